@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/user"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// batchSize is the number of records read or written between progress
+// reports and import checkpoints.
+const batchSize = 100
+
+// record is a line of an export file. Users come before the actions that
+// reference them.
+type record struct {
+	Kind   string         `json:"kind"`
+	User   *user.User     `json:"user,omitempty"`
+	Action *action.Action `json:"action,omitempty"`
+}
+
+// Export writes every user and action to the file as newline delimited JSON.
+// Password hashes are left out when redact is set.
+func Export(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, file string, redact bool) error {
+	if file == "" {
+		fmt.Println("help: export <file> [redact]")
+		return ErrHelp
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrap(err, "creating export file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	gql := data.NewGraphQL(gqlConfig)
+	users := user.NewStore(log, gql)
+	actions := action.NewStore(log, gql)
+	traceID := uuid.New().String()
+
+	var count int
+	for offset := 0; ; offset += batchSize {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		usrs, err := users.QueryAll(ctx, traceID, offset, batchSize)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "reading users at %d", offset)
+		}
+
+		for i := range usrs {
+			if redact {
+				usrs[i].PasswordHash = ""
+			}
+			if err := enc.Encode(record{Kind: "user", User: &usrs[i]}); err != nil {
+				return errors.Wrap(err, "writing user")
+			}
+		}
+
+		count += len(usrs)
+		fmt.Printf("exported %d users\n", count)
+
+		if len(usrs) < batchSize {
+			break
+		}
+	}
+
+	count = 0
+	for offset := 0; ; offset += batchSize {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		acts, err := actions.QueryAll(ctx, traceID, offset, batchSize)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "reading actions at %d", offset)
+		}
+
+		for i := range acts {
+			if err := enc.Encode(record{Kind: "action", Action: &acts[i]}); err != nil {
+				return errors.Wrap(err, "writing action")
+			}
+		}
+
+		count += len(acts)
+		fmt.Printf("exported %d actions\n", count)
+
+		if len(acts) < batchSize {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "writing export file")
+	}
+
+	return f.Close()
+}
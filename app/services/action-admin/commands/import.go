@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/user"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// checkpoint records how far an import got, so an interrupted import picks
+// up where it stopped. Users maps the ids in the file to the ids in the
+// database.
+type checkpoint struct {
+	Line  int               `json:"line"`
+	Users map[string]string `json:"users"`
+}
+
+// Import restores the users and actions of an export file. Records that
+// already exist are matched by email or name and kept as they are, so an
+// import can be run again safely. Actions are pointed at the new ids of
+// their users.
+func Import(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, file string) error {
+	if file == "" {
+		fmt.Println("help: import <file>")
+		return ErrHelp
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "opening import file")
+	}
+	defer f.Close()
+
+	progress := file + ".progress"
+	cp, err := readCheckpoint(progress)
+	if err != nil {
+		return err
+	}
+	if cp.Line > 0 {
+		fmt.Printf("resuming after line %d\n", cp.Line)
+	}
+
+	gql := data.NewGraphQL(gqlConfig)
+	users := user.NewStore(log, gql)
+	actions := action.NewStore(log, gql)
+	traceID := uuid.New().String()
+
+	var added, existing, redacted int
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var line int
+	for scanner.Scan() {
+		line++
+		if line <= cp.Line {
+			continue
+		}
+
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return errors.Wrapf(err, "decoding line %d", line)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		created, err := restore(ctx, traceID, users, actions, rec, cp.Users, &redacted)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "restoring line %d", line)
+		}
+
+		if created {
+			added++
+		} else {
+			existing++
+		}
+
+		if line%batchSize == 0 {
+			cp.Line = line
+			if err := writeCheckpoint(progress, cp); err != nil {
+				return err
+			}
+			fmt.Printf("imported %d records\n", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "reading import file")
+	}
+
+	if err := os.Remove(progress); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing checkpoint")
+	}
+
+	fmt.Printf("import complete: %d added, %d already existed\n", added, existing)
+	if redacted > 0 {
+		fmt.Printf("%d users were exported without passwords and can't log in with one\n", redacted)
+	}
+
+	return nil
+}
+
+// restore adds the record to the database unless it already exists. It
+// returns true when the record was added.
+func restore(ctx context.Context, traceID string, users user.Store, actions action.Store, rec record, ids map[string]string, redacted *int) (bool, error) {
+	switch {
+	case rec.Kind == "user" && rec.User != nil:
+		usr := *rec.User
+
+		// Redacted users get a password nobody knows.
+		if usr.PasswordHash == "" {
+			hash, err := unusablePassword()
+			if err != nil {
+				return false, err
+			}
+			usr.PasswordHash = hash
+			*redacted++
+		}
+
+		nu, err := users.Restore(ctx, traceID, usr)
+		if err != nil && errors.Cause(err) != user.ErrExists {
+			return false, err
+		}
+		ids[rec.User.ID] = nu.ID
+		return err == nil, nil
+
+	case rec.Kind == "action" && rec.Action != nil:
+		act := *rec.Action
+		if id, ok := ids[act.User]; ok {
+			act.User = id
+		}
+
+		_, err := actions.Restore(ctx, traceID, act)
+		if err != nil && errors.Cause(err) != action.ErrExists {
+			return false, err
+		}
+		return err == nil, nil
+	}
+
+	return false, fmt.Errorf("unknown record kind %q", rec.Kind)
+}
+
+// unusablePassword returns the hash of a random password.
+func unusablePassword() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "reading random")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(b, bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "generating password hash")
+	}
+
+	return string(hash), nil
+}
+
+// readCheckpoint returns the checkpoint of an earlier import of the file.
+func readCheckpoint(path string) (checkpoint, error) {
+	cp := checkpoint{
+		Users: make(map[string]string),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return checkpoint{}, errors.Wrap(err, "reading checkpoint")
+	}
+
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return checkpoint{}, errors.Wrap(err, "decoding checkpoint")
+	}
+	if cp.Users == nil {
+		cp.Users = make(map[string]string)
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint so a crash never leaves half of one.
+func writeCheckpoint(path string, cp checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "encoding checkpoint")
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "writing checkpoint")
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "writing checkpoint")
+	}
+
+	return nil
+}
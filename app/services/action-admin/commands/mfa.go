@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/mfa"
+	"github.com/jnkroeker/makulu/business/data/user"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// MFA enrolls a second factor for a user. When a code is provided the
+// pending enrollment is confirmed instead. This is how admins enroll when
+// the api requires a second factor before it hands them a token.
+func MFA(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, email string, code string) error {
+	if email == "" {
+		fmt.Println("help: mfa <email> [code]")
+		return ErrHelp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	gql := data.NewGraphQL(gqlConfig)
+	users := user.NewStore(log, gql)
+	store := mfa.NewStore(log, gql)
+	traceID := uuid.New().String()
+
+	usr, err := users.QueryByEmail(ctx, traceID, email)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	if code != "" {
+		if err := store.Confirm(ctx, traceID, usr.ID, code, time.Now()); err != nil {
+			return errors.Wrap(err, "confirming mfa")
+		}
+		fmt.Println("mfa enabled for:", usr.Email)
+		return nil
+	}
+
+	enr, _, err := store.Enroll(ctx, traceID, usr.ID, "makulu", usr.Email, "", time.Now())
+	if err != nil {
+		return errors.Wrap(err, "enrolling mfa")
+	}
+
+	fmt.Println("secret:", enr.Secret)
+	fmt.Println("uri:", enr.URI)
+	fmt.Println("recovery codes:")
+	for _, rc := range enr.RecoveryCodes {
+		fmt.Println("  ", rc)
+	}
+	fmt.Printf("confirm with: mfa %s <code>\n", usr.Email)
+	return nil
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/schema"
+	"github.com/pkg/errors"
+)
+
+// Migrate manages the versions of the schema in the database.
+func Migrate(gqlConfig data.GraphQLConfig, keysFolder string, activeKID string, action string) error {
+	switch action {
+	case "up", "status", "diff":
+	default:
+		fmt.Println("help: migrate <up|status|diff>")
+		return ErrHelp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := data.Validate(ctx, gqlConfig.URL, 5*time.Second); err != nil {
+		return errors.Wrap(err, "waiting for database to be ready")
+	}
+
+	schemaConfig, err := newSchemaConfig(gqlConfig, keysFolder, activeKID)
+	if err != nil {
+		return err
+	}
+
+	sch, err := schema.New(data.NewGraphQL(gqlConfig), schemaConfig)
+	if err != nil {
+		return errors.Wrap(err, "preparing schema")
+	}
+
+	switch action {
+	case "up":
+		applied, err := sch.Migrate(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+			return nil
+		}
+		for _, v := range applied {
+			fmt.Printf("applied version %d: %s\n", v.Number, v.Name)
+		}
+
+	case "status":
+		st, err := sch.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied version: %d\n", st.Applied)
+		fmt.Printf("latest version:  %d\n", st.Latest)
+		for _, v := range st.Pending {
+			fmt.Printf("pending version %d: %s\n", v.Number, v.Name)
+		}
+		if st.Drift {
+			fmt.Println("schema in the database doesn't match the applied version")
+		}
+
+	case "diff":
+		diff, err := sch.Diff(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Print(diff)
+	}
+
+	return nil
+}
@@ -2,18 +2,28 @@ package commands
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/jnkroeker/makulu/business/data"
 	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/schema"
 	"github.com/jnkroeker/makulu/business/data/user"
 	"github.com/jnkroeker/makulu/business/feeds/loader"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/foundation/keystore"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-// Schema handles the updating of the schema.
-func Schema(gqlConfig data.GraphQLConfig) error {
-	if err := loader.UpdateSchema(gqlConfig); err != nil {
+// Schema handles the updating of the schema. The database is told to verify
+// tokens with the public key of the active key.
+func Schema(gqlConfig data.GraphQLConfig, keysFolder string, activeKID string) error {
+	schemaConfig, err := newSchemaConfig(gqlConfig, keysFolder, activeKID)
+	if err != nil {
+		return err
+	}
+
+	if err := loader.UpdateSchema(gqlConfig, schemaConfig); err != nil {
 		return err
 	}
 
@@ -21,6 +31,34 @@ func Schema(gqlConfig data.GraphQLConfig) error {
 	return nil
 }
 
+// newSchemaConfig constructs the schema configuration for the database the
+// GraphQL configuration points at.
+func newSchemaConfig(gqlConfig data.GraphQLConfig, keysFolder string, activeKID string) (schema.Config, error) {
+	ks, err := keystore.NewFS(os.DirFS(keysFolder))
+	if err != nil {
+		return schema.Config{}, fmt.Errorf("reading keys: %w", err)
+	}
+
+	a, err := auth.New(activeKID, ks)
+	if err != nil {
+		return schema.Config{}, fmt.Errorf("constructing auth: %w", err)
+	}
+
+	publicKey, err := a.PublicKeyPEM()
+	if err != nil {
+		return schema.Config{}, err
+	}
+
+	schemaConfig := schema.Config{
+		Authorization: schema.Authorization{
+			Header:    gqlConfig.AuthHeaderName,
+			PublicKey: publicKey,
+		},
+	}
+
+	return schemaConfig, nil
+}
+
 func Seed(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, config loader.Config) error {
 	// if os.Getenv("ACTION_API_KEYS_MAPS_KEY") == "" {
 	// 	return errors.New("ACTION_API_KEYS_MAPS_KEY is not set with map key")
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/lockout"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Unlock clears the failed login state for an account and optionally for
+// the address of a client.
+func Unlock(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, email string, ip string) error {
+	if email == "" {
+		fmt.Println("help: unlock <email> [ip]")
+		return ErrHelp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := lockout.NewStore(
+		log,
+		data.NewGraphQL(gqlConfig),
+		lockout.Config{},
+	)
+	traceID := uuid.New().String()
+
+	keys := []string{lockout.AccountKey(email)}
+	if ip != "" {
+		keys = append(keys, lockout.IPKey(ip))
+	}
+
+	for _, key := range keys {
+		if err := store.Reset(ctx, traceID, key); err != nil {
+			return errors.Wrapf(err, "unlocking %s", key)
+		}
+		log.Infow("AUDIT", "traceid", traceID, "event", "unlock", "key", key)
+		fmt.Println("unlocked:", key)
+	}
+
+	return nil
+}
@@ -48,6 +48,10 @@ func run(log *zap.SugaredLogger) error {
 			AuthHeaderName string `conf:"default:X-Action-Auth"`
 			AuthToken      string
 		}
+		Auth struct {
+			KeysFolder string `conf:"default:zarf/keys/"`
+			ActiveKID  string `conf:"default:54bb2165-71e1-41a6-af3e-7da4a0e1e2c1"`
+		}
 		Search struct {
 			Categories []string `conf:"default:cycling;skiing;crossfit"`
 			// Radius     int      `conf:"default:5000"`
@@ -108,10 +112,29 @@ func run(log *zap.SugaredLogger) error {
 	switch cfg.Args.Num(0) {
 	case "schema":
 
-		if err := commands.Schema(gqlConfig); err != nil {
+		if err := commands.Schema(gqlConfig, cfg.Auth.KeysFolder, cfg.Auth.ActiveKID); err != nil {
 			return errors.Wrap(err, "updating schema")
 		}
 
+	case "migrate":
+		action := cfg.Args.Num(1)
+		if err := commands.Migrate(gqlConfig, cfg.Auth.KeysFolder, cfg.Auth.ActiveKID, action); err != nil {
+			return errors.Wrap(err, "migrating schema")
+		}
+
+	case "export":
+		file := cfg.Args.Num(1)
+		redact := cfg.Args.Num(2) == "redact"
+		if err := commands.Export(log, gqlConfig, file, redact); err != nil {
+			return errors.Wrap(err, "exporting data")
+		}
+
+	case "import":
+		file := cfg.Args.Num(1)
+		if err := commands.Import(log, gqlConfig, file); err != nil {
+			return errors.Wrap(err, "importing data")
+		}
+
 	case "seed":
 		config := loader.Config{
 			Filter: loader.Filter{
@@ -139,6 +162,18 @@ func run(log *zap.SugaredLogger) error {
 		if err := commands.GetUser(log, gqlConfig, email); err != nil {
 			return errors.Wrap(err, "getting user")
 		}
+	case "unlock":
+		email := cfg.Args.Num(1)
+		ip := cfg.Args.Num(2)
+		if err := commands.Unlock(log, gqlConfig, email, ip); err != nil {
+			return errors.Wrap(err, "unlocking account")
+		}
+	case "mfa":
+		email := cfg.Args.Num(1)
+		code := cfg.Args.Num(2)
+		if err := commands.MFA(log, gqlConfig, email, code); err != nil {
+			return errors.Wrap(err, "enrolling mfa")
+		}
 	case "genkey":
 		if err := commands.GenKey(); err != nil {
 			return errors.Wrap(err, "key generation")
@@ -151,9 +186,14 @@ func run(log *zap.SugaredLogger) error {
 		}
 	default:
 		fmt.Println("schema: create the schema in the database")
+		fmt.Println("migrate: apply, show or diff the versions of the schema")
 		fmt.Println("seed: add data to the database")
+		fmt.Println("export: write users and actions to a newline delimited JSON file")
+		fmt.Println("import: restore users and actions from an export file")
 		fmt.Println("adduser: add a new user to the database")
 		fmt.Println("getuser: get a list of users from the database")
+		fmt.Println("unlock: clear a login lockout for an account and client address")
+		fmt.Println("mfa: enroll or confirm a second factor for a user")
 		fmt.Println("genkey: generate a set of private/public key files")
 		fmt.Println("gentoken: generate a JWT for a user with claims")
 		fmt.Println("provide a command to get more help.")
@@ -9,22 +9,30 @@ import (
 	"time"
 
 	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/foundation/web"
 	"go.uber.org/zap"
 )
 
+// readinessTimeout is how long Readiness waits for the database, under the
+// 5 seconds the probe waits for an answer.
+const readinessTimeout = 4 * time.Second
+
 type Handlers struct {
-	Build     string
-	GqlConfig data.GraphQLConfig
-	Log       *zap.SugaredLogger
+	Build      string
+	GqlConfig  data.GraphQLConfig
+	Log        *zap.SugaredLogger
+	RouteTable []web.Route
 }
 
+// Readiness checks the database can be reached. The check gives up before
+// the probe does, and as soon as the probe goes away.
 func (h Handlers) Readiness(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
 	defer cancel()
 
 	status := "ok"
 	statusCode := http.StatusOK
-	err := data.Validate(ctx, h.GqlConfig.URL, 5*time.Second)
+	err := data.Validate(ctx, h.GqlConfig.URL, time.Second)
 	if err != nil {
 		status = "db not ready"
 		statusCode = http.StatusInternalServerError
@@ -77,6 +85,16 @@ func (h Handlers) Liveness(w http.ResponseWriter, r *http.Request) {
 	h.Log.Infow("liveness", "statusCode", statusCode, "method", r.Method, "path", r.URL.Path, "remoteaddr", r.RemoteAddr)
 }
 
+// Routes lists the routes of the api with the handlers bound to them.
+func (h Handlers) Routes(w http.ResponseWriter, r *http.Request) {
+	statusCode := http.StatusOK
+	if err := response(w, statusCode, h.RouteTable); err != nil {
+		h.Log.Errorw("routes", "ERROR", err)
+	}
+
+	h.Log.Infow("routes", "statusCode", statusCode, "method", r.Method, "path", r.URL.Path, "remoteaddr", r.RemoteAddr)
+}
+
 func response(w http.ResponseWriter, statusCode int, data interface{}) error {
 	// Convert the response value to JSON
 	jsonData, err := json.Marshal(data)
@@ -7,21 +7,43 @@ package handlers
 // We can't use the default server mux in production, because it is unclear what other endpoints are bound to it.
 // We add the endpoints to a new mux in this package.
 import (
+	"context"
 	"expvar"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"time"
 
 	"github.com/jnkroeker/makulu/app/services/action-api/handlers/debug/checkgrp"
 	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/actiongrp"
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/auditgrp"
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/docgrp"
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/keygrp"
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/oidcgrp"
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/orggrp"
 	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/testgrp"
 	"github.com/jnkroeker/makulu/app/services/action-api/handlers/v1/usergrp"
 	"github.com/jnkroeker/makulu/business/data"
 	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/apikey"
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/data/cache"
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/business/data/lockout"
+	"github.com/jnkroeker/makulu/business/data/mfa"
+	"github.com/jnkroeker/makulu/business/data/org"
 	"github.com/jnkroeker/makulu/business/data/user"
 	"github.com/jnkroeker/makulu/business/feeds/loader"
 	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/metrics"
+	"github.com/jnkroeker/makulu/business/sys/oidc"
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	v1Web "github.com/jnkroeker/makulu/business/web/v1"
 	"github.com/jnkroeker/makulu/business/web/v1/mid"
+	"github.com/jnkroeker/makulu/foundation/geojson"
+	"github.com/jnkroeker/makulu/foundation/msgpack"
+	"github.com/jnkroeker/makulu/foundation/trace"
 	"github.com/jnkroeker/makulu/foundation/web"
 	"go.uber.org/zap"
 )
@@ -40,33 +62,78 @@ func DebugStandardLibraryMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", metrics.Handler())
 
 	return mux
 }
 
-func DebugMux(build string, log *zap.SugaredLogger, gqlConfig data.GraphQLConfig) http.Handler {
+func DebugMux(build string, log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, routes []web.Route) http.Handler {
 	mux := DebugStandardLibraryMux()
 
 	// Register debug check endpoints.
 	cgh := checkgrp.Handlers{
-		Build:     build,
-		GqlConfig: gqlConfig,
-		Log:       log,
+		Build:      build,
+		GqlConfig:  gqlConfig,
+		Log:        log,
+		RouteTable: routes,
 	}
 	mux.HandleFunc("/debug/readiness", cgh.Readiness)
 	mux.HandleFunc("/debug/liveness", cgh.Liveness)
+	mux.HandleFunc("/debug/routes", cgh.Routes)
 
 	return mux
 }
 
 // APIMuxConfig contains all the mandatory systems required by handlers.
 type APIMuxConfig struct {
-	Shutdown chan os.Signal
-	Log      *zap.SugaredLogger
+	Build          string
+	Shutdown       chan os.Signal
+	ShutdownPolicy web.ShutdownPolicy
+	MaxBodySize    int64
+	Compress       mid.CompressConfig
+	Timeouts       TimeoutConfig
+	Log            *zap.SugaredLogger
 	// Metrics  *metrics.Metrics
-	Auth   *auth.Auth
-	DB     data.GraphQLConfig
-	Loader loader.Config
+	Auth    *auth.Auth
+	DB      data.GraphQLConfig
+	Cache   cache.Cache
+	Tracer  *trace.Tracer
+	Audit   *audit.Auditor
+	Limiter *ratelimit.Limiter
+	CORS    web.CORSConfig
+	Loader  loader.Config
+	Lockout lockout.Config
+	OIDC    OIDCConfig
+
+	// AddressLimiter limits callers by address before they are
+	// authenticated.
+	AddressLimiter *ratelimit.Limiter
+
+	Idempotency IdempotencyConfig
+}
+
+// TimeoutConfig contains how long requests may take. Routes that hash
+// passwords, scan the audit trail or wait on the identity provider get the
+// slow timeout, the others the default one.
+type TimeoutConfig struct {
+	Default time.Duration
+	Slow    time.Duration
+}
+
+// IdempotencyConfig contains where the responses to requests with an
+// Idempotency-Key are kept and for how long. Without a store the header is
+// ignored.
+type IdempotencyConfig struct {
+	Store  idempotency.Store
+	Window time.Duration
+}
+
+// OIDCConfig contains the settings for logins through an external identity
+// provider. These logins are disabled when no issuer is configured.
+type OIDCConfig struct {
+	Provider      oidc.Config
+	DefaultRole   string
+	AutoProvision bool
 }
 
 // APIMux constructs an http.Handler with all application routes defined.
@@ -79,10 +146,38 @@ func APIMux(cfg APIMuxConfig) *web.App {
 	app := web.NewApp(
 		cfg.Shutdown,
 		mid.Logger(cfg.Log),
-		mid.Errors(cfg.Log),
+		mid.Compress(cfg.Compress),
 		mid.Metrics(),
+		mid.Errors(cfg.Log),
 		mid.Panics(),
+		mid.Timeout(cfg.Log, mid.TimeoutConfig{
+			Default: cfg.Timeouts.Default,
+			Routes: map[string]time.Duration{
+				"GET /v1/users/token":   cfg.Timeouts.Slow,
+				"POST /v1/users":        cfg.Timeouts.Slow,
+				"PUT /v1/user/:id":      cfg.Timeouts.Slow,
+				"GET /v1/audit":         cfg.Timeouts.Slow,
+				"GET /v1/oidc/callback": cfg.Timeouts.Slow,
+			},
+		}),
 	)
+	app.SetTracer(cfg.Tracer)
+	app.SetShutdownPolicy(cfg.ShutdownPolicy)
+	app.SetMaxBodySize(cfg.MaxBodySize)
+
+	// Mobile clients ask for MessagePack and the map for GeoJSON.
+	app.AddEncoders(msgpack.Encoder{}, geojson.Encoder{})
+
+	// The browser frontend is served from another origin.
+	if len(cfg.CORS.Origins) > 0 {
+		app.EnableCORS(cfg.CORS)
+	}
+
+	// Errors that only failed the request, like a client that went away
+	// before the response was written, are logged.
+	app.SetErrorHook(func(ctx context.Context, r *http.Request, err error) {
+		cfg.Log.Errorw("request failed", "traceid", web.GetTraceID(ctx), "method", r.Method, "path", r.URL.Path, "ERROR", err)
+	})
 
 	v1(app, cfg)
 
@@ -91,13 +186,43 @@ func APIMux(cfg APIMuxConfig) *web.App {
 
 // v1 binds all the version 1 routes.
 func v1(app *web.App, cfg APIMuxConfig) {
-	const version = "v1"
+	const version = "/v1"
+
+	// Every route is rate limited, authenticated callers by who they are.
+	// Their address is limited before that, so failing to authenticate
+	// isn't free.
+	limit := mid.RateLimit(cfg.Log, cfg.Limiter)
+	limitAddress := mid.RateLimitAddress(cfg.Log, cfg.AddressLimiter)
+
+	// Responses for a caller are only kept by their browser, which checks
+	// with the ETag that they are still current. Responses with credentials
+	// aren't kept at all.
+	private := mid.CacheControl("private, no-cache")
+	noStore := mid.CacheControl("no-store")
+
+	// Credentials are only managed by users who logged in, never with an
+	// api key.
+	login := mid.RequireLogin(cfg.Audit)
+
+	// Changes name the version of the entity they change.
+	ifMatch := []web.HeaderParam{{Name: "If-Match", Description: "ETag of the version to change.", Required: true}}
+
+	// Requests that create things can be retried with an Idempotency-Key.
+	idempotent := mid.Idempotency(cfg.Log, cfg.Idempotency.Store, cfg.Idempotency.Window)
+
+	// Routes are grouped by who can call them. Scopes required by single
+	// routes are added to the routes themselves.
+	public := app.Group(version, limit)
+	authed := app.Group(version, limitAddress, mid.Authenticate(cfg.Auth), limit, private).Secure("bearer", "apiKey")
+	admin := authed.Group("", mid.Authorize(cfg.Audit, auth.RoleAdmin))
 
 	tgh := testgrp.Handlers{
 		Log: cfg.Log,
 	}
-	app.Handle(http.MethodGet, version, "/test", tgh.Test)
-	app.Handle(http.MethodGet, version, "/testauth", tgh.Test, mid.Authenticate(cfg.Auth), mid.Authorize("ADMIN"))
+	public.Handle(http.MethodGet, "/test", tgh.Test).
+		Describe(web.Doc{Summary: "Check the api responds", Response: testgrp.Status{}})
+	admin.Handle(http.MethodGet, "/testauth", tgh.Test).
+		Describe(web.Doc{Summary: "Check the api authenticates admins", Response: testgrp.Status{}})
 
 	// TODO: connect to Strava API using feedgrp
 
@@ -106,27 +231,182 @@ func v1(app *web.App, cfg APIMuxConfig) {
 	// 	GqlConfig:    cfg.DB,
 	// 	LoaderConfig: cfg.Loader,
 	// }
-	// app.Handle(http.MethodPost, version, "/feed/upload", fg.Upload)
+	// authed.Handle(http.MethodPost, "/feed/upload", fg.Upload)
+
+	// Credentials, lockouts and organizations are only changed by the service
+	// once the handlers authorized the caller, the database keeps them from
+	// the tokens of callers. The service also reaches users for callers
+	// limited to an organization, which the database knows nothing of.
+	service := cfg.DB
+	service.CallerToken = nil
 
 	act := actiongrp.Handlers{
 		ActionStore: action.NewStore(
 			cfg.Log,
 			data.NewGraphQL(cfg.DB),
-		),
+		).WithCache(cfg.Cache),
+		Audit: cfg.Audit,
 	}
-	app.Handle(http.MethodPost, version, "/action", act.Create, mid.Authenticate(cfg.Auth))
-	app.Handle(http.MethodGet, version, "/action/:id", act.QueryByID, mid.Authenticate(cfg.Auth))
-	app.Handle(http.MethodGet, version, "/action/user/:user", act.QueryByUser, mid.Authenticate(cfg.Auth))
+	authed.Handle(http.MethodPost, "/action", act.Create, mid.RequireScope(cfg.Audit, auth.ScopeActionsWrite), idempotent).
+		Describe(web.Doc{Summary: "Record an action", Request: action.NewAction{}, Response: action.Action{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodGet, "/action/:id", act.QueryByID, mid.RequireScope(cfg.Audit, auth.ScopeActionsRead)).
+		Describe(web.Doc{Summary: "Get an action", Response: action.Action{}})
+	authed.Handle(http.MethodPut, "/action/:id", act.Update, mid.RequireScope(cfg.Audit, auth.ScopeActionsWrite)).
+		Describe(web.Doc{Summary: "Change an action", Request: action.UpdateAction{}, Response: action.Action{}, Headers: ifMatch})
+	authed.Handle(http.MethodDelete, "/action/:id", act.Delete, mid.RequireScope(cfg.Audit, auth.ScopeActionsWrite)).
+		Describe(web.Doc{Summary: "Remove an action", Status: http.StatusNoContent, Headers: ifMatch})
+	authed.Handle(http.MethodGet, "/action/user/:user", act.QueryByUser, mid.RequireScope(cfg.Audit, auth.ScopeActionsRead)).
+		Describe(web.Doc{Summary: "Get the action of a user", Response: action.Action{}})
 
 	usr := usergrp.Handlers{
 		UserStore: user.NewStore(
 			cfg.Log,
 			data.NewGraphQL(cfg.DB),
+		).WithCache(cfg.Cache).WithService(data.NewGraphQL(service)),
+		LockoutStore: lockout.NewStore(
+			cfg.Log,
+			data.NewGraphQL(service),
+			cfg.Lockout,
 		),
-		Auth: cfg.Auth,
+		MFAStore: mfa.NewStore(
+			cfg.Log,
+			data.NewGraphQL(service),
+		),
+		OrgStore: org.NewStore(
+			cfg.Log,
+			data.NewGraphQL(cfg.DB),
+		),
+		Auth:  cfg.Auth,
+		Audit: cfg.Audit,
+	}
+	public.Handle(http.MethodGet, "/users/token", usr.Token, noStore).
+		Describe(web.Doc{
+			Summary:  "Log in with email and password",
+			Response: web.OneOf{v1Web.Token{}, v1Web.Challenge{}},
+			Query:    []web.QueryParam{{Name: "org", Description: "Limit the token to an organization of the user."}},
+			Security: []string{"basic"},
+		})
+	public.Handle(http.MethodPost, "/users/token/mfa", usr.TokenMFA, noStore).
+		Describe(web.Doc{
+			Summary:  "Complete a login with a one-time password",
+			Request:  usergrp.MFALogin{},
+			Response: v1Web.Token{},
+			Query:    []web.QueryParam{{Name: "org", Description: "Limit the token to an organization of the user."}},
+		})
+	authed.Handle(http.MethodPost, "/users/mfa", usr.EnrollMFA, login, noStore).
+		Describe(web.Doc{Summary: "Enroll a second factor", Request: mfa.NewEnrollment{}, OptionalRequest: true, Response: mfa.Enrollment{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodPost, "/users/mfa/confirm", usr.ConfirmMFA, login).
+		Describe(web.Doc{Summary: "Enable the enrolled second factor", Request: mfa.Code{}, Status: http.StatusNoContent})
+	authed.Handle(http.MethodPost, "/users", usr.Create, mid.RequireScope(cfg.Audit, auth.ScopeUsersAdmin), idempotent).
+		Describe(web.Doc{Summary: "Create a user", Request: user.NewUser{}, Response: user.User{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodGet, "/user/:id", usr.QueryByID, mid.RequireScope(cfg.Audit, auth.ScopeUsersRead)).
+		Describe(web.Doc{Summary: "Get a user", Response: user.User{}})
+	authed.Handle(http.MethodPut, "/user/:id", usr.Update, login, mid.RequireScope(cfg.Audit, auth.ScopeUsersWrite)).
+		Describe(web.Doc{Summary: "Change a user", Request: user.UpdateUser{}, Response: user.User{}, Headers: ifMatch})
+	admin.Handle(http.MethodDelete, "/user/:id", usr.Delete, mid.RequireScope(cfg.Audit, auth.ScopeUsersAdmin)).
+		Describe(web.Doc{Summary: "Remove a user", Status: http.StatusNoContent, Headers: ifMatch})
+	authed.Handle(http.MethodGet, "/user/email/:email", usr.QueryByEmail, mid.RequireScope(cfg.Audit, auth.ScopeUsersRead)).
+		Describe(web.Doc{Summary: "Get a user by email", Response: user.User{}})
+
+	key := keygrp.Handlers{
+		KeyStore: apikey.NewStore(
+			cfg.Log,
+			data.NewGraphQL(service),
+		),
+		Audit: cfg.Audit,
 	}
-	app.Handle(http.MethodPost, version, "/users", usr.Create, mid.Authenticate(cfg.Auth), mid.Authorize("ADMIN"))
-	app.Handle(http.MethodGet, version, "/user/:id", usr.QueryByID, mid.Authenticate(cfg.Auth))
-	app.Handle(http.MethodGet, version, "/user/email/:email", usr.QueryByEmail, mid.Authenticate(cfg.Auth))
+	authed.Handle(http.MethodGet, "/users/:id/keys", key.Query, login).
+		Describe(web.Doc{Summary: "List the api keys of a user", Response: []apikey.Key{}})
+	authed.Handle(http.MethodPost, "/users/:id/keys", key.Create, login, noStore).
+		Describe(web.Doc{Summary: "Create an api key", Request: apikey.NewKey{}, Response: apikey.CreatedKey{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodDelete, "/users/:id/keys/:keyid", key.Delete, login).
+		Describe(web.Doc{Summary: "Revoke an api key", Status: http.StatusNoContent})
 
+	og := orggrp.Handlers{
+		OrgStore: org.NewStore(
+			cfg.Log,
+			data.NewGraphQL(service),
+		),
+		ActionStore: action.NewStore(
+			cfg.Log,
+			data.NewGraphQL(cfg.DB),
+		).WithCache(cfg.Cache),
+		Audit: cfg.Audit,
+	}
+	authed.Handle(http.MethodPost, "/orgs", og.Create, mid.RequireScope(cfg.Audit, auth.ScopeOrgsCreate), idempotent).
+		Describe(web.Doc{Summary: "Create an organization", Request: org.NewOrganization{}, Response: org.Organization{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodGet, "/orgs/:id/members", og.QueryMembers, mid.RequireScope(cfg.Audit, auth.ScopeUsersRead)).
+		Describe(web.Doc{Summary: "List the members of an organization", Response: []org.Membership{}})
+	authed.Handle(http.MethodPost, "/orgs/:id/members", og.AddMember, mid.RequireScope(cfg.Audit, auth.ScopeUsersAdmin), idempotent).
+		Describe(web.Doc{Summary: "Add a member to an organization", Request: org.NewMembership{}, Response: org.Membership{}, Status: http.StatusCreated})
+	authed.Handle(http.MethodDelete, "/orgs/:id/members/:user", og.RemoveMember, mid.RequireScope(cfg.Audit, auth.ScopeUsersAdmin)).
+		Describe(web.Doc{Summary: "Remove a member from an organization", Status: http.StatusNoContent})
+	authed.Handle(http.MethodGet, "/orgs/:id/actions", og.QueryActions, mid.RequireScope(cfg.Audit, auth.ScopeActionsRead)).
+		Describe(web.Doc{Summary: "List the actions of an organization", Response: []action.Action{}})
+
+	aud := auditgrp.Handlers{
+		Audit: cfg.Audit,
+	}
+	admin.Handle(http.MethodGet, "/audit", aud.Query, mid.RequireGlobal(cfg.Audit)).
+		Describe(web.Doc{
+			Summary:  "Query the audit trail, newest first",
+			Response: []audit.Event{},
+			Query: []web.QueryParam{
+				{Name: "actor"},
+				{Name: "action"},
+				{Name: "target"},
+				{Name: "outcome"},
+				{Name: "from", Description: "Time in RFC 3339."},
+				{Name: "to", Description: "Time in RFC 3339."},
+				{Name: "limit", Description: "Number of events, 100 by default."},
+			},
+		})
+
+	if cfg.OIDC.Provider.Issuer != "" {
+		sso := oidcgrp.Handlers{
+			Log:      cfg.Log,
+			Provider: oidc.New(cfg.OIDC.Provider, &http.Client{Timeout: 10 * time.Second}),
+			UserStore: user.NewStore(
+				cfg.Log,
+				data.NewGraphQL(cfg.DB),
+			).WithCache(cfg.Cache),
+			MFAStore: mfa.NewStore(
+				cfg.Log,
+				data.NewGraphQL(service),
+			),
+			Auth:          cfg.Auth,
+			Audit:         cfg.Audit,
+			DefaultRole:   cfg.OIDC.DefaultRole,
+			AutoProvision: cfg.OIDC.AutoProvision,
+		}
+		public.Handle(http.MethodGet, "/oidc/login", sso.Login).
+			Describe(web.Doc{Summary: "Log in through the identity provider", Status: http.StatusFound})
+		public.Handle(http.MethodGet, "/oidc/callback", sso.Callback, noStore).
+			Describe(web.Doc{
+				Summary:  "Complete a login through the identity provider",
+				Response: web.OneOf{v1Web.Token{}, v1Web.Challenge{}},
+				Query:    []web.QueryParam{{Name: "state"}, {Name: "code"}, {Name: "error"}, {Name: "error_description"}},
+			})
+	}
+
+	doc := docgrp.Handlers{
+		App:    app,
+		Config: OpenAPIConfig(cfg.Build),
+	}
+	public.Handle(http.MethodGet, "/openapi.json", doc.OpenAPI, mid.CacheControl("public, max-age=300")).
+		Describe(web.Doc{Summary: "Get the OpenAPI document of the api"})
+}
+
+// OpenAPIConfig describes the api beyond its routes.
+func OpenAPIConfig(build string) web.OpenAPIConfig {
+	return web.OpenAPIConfig{
+		Title:   "action-api",
+		Version: build,
+		Error:   validate.ErrorResponse{},
+		SecuritySchemes: map[string]web.SecurityScheme{
+			"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			"apiKey": {Type: "apiKey", Name: "X-API-Key", In: "header", Description: "Also accepted as Authorization: ApiKey <key>."},
+			"basic":  {Type: "http", Scheme: "basic"},
+		},
+	}
 }
@@ -0,0 +1,72 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/jnkroeker/makulu/app/services/action-api/handlers"
+	"github.com/jnkroeker/makulu/business/sys/oidc"
+	"github.com/jnkroeker/makulu/foundation/tests"
+	"go.uber.org/zap"
+)
+
+// update rewrites the golden OpenAPI document instead of comparing with it:
+// go test ./app/services/action-api/handlers -update
+var update = flag.Bool("update", false, "update the golden OpenAPI document")
+
+const golden = "testdata/openapi.json"
+
+func TestOpenAPI(t *testing.T) {
+	app := handlers.APIMux(handlers.APIMuxConfig{
+		Build:    "test",
+		Shutdown: make(chan os.Signal, 1),
+		Log:      zap.NewNop().Sugar(),
+		OIDC: handlers.OIDCConfig{
+			Provider: oidc.Config{Issuer: "https://issuer.example.com"},
+		},
+	})
+
+	t.Log("Given the need to document the api for its clients.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen generating the OpenAPI document.", testID)
+		{
+			for _, route := range app.Routes() {
+				if route.Doc == nil {
+					t.Errorf("\t%s\tTest %d:\tShould document route %s %s.", tests.Failed, testID, route.Method, route.Path)
+				}
+			}
+			if t.Failed() {
+				t.FailNow()
+			}
+			t.Logf("\t%s\tTest %d:\tShould document every route.", tests.Success, testID)
+
+			got, err := json.MarshalIndent(app.OpenAPI(handlers.OpenAPIConfig("test")), "", "  ")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to marshal the document: %s.", tests.Failed, testID, err)
+			}
+			got = append(got, '\n')
+
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to update the document: %s.", tests.Failed, testID, err)
+				}
+			}
+
+			exp, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to read the document: %s.", tests.Failed, testID, err)
+			}
+
+			// Changing a model or the types of a route changes the document,
+			// which must be updated along with it so clients learn of it.
+			if !bytes.Equal(got, exp) {
+				t.Fatalf("\t%s\tTest %d:\tShould match %s, run the tests with -update if the change is intended.", tests.Failed, testID, golden)
+			}
+			t.Logf("\t%s\tTest %d:\tShould match %s.", tests.Success, testID, golden)
+		}
+	}
+}
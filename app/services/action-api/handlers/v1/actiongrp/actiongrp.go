@@ -7,6 +7,8 @@ import (
 	"net/http"
 
 	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/sys/auth"
 	"github.com/jnkroeker/makulu/business/sys/validate"
 	v1Web "github.com/jnkroeker/makulu/business/web/v1"
 	"github.com/jnkroeker/makulu/foundation/web"
@@ -15,6 +17,7 @@ import (
 // Handlers manages the set of user endpoints
 type Handlers struct {
 	ActionStore action.Store
+	Audit       *audit.Auditor
 	// Auth *auth.Auth
 }
 
@@ -28,25 +31,126 @@ func (h Handlers) Create(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return v1Web.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
 	var act action.NewAction
 	if err := web.Decode(r, &act); err != nil {
 		return fmt.Errorf("unable to decode payload: %w", err)
 	}
 
+	// Users record actions for themselves, only user admins for others.
+	if err := claims.Allowed(auth.OwnerOrAdmin, act.User); err != nil {
+		return v1Web.NewRequestError(err, http.StatusForbidden)
+	}
+
 	usr, err := h.ActionStore.Add(ctx, v.TraceID, act)
 	if err != nil {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionCreate, Target: act.Name, Outcome: audit.OutcomeFailure})
 		return fmt.Errorf("user[%+v]: %w", &usr, err)
 	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionCreate, Target: usr.ID, Outcome: audit.OutcomeSuccess})
 
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusCreated)
 }
 
+// Update changes the action, as long as it still has the version in the
+// If-Match header. Users change their own actions, admins anyone's.
+func (h Handlers) Update(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	actionID := web.Param(r, "id")
+
+	version, err := v1Web.Version(r)
+	if err != nil {
+		return err
+	}
+
+	var ua action.UpdateAction
+	if err := web.Decode(r, &ua); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	if err := h.authorize(ctx, v.TraceID, claims, actionID); err != nil {
+		return err
+	}
+
+	act, err := h.ActionStore.Update(ctx, v.TraceID, actionID, version, ua, v.Now)
+	if err != nil {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionUpdate, Target: actionID, Outcome: audit.OutcomeFailure})
+		switch {
+		case errors.Is(err, action.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("ID[%s]: %w", actionID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionUpdate, Target: actionID, Outcome: audit.OutcomeSuccess})
+
+	v1Web.SetVersion(w, act.Version)
+	return web.Respond(ctx, w, act, http.StatusOK)
+}
+
+// Delete removes the action, as long as it still has the version in the
+// If-Match header. Users remove their own actions, admins anyone's.
+func (h Handlers) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	actionID := web.Param(r, "id")
+
+	version, err := v1Web.Version(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.authorize(ctx, v.TraceID, claims, actionID); err != nil {
+		return err
+	}
+
+	if err := h.ActionStore.Delete(ctx, v.TraceID, actionID, version); err != nil {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionDelete, Target: actionID, Outcome: audit.OutcomeFailure})
+		switch {
+		case errors.Is(err, action.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("ID[%s]: %w", actionID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionActionDelete, Target: actionID, Outcome: audit.OutcomeSuccess})
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
 func (h Handlers) QueryByID(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	v, err := web.GetValues(ctx)
 	if err != nil {
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return v1Web.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
 	actionID := web.Param(r, "id")
 
 	usr, err := h.ActionStore.QueryByID(ctx, v.TraceID, actionID)
@@ -61,6 +165,11 @@ func (h Handlers) QueryByID(ctx context.Context, w http.ResponseWriter, r *http.
 		}
 	}
 
+	if err := claims.Allowed(auth.OwnerOrAdmin, usr.User); err != nil {
+		return v1Web.NewRequestError(err, http.StatusForbidden)
+	}
+
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusOK)
 }
 
@@ -70,8 +179,17 @@ func (h Handlers) QueryByUser(ctx context.Context, w http.ResponseWriter, r *htt
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return v1Web.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
 	user := web.Param(r, "user")
 
+	if err := claims.Allowed(auth.OwnerOrAdmin, user); err != nil {
+		return v1Web.NewRequestError(err, http.StatusForbidden)
+	}
+
 	usr, err := h.ActionStore.QueryByUser(ctx, v.TraceID, user)
 	if err != nil {
 		switch {
@@ -82,5 +200,29 @@ func (h Handlers) QueryByUser(ctx context.Context, w http.ResponseWriter, r *htt
 		}
 	}
 
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusOK)
 }
+
+// =============================================================================
+
+// authorize checks the caller owns the action or is an admin.
+func (h Handlers) authorize(ctx context.Context, traceID string, claims auth.Claims, actionID string) error {
+	act, err := h.ActionStore.QueryByID(ctx, traceID, actionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validate.ErrInvalidID):
+			return validate.NewRequestError(err, http.StatusBadRequest)
+		case errors.Is(err, action.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("ID[%s]: %w", actionID, err)
+		}
+	}
+
+	if err := claims.Allowed(auth.OwnerOrAdmin, act.User); err != nil {
+		return validate.NewRequestError(err, http.StatusForbidden)
+	}
+
+	return nil
+}
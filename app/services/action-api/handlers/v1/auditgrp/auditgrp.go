@@ -0,0 +1,56 @@
+package auditgrp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// Handlers manages the set of audit endpoints
+type Handlers struct {
+	Audit *audit.Auditor
+}
+
+// Query returns the recorded events, newest first. Events can be selected
+// by actor, action, target and outcome, and by time with from and to in
+// RFC 3339. The limit defaults to 100 events.
+func (h Handlers) Query(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	f := audit.Filter{
+		Actor:   q.Get("actor"),
+		Action:  q.Get("action"),
+		Target:  q.Get("target"),
+		Outcome: q.Get("outcome"),
+	}
+
+	var err error
+	if s := q.Get("from"); s != "" {
+		if f.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return validate.NewRequestError(fmt.Errorf("from must be RFC 3339: %w", err), http.StatusBadRequest)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if f.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return validate.NewRequestError(fmt.Errorf("to must be RFC 3339: %w", err), http.StatusBadRequest)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit <= 0 {
+			return validate.NewRequestError(fmt.Errorf("limit must be a positive number"), http.StatusBadRequest)
+		}
+	}
+
+	events, err := h.Audit.Query(ctx, f)
+	if err != nil {
+		return fmt.Errorf("querying events: %w", err)
+	}
+
+	return web.Respond(ctx, w, events, http.StatusOK)
+}
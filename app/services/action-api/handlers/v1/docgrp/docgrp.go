@@ -0,0 +1,21 @@
+// Package docgrp serves the documentation of the api.
+package docgrp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// Handlers manages the set of documentation endpoints.
+type Handlers struct {
+	App    *web.App
+	Config web.OpenAPIConfig
+}
+
+// OpenAPI returns the OpenAPI document of the routes of the api. It is
+// generated on every request, so it always lists every route.
+func (h Handlers) OpenAPI(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return web.Respond(ctx, w, h.App.OpenAPI(h.Config), http.StatusOK)
+}
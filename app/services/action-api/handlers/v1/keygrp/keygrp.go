@@ -0,0 +1,134 @@
+package keygrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jnkroeker/makulu/business/data/apikey"
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// Handlers manages the set of api key endpoints
+type Handlers struct {
+	KeyStore apikey.Store
+	Audit    *audit.Auditor
+}
+
+// Create issues a new key for the user. The key is only shown in this response.
+// It gets the scopes of the caller unless it asks for fewer.
+func (h Handlers) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	userID := web.Param(r, "id")
+	if err := authorize(ctx, userID); err != nil {
+		return err
+	}
+
+	var nk apikey.NewKey
+	if err := web.Decode(r, &nk); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	// A key never holds more than the caller, and a key without scopes would
+	// hold everything the role of its owner grants.
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+	if len(nk.Scopes) == 0 {
+		nk.Scopes = claims.Scopes
+	}
+	if len(nk.Scopes) == 0 {
+		return validate.NewRequestError(errors.New("the caller holds no scopes to give a key"), http.StatusForbidden)
+	}
+	for _, scope := range nk.Scopes {
+		if !claims.HasScopes(scope) {
+			return validate.NewRequestError(fmt.Errorf("scope %q is not held by the caller", scope), http.StatusForbidden)
+		}
+	}
+
+	key, err := h.KeyStore.Add(ctx, v.TraceID, userID, nk, v.Now)
+	if err != nil {
+		return fmt.Errorf("user[%s]: %w", userID, err)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionKeyCreate, Target: key.ID, Outcome: audit.OutcomeSuccess, Detail: "user " + userID})
+
+	return web.Respond(ctx, w, key, http.StatusCreated)
+}
+
+// Query returns the keys of the user without the keys themselves.
+func (h Handlers) Query(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	userID := web.Param(r, "id")
+	if err := authorize(ctx, userID); err != nil {
+		return err
+	}
+
+	keys, err := h.KeyStore.QueryByUser(ctx, v.TraceID, userID)
+	if err != nil {
+		return fmt.Errorf("user[%s]: %w", userID, err)
+	}
+
+	return web.Respond(ctx, w, keys, http.StatusOK)
+}
+
+// Delete revokes a key of the user.
+func (h Handlers) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	userID := web.Param(r, "id")
+	if err := authorize(ctx, userID); err != nil {
+		return err
+	}
+
+	keyID := web.Param(r, "keyid")
+
+	if err := h.KeyStore.Delete(ctx, v.TraceID, userID, keyID); err != nil {
+		switch {
+		case errors.Is(err, apikey.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("user[%s] key[%s]: %w", userID, keyID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionKeyRevoke, Target: keyID, Outcome: audit.OutcomeSuccess, Detail: "user " + userID})
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// =============================================================================
+
+// authorize allows user admins to manage any keys and users to manage their
+// own. Keys aren't limited to an organization, so callers that are may only
+// manage their own.
+func authorize(ctx context.Context, userID string) error {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	if claims.Tenant != "" && claims.Subject != userID {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	if err := claims.Allowed(auth.OwnerOrAdmin, userID); err != nil {
+		return validate.NewRequestError(err, http.StatusForbidden)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package oidcgrp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/data/mfa"
+	"github.com/jnkroeker/makulu/business/data/user"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/oidc"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	v1Web "github.com/jnkroeker/makulu/business/web/v1"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"go.uber.org/zap"
+)
+
+// Handlers manages the set of endpoints for logins through an external
+// identity provider.
+type Handlers struct {
+	Log           *zap.SugaredLogger
+	Provider      *oidc.Provider
+	UserStore     user.Store
+	MFAStore      mfa.Store
+	Auth          *auth.Auth
+	Audit         *audit.Auditor
+	DefaultRole   string
+	AutoProvision bool
+}
+
+// stateCookie is the cookie that keeps the login of a client while it is at
+// the identity provider.
+const stateCookie = "oidc_state"
+
+// Login sends the client to the identity provider to log in. The login is
+// kept in a signed cookie rather than by the instance, so any instance can
+// complete it, and only the client that started it can.
+func (h Handlers) Login(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	url, pnd, err := h.Provider.AuthURL(ctx, v.Now)
+	if err != nil {
+		return fmt.Errorf("building auth url: %w", err)
+	}
+
+	values := map[string]string{
+		"state":    pnd.State,
+		"nonce":    pnd.Nonce,
+		"verifier": pnd.Verifier,
+		"expires":  pnd.Expires.Format(time.RFC3339Nano),
+	}
+	state, err := h.Auth.GenerateState(values, v.Now, pnd.Expires)
+	if err != nil {
+		return fmt.Errorf("generating state: %w", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/v1/oidc",
+		Expires:  pnd.Expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return web.Redirect(ctx, w, r, url, http.StatusFound)
+}
+
+// Callback completes a login when the identity provider sends the client
+// back. The identity is mapped to a user and a token for that user is
+// returned. Users with a second factor get a challenge instead, like with a
+// password.
+func (h Handlers) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	// The login can only be completed once.
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Path:     "/v1/oidc",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		err := fmt.Errorf("identity provider: %s: %s", e, q.Get("error_description"))
+		return validate.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	var pnd oidc.Pending
+	if c, err := r.Cookie(stateCookie); err == nil {
+		if values, err := h.Auth.ValidateState(c.Value); err == nil {
+			expires, _ := time.Parse(time.RFC3339Nano, values["expires"])
+			pnd = oidc.Pending{
+				State:    values["state"],
+				Nonce:    values["nonce"],
+				Verifier: values["verifier"],
+				Expires:  expires,
+			}
+		}
+	}
+
+	id, err := h.Provider.Exchange(ctx, pnd, q.Get("state"), q.Get("code"), v.Now)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrUnknownState), errors.Is(err, oidc.ErrInvalidToken):
+			h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionLogin, Outcome: audit.OutcomeFailure, Detail: err.Error()})
+			return validate.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return fmt.Errorf("exchanging code: %w", err)
+		}
+	}
+
+	usr, err := h.user(ctx, r, v.TraceID, id)
+	if err != nil {
+		return err
+	}
+
+	enabled, err := h.MFAStore.Enabled(ctx, v.TraceID, usr.ID)
+	if err != nil {
+		return fmt.Errorf("checking mfa: %w", err)
+	}
+
+	// Users who enabled a second factor here must provide it, whatever the
+	// provider checked. The challenge is exchanged for a token with a code.
+	if enabled {
+		h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeSuccess, Detail: id.Issuer + ": mfa required"})
+		chl := v1Web.Challenge{MFARequired: true}
+		chl.Challenge, err = h.Auth.GenerateChallenge(usr.ID, v.Now, auth.AMRExternal)
+		if err != nil {
+			return fmt.Errorf("generating challenge: %w", err)
+		}
+		return web.Respond(ctx, w, chl, http.StatusOK)
+	}
+
+	// Otherwise a second factor at the provider counts as a second factor
+	// here, for the roles that require one.
+	amr := []string{auth.AMRExternal}
+	for _, m := range id.AMR {
+		if m == "mfa" || m == "otp" {
+			amr = append(amr, auth.AMROTP)
+			break
+		}
+	}
+
+	var tkn v1Web.Token
+	tkn.Token, err = h.Auth.GenerateToken(user.NewClaims(usr, v.Now, amr...))
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrMFARequired):
+			h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeDenied, Detail: id.Issuer + ": mfa required"})
+			return validate.NewRequestError(err, http.StatusForbidden)
+		default:
+			return fmt.Errorf("generating token: %w", err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeSuccess, Detail: id.Issuer})
+	h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionTokenIssue, Target: usr.ID, Outcome: audit.OutcomeSuccess})
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
+
+// =============================================================================
+
+// user finds the user for the identity. Users are matched on the identity
+// first, then on a verified email. Unknown users are provisioned when
+// configured.
+func (h Handlers) user(ctx context.Context, r *http.Request, traceID string, id oidc.Identity) (user.User, error) {
+	externalID := id.Issuer + "|" + id.Subject
+
+	usr, err := h.UserStore.QueryByExternalID(ctx, traceID, externalID)
+	if err == nil {
+		return usr, nil
+	}
+	if !errors.Is(err, user.ErrNotFound) {
+		return user.User{}, fmt.Errorf("external[%s]: %w", externalID, err)
+	}
+
+	if id.Email == "" || !id.EmailVerified {
+		err := errors.New("identity provider did not supply a verified email")
+		return user.User{}, validate.NewRequestError(err, http.StatusForbidden)
+	}
+
+	usr, err = h.UserStore.QueryByEmail(ctx, traceID, id.Email)
+	switch {
+	case err == nil:
+	case errors.Is(err, user.ErrNotFound):
+		if !h.AutoProvision {
+			err := fmt.Errorf("no account exists for %s", id.Email)
+			return user.User{}, validate.NewRequestError(err, http.StatusForbidden)
+		}
+
+		usr, err = h.provision(ctx, r, traceID, id)
+		if err != nil {
+			return user.User{}, err
+		}
+	default:
+		return user.User{}, fmt.Errorf("email[%s]: %w", id.Email, err)
+	}
+
+	if err := h.UserStore.Link(ctx, traceID, usr.ID, externalID); err != nil {
+		return user.User{}, fmt.Errorf("linking ID[%s]: %w", usr.ID, err)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionUserLink, Target: usr.ID, Outcome: audit.OutcomeSuccess, Detail: externalID})
+
+	return usr, nil
+}
+
+// provision creates a user for an identity logging in for the first time.
+// The user gets a random password since they log in through the provider.
+func (h Handlers) provision(ctx context.Context, r *http.Request, traceID string, id oidc.Identity) (user.User, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return user.User{}, fmt.Errorf("generating password: %w", err)
+	}
+	pass := base64.RawURLEncoding.EncodeToString(b)
+
+	name := id.Name
+	if name == "" {
+		name = id.Email
+	}
+
+	nu := user.NewUser{
+		Name:            name,
+		Email:           id.Email,
+		Role:            h.DefaultRole,
+		Password:        pass,
+		PasswordConfirm: pass,
+	}
+
+	usr, err := h.UserStore.Add(ctx, traceID, nu)
+	if err != nil {
+		return user.User{}, fmt.Errorf("provisioning email[%s]: %w", id.Email, err)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionUserCreate, Target: usr.ID, Outcome: audit.OutcomeSuccess, Detail: "provisioned " + usr.Role})
+
+	return usr, nil
+}
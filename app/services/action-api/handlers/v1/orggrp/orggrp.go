@@ -0,0 +1,175 @@
+package orggrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jnkroeker/makulu/business/data/action"
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/data/org"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// Handlers manages the set of organization endpoints
+type Handlers struct {
+	OrgStore    org.Store
+	ActionStore action.Store
+	Audit       *audit.Auditor
+}
+
+// Create adds a new organization with the calling user as its first admin.
+func (h Handlers) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	var no org.NewOrganization
+	if err := web.Decode(r, &no); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	o, err := h.OrgStore.Add(ctx, v.TraceID, claims.Subject, no, v.Now)
+	if err != nil {
+		return fmt.Errorf("organization[%+v]: %w", &no, err)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionOrgCreate, Target: o.ID, Outcome: audit.OutcomeSuccess})
+
+	return web.Respond(ctx, w, o, http.StatusCreated)
+}
+
+// QueryMembers returns the members of the organization.
+func (h Handlers) QueryMembers(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	orgID := web.Param(r, "id")
+	if err := authorize(ctx, auth.Member, orgID); err != nil {
+		return err
+	}
+
+	members, err := h.OrgStore.QueryMembers(ctx, v.TraceID, orgID)
+	if err != nil {
+		return fmt.Errorf("org[%s]: %w", orgID, err)
+	}
+
+	return web.Respond(ctx, w, members, http.StatusOK)
+}
+
+// AddMember adds a user to the organization or changes their role. Admins
+// of the organization only change the roles of its members, users join it
+// when it creates them or when a user admin of every organization adds them.
+func (h Handlers) AddMember(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	orgID := web.Param(r, "id")
+	if err := authorize(ctx, auth.Any(auth.OrgAdmin, auth.Global(auth.Scope(auth.ScopeUsersAdmin))), orgID); err != nil {
+		return err
+	}
+
+	var nm org.NewMembership
+	if err := web.Decode(r, &nm); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	if tenant, _ := auth.GetTenant(ctx); tenant != "" {
+		if _, err := h.OrgStore.QueryMembership(ctx, v.TraceID, orgID, nm.User); err != nil {
+			switch {
+			case errors.Is(err, org.ErrNotMember):
+				return validate.NewRequestError(errors.New("only members of the organization can be changed by its admins"), http.StatusForbidden)
+			default:
+				return fmt.Errorf("org[%s] user[%s]: %w", orgID, nm.User, err)
+			}
+		}
+	}
+
+	m, err := h.OrgStore.AddMember(ctx, v.TraceID, orgID, nm)
+	if err != nil {
+		return fmt.Errorf("org[%s]: %w", orgID, err)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionOrgMemberAdd, Target: m.Key, Outcome: audit.OutcomeSuccess, Detail: m.Role})
+
+	return web.Respond(ctx, w, m, http.StatusCreated)
+}
+
+// RemoveMember removes a user from the organization.
+func (h Handlers) RemoveMember(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	orgID := web.Param(r, "id")
+	if err := authorize(ctx, auth.OrgAdmin, orgID); err != nil {
+		return err
+	}
+
+	userID := web.Param(r, "user")
+	if err := h.OrgStore.RemoveMember(ctx, v.TraceID, orgID, userID); err != nil {
+		switch {
+		case errors.Is(err, org.ErrNotMember):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("org[%s] user[%s]: %w", orgID, userID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionOrgMemberRemove, Target: orgID + "|" + userID, Outcome: audit.OutcomeSuccess})
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// QueryActions returns the actions recorded by members of the organization.
+func (h Handlers) QueryActions(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	orgID := web.Param(r, "id")
+	if err := authorize(ctx, auth.Member, orgID); err != nil {
+		return err
+	}
+
+	acts, err := h.ActionStore.QueryByOrg(ctx, v.TraceID, orgID)
+	if err != nil {
+		switch {
+		case errors.Is(err, action.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("org[%s]: %w", orgID, err)
+		}
+	}
+
+	return web.Respond(ctx, w, acts, http.StatusOK)
+}
+
+// =============================================================================
+
+// authorize checks the policy against the organization. Tokens are limited
+// to a single organization, so one organization can't reach another.
+func authorize(ctx context.Context, p auth.Policy, orgID string) error {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	if err := claims.Allowed(p, orgID); err != nil {
+		return validate.NewRequestError(err, http.StatusForbidden)
+	}
+
+	return nil
+}
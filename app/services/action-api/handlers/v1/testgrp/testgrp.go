@@ -11,6 +11,11 @@ import (
 	"go.uber.org/zap"
 )
 
+// Status is the response of the test endpoints.
+type Status struct {
+	Status string
+}
+
 type Handlers struct {
 	Log *zap.SugaredLogger
 }
@@ -22,9 +27,7 @@ func (h Handlers) Test(ctx context.Context, w http.ResponseWriter, r *http.Reque
 		//panic("testing panic")
 	}
 
-	status := struct {
-		Status string
-	}{
+	status := Status{
 		Status: "OK",
 	}
 
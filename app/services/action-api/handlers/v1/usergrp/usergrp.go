@@ -5,7 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/data/lockout"
+	"github.com/jnkroeker/makulu/business/data/mfa"
+	"github.com/jnkroeker/makulu/business/data/org"
 	"github.com/jnkroeker/makulu/business/data/user"
 	"github.com/jnkroeker/makulu/business/sys/auth"
 	"github.com/jnkroeker/makulu/business/sys/validate"
@@ -15,8 +20,21 @@ import (
 
 // Handlers manages the set of user endpoints
 type Handlers struct {
-	UserStore user.Store
-	Auth      *auth.Auth
+	UserStore    user.Store
+	LockoutStore lockout.Store
+	MFAStore     mfa.Store
+	OrgStore     org.Store
+	Auth         *auth.Auth
+	Audit        *audit.Auditor
+}
+
+// mfaIssuer is the name authenticator apps show next to enrolled accounts.
+const mfaIssuer = "makulu"
+
+// MFALogin exchanges a challenge and a one-time password for a token.
+type MFALogin struct {
+	Challenge string `json:"challenge" validate:"required"`
+	Code      string `json:"code" validate:"required"`
 }
 
 func (h Handlers) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
@@ -36,12 +54,109 @@ func (h Handlers) Create(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	usr, err := h.UserStore.Add(ctx, v.TraceID, nu)
 	if err != nil {
-		return fmt.Errorf("user[%+v]: %w", &usr, err)
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserCreate, Target: nu.Email, Outcome: audit.OutcomeFailure})
+		switch {
+		case errors.Is(err, user.ErrRoleNotAllowed):
+			return validate.NewRequestError(err, http.StatusForbidden)
+		default:
+			return fmt.Errorf("user[%+v]: %w", &usr, err)
+		}
 	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserCreate, Target: usr.ID, Outcome: audit.OutcomeSuccess, Detail: usr.Role})
 
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusCreated)
 }
 
+// Update changes the user, as long as it still has the version in the
+// If-Match header. Users change themselves, admins anyone. Only admins can
+// change roles.
+func (h Handlers) Update(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	userID := web.Param(r, "id")
+
+	if err := claims.Allowed(auth.OwnerOrAdmin, userID); err != nil {
+		return validate.NewRequestError(err, http.StatusForbidden)
+	}
+
+	version, err := v1Web.Version(r)
+	if err != nil {
+		return err
+	}
+
+	var uu user.UpdateUser
+	if err := web.Decode(r, &uu); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	// Roles count in every organization, so only admins whose token isn't
+	// limited to one can change them.
+	if uu.Role != nil && (claims.Tenant != "" || !(claims.Authorized(auth.RoleAdmin) || claims.HasScopes(auth.ScopeUsersAdmin))) {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	usr, err := h.UserStore.Update(ctx, v.TraceID, userID, version, uu, v.Now)
+	if err != nil {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserUpdate, Target: userID, Outcome: audit.OutcomeFailure})
+		switch {
+		case errors.Is(err, validate.ErrInvalidID):
+			return validate.NewRequestError(err, http.StatusBadRequest)
+		case errors.Is(err, user.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		case errors.Is(err, user.ErrExists):
+			return validate.NewRequestError(err, http.StatusConflict)
+		case errors.Is(err, user.ErrRoleNotAllowed), errors.Is(err, user.ErrNotAllowed), errors.Is(err, user.ErrAuthenticationFailure):
+			return validate.NewRequestError(err, http.StatusForbidden)
+		default:
+			return fmt.Errorf("ID[%s]: %w", userID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserUpdate, Target: userID, Outcome: audit.OutcomeSuccess, Detail: usr.Role})
+
+	v1Web.SetVersion(w, usr.Version)
+	return web.Respond(ctx, w, usr, http.StatusOK)
+}
+
+// Delete removes the user, as long as it still has the version in the
+// If-Match header.
+func (h Handlers) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	userID := web.Param(r, "id")
+
+	version, err := v1Web.Version(r)
+	if err != nil {
+		return err
+	}
+
+	if err := h.UserStore.Delete(ctx, v.TraceID, userID, version); err != nil {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserDelete, Target: userID, Outcome: audit.OutcomeFailure})
+		switch {
+		case errors.Is(err, validate.ErrInvalidID):
+			return validate.NewRequestError(err, http.StatusBadRequest)
+		case errors.Is(err, user.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusNotFound)
+		default:
+			return fmt.Errorf("ID[%s]: %w", userID, err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionUserDelete, Target: userID, Outcome: audit.OutcomeSuccess})
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
 func (h Handlers) QueryByID(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	v, err := web.GetValues(ctx)
 	if err != nil {
@@ -55,9 +170,8 @@ func (h Handlers) QueryByID(ctx context.Context, w http.ResponseWriter, r *http.
 
 	userID := web.Param(r, "id")
 
-	// If you are not an admin and looking to retrieve someone other than yourself
-	if !claims.Authorized(auth.RoleAdmin) && claims.Subject != userID {
-		return v1Web.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	if err := claims.Allowed(auth.OwnerOrAdmin, userID); err != nil {
+		return v1Web.NewRequestError(err, http.StatusForbidden)
 	}
 
 	usr, err := h.UserStore.QueryByID(ctx, v.TraceID, userID)
@@ -72,6 +186,7 @@ func (h Handlers) QueryByID(ctx context.Context, w http.ResponseWriter, r *http.
 		}
 	}
 
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusOK)
 }
 
@@ -81,6 +196,11 @@ func (h Handlers) QueryByEmail(ctx context.Context, w http.ResponseWriter, r *ht
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return v1Web.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
 	email := web.Param(r, "email")
 
 	usr, err := h.UserStore.QueryByEmail(ctx, v.TraceID, email)
@@ -93,5 +213,289 @@ func (h Handlers) QueryByEmail(ctx context.Context, w http.ResponseWriter, r *ht
 		}
 	}
 
+	if err := claims.Allowed(auth.OwnerOrAdmin, usr.ID); err != nil {
+		return v1Web.NewRequestError(err, http.StatusForbidden)
+	}
+
+	v1Web.SetVersion(w, usr.Version)
 	return web.Respond(ctx, w, usr, http.StatusOK)
 }
+
+// Token provides an API token for the authenticated user. Credentials are
+// supplied using basic auth and every failure counts towards the lockout
+// policy of both the account and the calling client. The org query parameter
+// asks for a token limited to an organization the user is a member of.
+func (h Handlers) Token(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	email, pass, ok := r.BasicAuth()
+	if !ok {
+		err := errors.New("must provide email and password in Basic auth")
+		return validate.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	ip := web.ClientIP(r)
+
+	until, err := h.LockoutStore.Check(ctx, v.TraceID, v.Now, email, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, lockout.ErrLocked):
+			h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionLogin, Target: email, Outcome: audit.OutcomeDenied, Detail: "locked"})
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(v.Now).Seconds())+1))
+			return validate.NewRequestError(err, http.StatusTooManyRequests)
+		default:
+			return fmt.Errorf("checking lockout: %w", err)
+		}
+	}
+
+	claims, err := h.UserStore.Authenticate(ctx, v.TraceID, v.Now, email, pass)
+	if err != nil {
+		switch {
+		case errors.Is(err, user.ErrAuthenticationFailure):
+			h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionLogin, Target: email, Outcome: audit.OutcomeFailure})
+			if _, err := h.LockoutStore.Fail(ctx, v.TraceID, v.Now, email, ip); err != nil {
+				return fmt.Errorf("recording failure: %w", err)
+			}
+			return validate.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	enabled, err := h.MFAStore.Enabled(ctx, v.TraceID, claims.Subject)
+	if err != nil {
+		return fmt.Errorf("checking mfa: %w", err)
+	}
+
+	// Users with a second factor get a challenge that must be exchanged
+	// for a token with a one-time password.
+	if enabled {
+		h.Audit.Record(ctx, r, audit.Event{Actor: claims.Subject, Action: audit.ActionLogin, Target: email, Outcome: audit.OutcomeSuccess, Detail: "mfa required"})
+		chl := v1Web.Challenge{MFARequired: true}
+		chl.Challenge, err = h.Auth.GenerateChallenge(claims.Subject, v.Now)
+		if err != nil {
+			return fmt.Errorf("generating challenge: %w", err)
+		}
+		return web.Respond(ctx, w, chl, http.StatusOK)
+	}
+	h.Audit.Record(ctx, r, audit.Event{Actor: claims.Subject, Action: audit.ActionLogin, Target: email, Outcome: audit.OutcomeSuccess})
+
+	// Failures are only forgiven once the login is complete, so a known
+	// password doesn't clear the failed codes of a second factor.
+	if err := h.LockoutStore.Succeed(ctx, v.TraceID, email, ip); err != nil {
+		return fmt.Errorf("resetting lockout: %w", err)
+	}
+
+	return h.respondToken(ctx, w, r, claims)
+}
+
+// TokenMFA completes a login for a user with a second factor. The challenge
+// from Token is exchanged for a token when the code is valid.
+func (h Handlers) TokenMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var req MFALogin
+	if err := web.Decode(r, &req); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	if err := validate.Check(req); err != nil {
+		return fmt.Errorf("validating data: %w", err)
+	}
+
+	chl, err := h.Auth.ValidateChallenge(req.Challenge)
+	if err != nil {
+		return validate.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	usr, err := h.UserStore.QueryByID(ctx, v.TraceID, chl.Subject)
+	if err != nil {
+		return fmt.Errorf("ID[%s]: %w", chl.Subject, err)
+	}
+
+	ip := web.ClientIP(r)
+
+	until, err := h.LockoutStore.Check(ctx, v.TraceID, v.Now, usr.Email, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, lockout.ErrLocked):
+			h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeDenied, Detail: "locked"})
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(v.Now).Seconds())+1))
+			return validate.NewRequestError(err, http.StatusTooManyRequests)
+		default:
+			return fmt.Errorf("checking lockout: %w", err)
+		}
+	}
+
+	recovery, err := h.MFAStore.Verify(ctx, v.TraceID, usr.ID, req.Code, v.Now)
+	if err != nil {
+		switch {
+		case errors.Is(err, mfa.ErrInvalidCode):
+			h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeFailure, Detail: "invalid code"})
+			if _, err := h.LockoutStore.Fail(ctx, v.TraceID, v.Now, usr.Email, ip); err != nil {
+				return fmt.Errorf("recording failure: %w", err)
+			}
+			return validate.NewRequestError(err, http.StatusUnauthorized)
+		case errors.Is(err, mfa.ErrNotFound), errors.Is(err, mfa.ErrNotEnabled):
+			return validate.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return fmt.Errorf("verifying code: %w", err)
+		}
+	}
+
+	if recovery {
+		h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionRecoveryCodeUse, Target: usr.Email, Outcome: audit.OutcomeSuccess, Detail: "login"})
+	}
+
+	// The challenge says how the first step of the login was passed.
+	claims := user.NewClaims(usr, v.Now, append(chl.AMR, auth.AMROTP)...)
+	h.Audit.Record(ctx, r, audit.Event{Actor: usr.ID, Action: audit.ActionLogin, Target: usr.Email, Outcome: audit.OutcomeSuccess, Detail: "mfa"})
+
+	if err := h.LockoutStore.Succeed(ctx, v.TraceID, usr.Email, ip); err != nil {
+		return fmt.Errorf("resetting lockout: %w", err)
+	}
+
+	return h.respondToken(ctx, w, r, claims)
+}
+
+// EnrollMFA starts enrollment of a second factor for the calling user. The
+// secret and recovery codes are only ever shown in this response. A user
+// with an enabled factor keeps it until the new one is confirmed, and must
+// provide a code of it to start.
+func (h Handlers) EnrollMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	usr, err := h.UserStore.QueryByID(ctx, v.TraceID, claims.Subject)
+	if err != nil {
+		return fmt.Errorf("ID[%s]: %w", claims.Subject, err)
+	}
+
+	// Users replacing an enabled factor prove they hold it with a code.
+	var ne mfa.NewEnrollment
+	if r.ContentLength != 0 {
+		if err := web.Decode(r, &ne); err != nil {
+			return fmt.Errorf("unable to decode payload: %w", err)
+		}
+	}
+
+	ip := web.ClientIP(r)
+
+	until, err := h.LockoutStore.Check(ctx, v.TraceID, v.Now, usr.Email, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, lockout.ErrLocked):
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(v.Now).Seconds())+1))
+			return validate.NewRequestError(err, http.StatusTooManyRequests)
+		default:
+			return fmt.Errorf("checking lockout: %w", err)
+		}
+	}
+
+	// The recovery code is used up even when the enrollment fails later.
+	enr, recovery, err := h.MFAStore.Enroll(ctx, v.TraceID, usr.ID, mfaIssuer, usr.Email, ne.Code, v.Now)
+	if recovery {
+		h.Audit.Record(ctx, r, audit.Event{Action: audit.ActionRecoveryCodeUse, Target: usr.Email, Outcome: audit.OutcomeSuccess, Detail: "enroll"})
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, mfa.ErrInvalidCode):
+			if _, err := h.LockoutStore.Fail(ctx, v.TraceID, v.Now, usr.Email, ip); err != nil {
+				return fmt.Errorf("recording failure: %w", err)
+			}
+			return validate.NewRequestError(err, http.StatusForbidden)
+		case errors.Is(err, mfa.ErrCodeRequired):
+			return validate.NewRequestError(err, http.StatusForbidden)
+		default:
+			return fmt.Errorf("enrolling ID[%s]: %w", usr.ID, err)
+		}
+	}
+
+	return web.Respond(ctx, w, enr, http.StatusCreated)
+}
+
+// ConfirmMFA enables the second factor of the calling user.
+func (h Handlers) ConfirmMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return validate.NewRequestError(auth.ErrorForbidden, http.StatusForbidden)
+	}
+
+	var code mfa.Code
+	if err := web.Decode(r, &code); err != nil {
+		return fmt.Errorf("unable to decode payload: %w", err)
+	}
+
+	if err := validate.Check(code); err != nil {
+		return fmt.Errorf("validating data: %w", err)
+	}
+
+	if err := h.MFAStore.Confirm(ctx, v.TraceID, claims.Subject, code.Code, v.Now); err != nil {
+		switch {
+		case errors.Is(err, mfa.ErrInvalidCode), errors.Is(err, mfa.ErrNotFound):
+			return validate.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return fmt.Errorf("confirming ID[%s]: %w", claims.Subject, err)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// =============================================================================
+
+// respondToken generates a token for the claims and sends it to the client.
+// When an organization is requested the token is limited to it and carries
+// the role the user has there.
+func (h Handlers) respondToken(ctx context.Context, w http.ResponseWriter, r *http.Request, claims auth.Claims) error {
+	v, err := web.GetValues(ctx)
+	if err != nil {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if orgID := r.URL.Query().Get("org"); orgID != "" {
+		m, err := h.OrgStore.QueryMembership(ctx, v.TraceID, orgID, claims.Subject)
+		if err != nil {
+			switch {
+			case errors.Is(err, org.ErrNotMember):
+				return validate.NewRequestError(err, http.StatusForbidden)
+			default:
+				return fmt.Errorf("querying membership: %w", err)
+			}
+		}
+		claims.Tenant = orgID
+		claims.Roles = []string{m.Role}
+	}
+
+	var tkn v1Web.Token
+	tkn.Token, err = h.Auth.GenerateToken(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrMFARequired):
+			return validate.NewRequestError(err, http.StatusForbidden)
+		default:
+			return fmt.Errorf("generating token: %w", err)
+		}
+	}
+	h.Audit.Record(ctx, r, audit.Event{Actor: claims.Subject, Action: audit.ActionTokenIssue, Target: claims.Subject, Outcome: audit.OutcomeSuccess, Detail: claims.Tenant})
+
+	return web.Respond(ctx, w, tkn, http.StatusOK)
+}
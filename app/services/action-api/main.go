@@ -15,9 +15,20 @@ import (
 	"github.com/ardanlabs/conf"
 	"github.com/jnkroeker/makulu/app/services/action-api/handlers"
 	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/apikey"
+	"github.com/jnkroeker/makulu/business/data/audit"
+	"github.com/jnkroeker/makulu/business/data/cache"
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/business/data/lockout"
+	"github.com/jnkroeker/makulu/business/data/schema"
 	"github.com/jnkroeker/makulu/business/feeds/loader"
 	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/oidc"
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
+	"github.com/jnkroeker/makulu/business/web/v1/mid"
 	"github.com/jnkroeker/makulu/foundation/keystore"
+	"github.com/jnkroeker/makulu/foundation/trace"
+	"github.com/jnkroeker/makulu/foundation/web"
 	"go.uber.org/automaxprocs/maxprocs"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -72,10 +83,62 @@ func run(log *zap.SugaredLogger) error {
 			Writetimeout    time.Duration `conf:"default:10s"`
 			IdleTimeout     time.Duration `conf:"default:120s"`
 			ShutdownTimeout time.Duration `conf:"default:20s,mask"`
+
+			// ShutdownPolicy is which errors from handlers shut the
+			// service down: integrity, any or never.
+			ShutdownPolicy string `conf:"default:integrity"`
+
+			// MaxBodySize is the largest request body in bytes.
+			MaxBodySize int64 `conf:"default:1048576"`
+
+			// RequestTimeout is how long a request may take, and
+			// SlowRequestTimeout how long the routes that hash passwords or
+			// wait on other services may. Both stay under the write timeout
+			// so the client still gets an answer.
+			RequestTimeout     time.Duration `conf:"default:5s"`
+			SlowRequestTimeout time.Duration `conf:"default:9s"`
+		}
+		Compress struct {
+			Enabled bool `conf:"default:true"`
+
+			// MinSize is the smallest body in bytes worth compressing and
+			// Level the gzip level, -1 for the default.
+			MinSize int `conf:"default:1024"`
+			Level   int `conf:"default:-1"`
+		}
+		CORS struct {
+			// Origins allowed to call the api from a browser, * for any.
+			// Without any, cross-origin requests aren't allowed. Without
+			// Methods, every route allows the methods it handles.
+			Origins        []string
+			Methods        []string
+			Headers        []string      `conf:"default:Authorization;Content-Type;X-API-Key"`
+			ExposedHeaders []string      `conf:"default:RateLimit-Limit;RateLimit-Remaining;RateLimit-Reset;Retry-After"`
+			Credentials    bool          `conf:"default:false"`
+			MaxAge         time.Duration `conf:"default:10m"`
 		}
 		Auth struct {
 			KeysFolder string `conf:"default:zarf/keys/"`
 			ActiveKID  string `conf:"default:54bb2165-71e1-41a6-af3e-7da4a0e1e2c1"`
+			RequireMFA bool   `conf:"default:false"`
+
+			// Permissions maps roles to scopes, ROLE=scope scope;ROLE=scope.
+			Permissions []string `conf:"default:ADMIN=actions:read actions:write users:read users:write users:admin videos:upload orgs:create;USER=actions:read actions:write users:read users:write videos:upload"`
+		}
+		OIDC struct {
+			Issuer        string
+			ClientID      string
+			ClientSecret  string `conf:"mask"`
+			RedirectURL   string `conf:"default:http://localhost:3000/v1/oidc/callback"`
+			DefaultRole   string `conf:"default:USER"`
+			AutoProvision bool   `conf:"default:true"`
+		}
+		Lockout struct {
+			AccountThreshold int           `conf:"default:5"`
+			IPThreshold      int           `conf:"default:20"`
+			BaseDelay        time.Duration `conf:"default:30s"`
+			MaxDelay         time.Duration `conf:"default:1h"`
+			Window           time.Duration `conf:"default:15m"`
 		}
 		Dgraph struct {
 			URL             string `conf:"default:http://0.0.0.0:8080"`
@@ -83,6 +146,64 @@ func run(log *zap.SugaredLogger) error {
 			AuthToken       string
 			CloudHeaderName string `config:"default:X-Auth-Token"`
 			CloudToken      string
+
+			// SchemaCheck is what happens when the schema in the database
+			// doesn't match the compiled one: warn, fail or off.
+			SchemaCheck  string        `conf:"default:warn"`
+			CheckTimeout time.Duration `conf:"default:10s"`
+
+			// Requests that take longer than Timeout are abandoned. Queries
+			// are retried, and the breaker stops sending requests for the
+			// cooldown after that many requests failed in a row.
+			Timeout          time.Duration `conf:"default:5s"`
+			Retries          int           `conf:"default:2"`
+			RetryBase        time.Duration `conf:"default:100ms"`
+			RetryMax         time.Duration `conf:"default:1s"`
+			BreakerThreshold int           `conf:"default:5"`
+			BreakerCooldown  time.Duration `conf:"default:30s"`
+		}
+		Cache struct {
+			Enabled bool          `conf:"default:true"`
+			Size    int           `conf:"default:10000"`
+			TTL     time.Duration `conf:"default:1m"`
+
+			// When RedisAddr is set the cache is kept in Redis and shared by
+			// every instance, otherwise each instance keeps its own.
+			RedisAddr     string
+			RedisPassword string        `conf:"mask"`
+			RedisDB       int           `conf:"default:0"`
+			RedisTimeout  time.Duration `conf:"default:500ms"`
+		}
+		RateLimit struct {
+			Enabled bool `conf:"default:true"`
+
+			// Limits have the form requests/period burst. Routes override
+			// the default with METHOD /path=limit;METHOD /path=limit and
+			// none turns the limit of a route off.
+			Default string   `conf:"default:20/s 40"`
+			Routes  []string `conf:"default:GET /v1/users/token=10/1m 5;POST /v1/users/token/mfa=10/1m 5;GET /v1/oidc/callback=10/1m 5"`
+
+			// Address limits every caller by address before the token or
+			// api key is checked.
+			Address string `conf:"default:50/s 100"`
+		}
+		Audit struct {
+			// Sink is where events are recorded: file or dgraph.
+			Sink string `conf:"default:file"`
+			File string `conf:"default:audit.log"`
+		}
+		Idempotency struct {
+			// Store is where responses to requests with an Idempotency-Key
+			// are kept: none, memory or dgraph.
+			Store  string        `conf:"default:memory"`
+			Window time.Duration `conf:"default:24h"`
+		}
+		Tracing struct {
+			// Exporter is where spans are sent: none, stdout, file or otlp.
+			Exporter    string  `conf:"default:none"`
+			File        string  `conf:"default:traces.json"`
+			OTLPURL     string  `conf:"default:http://localhost:4318/v1/traces"`
+			Probability float64 `conf:"default:1"`
 		}
 		Search struct {
 			Categories []string `conf:"default:cycling;skiing;crossfit"`
@@ -137,42 +258,62 @@ func run(log *zap.SugaredLogger) error {
 		return fmt.Errorf("reading keys: %w", err)
 	}
 
+	perms, err := auth.ParsePermissions(cfg.Auth.Permissions)
+	if err != nil {
+		return fmt.Errorf("parsing permissions: %w", err)
+	}
+
 	auth, err := auth.New(cfg.Auth.ActiveKID, ks)
 	if err != nil {
 		return fmt.Errorf("constructing auth: %w", err)
 	}
 
+	// Admins can create users and see everyone's data, so they can be
+	// required to prove a second factor before getting a token.
+	if cfg.Auth.RequireMFA {
+		auth.RequireMFA("ADMIN")
+	}
+
+	// Tokens carry the scopes granted by the roles of the user.
+	auth.SetPermissions(perms)
+
 	// =========================================================================
 	// Initialize GraphQL Support
 
-	// Capture the configuration for dgraph.
+	// Capture the configuration for dgraph. Without a configured token the service signs short lived ones of
+	// its own to access the database when no caller is involved.
+	var serviceToken func() (string, error)
+	if cfg.Dgraph.AuthToken == "" {
+		serviceToken = auth.ServiceTokens("action-api")
+	}
+
+	// Requests made for a caller carry the token of the caller, so the
+	// database enforces its authorization rules on them.
 	gqlConfig := data.GraphQLConfig{
 		URL:             cfg.Dgraph.URL,
 		AuthHeaderName:  cfg.Dgraph.AuthHeaderName,
 		AuthToken:       cfg.Dgraph.AuthToken,
 		CloudHeaderName: cfg.Dgraph.CloudHeaderName,
 		CloudToken:      cfg.Dgraph.CloudToken,
+		CallerToken:     auth.DatabaseToken,
+		ServiceToken:    serviceToken,
+		Policy: data.Policy{
+			Timeout:          cfg.Dgraph.Timeout,
+			Retries:          cfg.Dgraph.Retries,
+			RetryBase:        cfg.Dgraph.RetryBase,
+			RetryMax:         cfg.Dgraph.RetryMax,
+			BreakerThreshold: cfg.Dgraph.BreakerThreshold,
+			BreakerCooldown:  cfg.Dgraph.BreakerCooldown,
+		},
 	}
 
-	// ========================================================================================
-	// Start Debug Service
+	// API keys are validated against the database, so the lookup can only be
+	// set once we know how to reach it.
+	auth.SetAPIKeyLookup(apikey.NewLookup(log, data.NewGraphQL(gqlConfig)))
 
-	log.Infow("startup", "status", "debug router started", "host", cfg.Web.DebugHost)
-
-	// The Debug function returns a mux to listen and serve on for all the debug
-	// related endpoints. this includes the standard library endpoints.
-
-	// Construct the mux for the debug calls.
-	debugMux := handlers.DebugMux(build, log, gqlConfig)
-
-	// Start the service listening for debug requests.
-	// Not concerned with shutting this down with load shedding.
-	// This is an exception to the 'parent/child' goroutine relationship
-	go func() {
-		if err := http.ListenAndServe(cfg.Web.DebugHost, debugMux); err != nil {
-			log.Errorw("shutdown", "status", "debug router closed", "host", cfg.Web.DebugHost, "ERROR", err)
-		}
-	}()
+	if err := checkSchema(log, gqlConfig, auth, cfg.Dgraph.SchemaCheck, cfg.Dgraph.CheckTimeout); err != nil {
+		return err
+	}
 
 	// ========================================================================================
 	// Start API Service
@@ -191,14 +332,186 @@ func run(log *zap.SugaredLogger) error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
+	// Failed logins are tracked per account and per client address. The
+	// address threshold is higher since many users can share one address.
+	lockoutConfig := lockout.Config{
+		Account: lockout.Policy{
+			Threshold: cfg.Lockout.AccountThreshold,
+			BaseDelay: cfg.Lockout.BaseDelay,
+			MaxDelay:  cfg.Lockout.MaxDelay,
+			Window:    cfg.Lockout.Window,
+		},
+		IP: lockout.Policy{
+			Threshold: cfg.Lockout.IPThreshold,
+			BaseDelay: cfg.Lockout.BaseDelay,
+			MaxDelay:  cfg.Lockout.MaxDelay,
+			Window:    cfg.Lockout.Window,
+		},
+	}
+
+	// Users and actions read by id are cached unless disabled.
+	var dbCache cache.Cache
+	switch {
+	case !cfg.Cache.Enabled:
+		log.Infow("startup", "status", "cache disabled")
+	case cfg.Cache.RedisAddr != "":
+		log.Infow("startup", "status", "cache in redis", "addr", cfg.Cache.RedisAddr)
+		dbCache = cache.NewRedis(cache.RedisConfig{
+			Addr:     cfg.Cache.RedisAddr,
+			Password: cfg.Cache.RedisPassword,
+			DB:       cfg.Cache.RedisDB,
+			Timeout:  cfg.Cache.RedisTimeout,
+		}, cfg.Cache.TTL)
+	default:
+		dbCache = cache.NewLRU(cfg.Cache.Size, cfg.Cache.TTL)
+	}
+
+	// Clients are limited per route by a token bucket kept by this instance.
+	var limiter, addressLimiter *ratelimit.Limiter
+	if cfg.RateLimit.Enabled {
+		def, err := ratelimit.ParseLimit(cfg.RateLimit.Default)
+		if err != nil {
+			return fmt.Errorf("parsing default rate limit: %w", err)
+		}
+		routes, err := ratelimit.ParseRoutes(cfg.RateLimit.Routes)
+		if err != nil {
+			return fmt.Errorf("parsing route rate limits: %w", err)
+		}
+		limiter = ratelimit.New(ratelimit.NewMemory(), def, routes)
+
+		addr, err := ratelimit.ParseLimit(cfg.RateLimit.Address)
+		if err != nil {
+			return fmt.Errorf("parsing address rate limit: %w", err)
+		}
+		addressLimiter = ratelimit.New(ratelimit.NewMemory(), addr, nil)
+		log.Infow("startup", "status", "rate limit", "default", def, "address", addr)
+	}
+
+	// Requests continue the trace of their caller and every request and
+	// database call is a span. Spans are only exported when configured.
+	tracer, err := newTracer(log, cfg.Tracing.Exporter, cfg.Tracing.File, cfg.Tracing.OTLPURL, cfg.Tracing.Probability)
+	if err != nil {
+		return fmt.Errorf("starting tracer: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Errorw("shutdown", "status", "exporting spans", "ERROR", err)
+		}
+	}()
+
+	// Security relevant events are recorded to an append-only sink.
+	var sink audit.Sink
+	switch cfg.Audit.Sink {
+	case "file":
+		f, err := audit.NewFile(cfg.Audit.File)
+		if err != nil {
+			return fmt.Errorf("opening audit file: %w", err)
+		}
+		defer f.Close()
+		sink = f
+	case "dgraph":
+		sink = audit.NewStore(log, data.NewGraphQL(gqlConfig))
+	default:
+		return fmt.Errorf("unknown audit sink %q, use file or dgraph", cfg.Audit.Sink)
+	}
+	log.Infow("startup", "status", "audit", "sink", cfg.Audit.Sink)
+
+	// Retries of requests with an Idempotency-Key get the first response.
+	var idem idempotency.Store
+	switch cfg.Idempotency.Store {
+	case "none":
+	case "memory":
+		idem = idempotency.NewMemory()
+	case "dgraph":
+
+		// The records belong to the service, not to the callers whose
+		// requests they keep.
+		service := gqlConfig
+		service.CallerToken = nil
+		idem = idempotency.NewDgraph(log, data.NewGraphQL(service))
+	default:
+		return fmt.Errorf("unknown idempotency store %q, use none, memory or dgraph", cfg.Idempotency.Store)
+	}
+
+	compress := mid.CompressConfig{
+		MinSize: cfg.Compress.MinSize,
+	}
+	if cfg.Compress.Enabled {
+		compress.Compressors = []mid.Compressor{mid.Gzip(cfg.Compress.Level)}
+	}
+
+	shutdownPolicy, err := web.ParseShutdownPolicy(cfg.Web.ShutdownPolicy)
+	if err != nil {
+		return fmt.Errorf("parsing shutdown policy: %w", err)
+	}
+
 	apiMux := handlers.APIMux(handlers.APIMuxConfig{
-		Shutdown: shutdown,
-		Log:      log,
-		Auth:     auth,
-		DB:       gqlConfig,
-		Loader:   loaderConfig,
+		Build:          build,
+		Shutdown:       shutdown,
+		ShutdownPolicy: shutdownPolicy,
+		MaxBodySize:    cfg.Web.MaxBodySize,
+		Compress:       compress,
+		Log:            log,
+		Auth:           auth,
+		DB:             gqlConfig,
+		Cache:          dbCache,
+		Tracer:         tracer,
+		Audit:          audit.New(log, sink),
+		Limiter:        limiter,
+		AddressLimiter: addressLimiter,
+		CORS: web.CORSConfig{
+			Origins:        cfg.CORS.Origins,
+			Methods:        cfg.CORS.Methods,
+			Headers:        cfg.CORS.Headers,
+			ExposedHeaders: cfg.CORS.ExposedHeaders,
+			Credentials:    cfg.CORS.Credentials,
+			MaxAge:         cfg.CORS.MaxAge,
+		},
+		Loader:  loaderConfig,
+		Lockout: lockoutConfig,
+		Timeouts: handlers.TimeoutConfig{
+			Default: cfg.Web.RequestTimeout,
+			Slow:    cfg.Web.SlowRequestTimeout,
+		},
+		Idempotency: handlers.IdempotencyConfig{
+			Store:  idem,
+			Window: cfg.Idempotency.Window,
+		},
+		OIDC: handlers.OIDCConfig{
+			Provider: oidc.Config{
+				Issuer:       cfg.OIDC.Issuer,
+				ClientID:     cfg.OIDC.ClientID,
+				ClientSecret: cfg.OIDC.ClientSecret,
+				RedirectURL:  cfg.OIDC.RedirectURL,
+			},
+			DefaultRole:   cfg.OIDC.DefaultRole,
+			AutoProvision: cfg.OIDC.AutoProvision,
+		},
 	})
 
+	// ========================================================================================
+	// Start Debug Service
+
+	log.Infow("startup", "status", "debug router started", "host", cfg.Web.DebugHost)
+
+	// The Debug function returns a mux to listen and serve on for all the debug
+	// related endpoints. this includes the standard library endpoints.
+
+	// Construct the mux for the debug calls. It lists the routes of the api,
+	// so it's constructed once they are bound.
+	debugMux := handlers.DebugMux(build, log, gqlConfig, apiMux.Routes())
+
+	// Start the service listening for debug requests.
+	// Not concerned with shutting this down with load shedding.
+	// This is an exception to the 'parent/child' goroutine relationship
+	go func() {
+		if err := http.ListenAndServe(cfg.Web.DebugHost, debugMux); err != nil {
+			log.Errorw("shutdown", "status", "debug router closed", "host", cfg.Web.DebugHost, "ERROR", err)
+		}
+	}()
+
 	// Construct a server to service the requests against the mux.
 	//
 	// To do load shedding, we need an http.server value
@@ -259,6 +572,37 @@ func run(log *zap.SugaredLogger) error {
 	return nil
 }
 
+// newTracer constructs the tracer with the exporter named in the config.
+func newTracer(log *zap.SugaredLogger, exporter string, file string, otlpURL string, probability float64) (*trace.Tracer, error) {
+	cfg := trace.Config{
+		Service:     "action-api",
+		Probability: probability,
+		ErrorFunc: func(err error) {
+			log.Errorw("tracing", "status", "exporting spans", "ERROR", err)
+		},
+	}
+
+	switch exporter {
+	case "none":
+	case "stdout":
+		cfg.Exporter = trace.NewWriter(os.Stdout)
+	case "file":
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", file, err)
+		}
+		cfg.Exporter = trace.NewWriter(f)
+	case "otlp":
+		cfg.Exporter = trace.NewOTLP(otlpURL, &http.Client{Timeout: 10 * time.Second})
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, use none, stdout, file or otlp", exporter)
+	}
+
+	log.Infow("startup", "status", "tracing", "exporter", exporter, "probability", probability)
+
+	return trace.New(cfg), nil
+}
+
 func initLogger(service string) (*zap.SugaredLogger, error) {
 	config := zap.NewProductionConfig()
 	config.OutputPaths = []string{"stdout"}
@@ -277,3 +621,43 @@ func initLogger(service string) (*zap.SugaredLogger, error) {
 
 	return log.Sugar(), nil
 }
+
+// checkSchema compares the schema in the database with the compiled one.
+// Depending on the mode a mismatch is logged or stops the service from
+// starting, since queries against the wrong schema fail in odd ways.
+func checkSchema(log *zap.SugaredLogger, gqlConfig data.GraphQLConfig, a *auth.Auth, mode string, timeout time.Duration) error {
+	switch mode {
+	case "off":
+		return nil
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("unknown schema check mode %q", mode)
+	}
+
+	publicKey, err := a.PublicKeyPEM()
+	if err != nil {
+		return fmt.Errorf("encoding public key: %w", err)
+	}
+
+	sch, err := schema.New(data.NewGraphQL(gqlConfig), schema.Config{
+		Authorization: schema.Authorization{
+			Header:    gqlConfig.AuthHeaderName,
+			PublicKey: publicKey,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("preparing schema: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := sch.Check(ctx); err != nil {
+		if mode == "fail" {
+			return fmt.Errorf("checking schema, run action-admin migrate up: %w", err)
+		}
+		log.Warnw("startup", "status", "schema check failed, run action-admin migrate up", "ERROR", err)
+	}
+
+	return nil
+}
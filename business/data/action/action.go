@@ -4,9 +4,13 @@ package action
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/ardanlabs/graphql"
 	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/cache"
+	"github.com/jnkroeker/makulu/business/sys/auth"
 	"github.com/jnkroeker/makulu/business/sys/validate"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -15,12 +19,14 @@ import (
 // Set of error variables for CRUD operations
 var (
 	ErrNotFound = errors.New("action not found")
+	ErrExists   = errors.New("action exists")
 )
 
 // Store manages the set o APIs for action access
 type Store struct {
-	log *zap.SugaredLogger
-	gql *graphql.GraphQL
+	log   *zap.SugaredLogger
+	gql   *graphql.GraphQL
+	cache cache.Cache
 }
 
 // NewStore constructs an action sore for api access
@@ -31,6 +37,13 @@ func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
 	}
 }
 
+// WithCache returns a copy of the store that reads actions by id through the
+// cache. Actions changed through the store are removed from the cache.
+func (s Store) WithCache(c cache.Cache) Store {
+	s.cache = c
+	return s
+}
+
 // Upsert adds a new action to the database if it doesn't already exist by name
 // If the action already exists, the function will return an Action value with the existing ID
 func (s Store) Add(ctx context.Context, traceID string, na NewAction) (Action, error) {
@@ -38,63 +51,210 @@ func (s Store) Add(ctx context.Context, traceID string, na NewAction) (Action, e
 		return Action{}, fmt.Errorf("validating data: %w", err)
 	}
 
+	// Actions belong to the organization of the caller.
+	tenant, _ := auth.GetTenant(ctx)
+
 	act := Action{
 		Name: na.Name,
 		Lat:  na.Lat,
 		Lng:  na.Lng,
 		User: na.User,
+		Org:  tenant,
 	}
 
 	return s.add(ctx, traceID, act)
 }
 
+// Update changes the action if it still has the version the caller read.
+// ErrConflict of package data is returned when it changed since.
+func (s Store) Update(ctx context.Context, traceID string, actionID string, version int, ua UpdateAction, now time.Time) (Action, error) {
+	if err := validate.Check(ua); err != nil {
+		return Action{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	act, err := s.queryForChange(ctx, traceID, actionID)
+	if err != nil {
+		return Action{}, err
+	}
+
+	// Checked by the mutation as well, in case it changes in between.
+	if act.Version != version {
+		return Action{}, data.ErrConflict
+	}
+
+	if ua.Name != nil {
+		act.Name = *ua.Name
+	}
+	if ua.Lat != nil {
+		act.Lat = *ua.Lat
+	}
+	if ua.Lng != nil {
+		act.Lng = *ua.Lng
+	}
+	act.Version = version + 1
+	act.UpdatedAt = &now
+
+	var result struct {
+		UpdateAction struct {
+			NumUids int `json:"numUids"`
+		} `json:"updateAction"`
+	}
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateAction(input: {
+			filter: { id: [%q], %s }
+			set: {
+				name: %q
+				lat: %f
+				lng: %f
+				version: %d
+				updated_at: %q
+			}
+		}) {
+			numUids
+		}
+	}`, actionID, data.VersionFilter(version), act.Name, act.Lat, act.Lng, act.Version, now.UTC().Format(time.RFC3339Nano))
+
+	s.log.Debug("%s: %s: %s", traceID, "action.Update", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return Action{}, errors.Wrap(err, "failed to update action")
+	}
+
+	if err := cache.Delete(ctx, s.cache, cache.Key("action", actionID)); err != nil {
+		return Action{}, errors.Wrap(err, "removing cached action")
+	}
+
+	if result.UpdateAction.NumUids != 1 {
+		return Action{}, data.ErrConflict
+	}
+
+	return act, nil
+}
+
+// Delete removes the action if it still has the version the caller read.
+// ErrConflict of package data is returned when it changed since.
+func (s Store) Delete(ctx context.Context, traceID string, actionID string, version int) error {
+	act, err := s.queryForChange(ctx, traceID, actionID)
+	if err != nil {
+		return err
+	}
+
+	// Checked by the mutation as well, in case it changes in between.
+	if act.Version != version {
+		return data.ErrConflict
+	}
+
+	var result struct {
+		DeleteAction struct {
+			NumUids int `json:"numUids"`
+		} `json:"deleteAction"`
+	}
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteAction(filter: { id: [%q], %s }) {
+			numUids
+		}
+	}`, actionID, data.VersionFilter(version))
+
+	s.log.Debug("%s: %s: %s", traceID, "action.Delete", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return errors.Wrap(err, "failed to delete action")
+	}
+
+	if err := cache.Delete(ctx, s.cache, cache.Key("action", actionID)); err != nil {
+		return errors.Wrap(err, "removing cached action")
+	}
+
+	if result.DeleteAction.NumUids != 1 {
+		return data.ErrConflict
+	}
+
+	return nil
+}
+
 // QueryByID returns the specified action from the database by the action id.
 func (s Store) QueryByID(ctx context.Context, traceID string, actionID string) (Action, error) {
+	key := cache.Key("action", actionID)
+
+	var act Action
+	ok, err := cache.Get(ctx, s.cache, key, &act)
+	if err != nil {
+		s.log.Warnw("cache", "traceid", traceID, "key", key, "ERROR", err)
+	}
+
+	if !ok {
+		if act, err = s.queryByID(ctx, traceID, actionID); err != nil {
+			return Action{}, err
+		}
+
+		if err := cache.Set(ctx, s.cache, key, act); err != nil {
+			s.log.Warnw("cache", "traceid", traceID, "key", key, "ERROR", err)
+		}
+	}
+
+	// Actions found in the cache never went past the rules of the database,
+	// so the store applies them to every caller. Actions of other
+	// organizations don't exist as far as the caller knows.
+	if !readable(ctx, act) {
+		return Action{}, ErrNotFound
+	}
+
+	return act, nil
+}
+
+// QueryByUser returns the specified action from the database by the user id.
+func (s Store) QueryByUser(ctx context.Context, traceID string, userID string) (Action, error) {
 	query := fmt.Sprintf(`
 query {
-	getAction(id: %q) {
+	queryAction(filter: { user: { eq: %q }%s }) {
 		id
 		name
 		lat
 		lng
 		user
+		org
+		version
+		updated_at
 	}
-}`, actionID)
+}`, userID, tenantFilter(ctx))
 
-	s.log.Debug("%s: %s: %s", traceID, "action.QueryByID", data.Log(query))
+	s.log.Debug("%s: %s: %s", traceID, "action.QueryByUser", data.Log(query))
 
 	// the response from the call has the name of the calling function in it
-
 	var result struct {
-		GetAction Action `json:"getAction"`
+		QueryAction []Action `json:"queryAction"`
 	}
 	if err := s.gql.Execute(ctx, query, &result); err != nil {
 		return Action{}, errors.Wrap(err, "query failed")
 	}
 
-	if result.GetAction.ID == "" {
+	if len(result.QueryAction) != 1 {
 		return Action{}, ErrNotFound
 	}
 
-	return result.GetAction, nil
+	return result.QueryAction[0], nil
 }
 
-// QueryByUser returns the specified action from the database by the user id.
-func (s Store) QueryByUser(ctx context.Context, traceID string, userID string) (Action, error) {
+// QueryByName returns the specified action from the database by its name.
+func (s Store) QueryByName(ctx context.Context, traceID string, name string) (Action, error) {
 	query := fmt.Sprintf(`
 query {
-	queryAction(filter: { User: { eq: %q } }) {
+	queryAction(filter: { name: { eq: %q }%s }) {
 		id
 		name
 		lat
-		lon
-		user 
+		lng
+		user
+		org
+		version
+		updated_at
 	}
-}`, userID)
+}`, name, tenantFilter(ctx))
 
-	s.log.Debug("%s: %s: %s", traceID, "action.QueryByUser", data.Log(query))
+	s.log.Debug("%s: %s: %s", traceID, "action.QueryByName", data.Log(query))
 
-	// the response from the call has the name of the calling function in it
 	var result struct {
 		QueryAction []Action `json:"queryAction"`
 	}
@@ -109,9 +269,141 @@ query {
 	return result.QueryAction[0], nil
 }
 
+// QueryAll returns a page of actions ordered by name.
+func (s Store) QueryAll(ctx context.Context, traceID string, offset int, limit int) ([]Action, error) {
+	query := fmt.Sprintf(`
+query {
+	queryAction(%sorder: { asc: name }, first: %d, offset: %d) {
+		id
+		name
+		lat
+		lng
+		user
+		org
+		version
+		updated_at
+	}
+}`, allFilter(ctx), limit, offset)
+
+	s.log.Debug("%s: %s: %s", traceID, "action.QueryAll", data.Log(query))
+
+	var result struct {
+		QueryAction []Action `json:"queryAction"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryAction, nil
+}
+
+// Restore adds an action exactly as it was exported. If an action with the
+// name already exists it is returned with ErrExists.
+func (s Store) Restore(ctx context.Context, traceID string, act Action) (Action, error) {
+	if existing, err := s.QueryByName(ctx, traceID, act.Name); err == nil {
+		return existing, ErrExists
+	}
+
+	return s.add(ctx, traceID, act)
+}
+
+// QueryByOrg returns the actions recorded by members of the organization.
+func (s Store) QueryByOrg(ctx context.Context, traceID string, orgID string) ([]Action, error) {
+	if tenant, restricted := auth.GetTenant(ctx); restricted && orgID != tenant {
+		return nil, ErrNotFound
+	}
+
+	query := fmt.Sprintf(`
+query {
+	queryAction(filter: { org: { eq: %q } }) {
+		id
+		name
+		lat
+		lng
+		user
+		org
+		version
+		updated_at
+	}
+}`, orgID)
+
+	s.log.Debug("%s: %s: %s", traceID, "action.QueryByOrg", data.Log(query))
+
+	var result struct {
+		QueryAction []Action `json:"queryAction"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryAction, nil
+}
+
 // ===================================================================
 
+// queryForChange reads the action about to be changed from the database
+// rather than the cache, which may not have the latest version.
+func (s Store) queryForChange(ctx context.Context, traceID string, actionID string) (Action, error) {
+	act, err := s.queryByID(ctx, traceID, actionID)
+	if err != nil {
+		return Action{}, err
+	}
+
+	if tenant, restricted := auth.GetTenant(ctx); restricted && act.Org != tenant {
+		return Action{}, ErrNotFound
+	}
+
+	return act, nil
+}
+
+// queryByID reads the action from the database without checking the
+// organization of the caller.
+func (s Store) queryByID(ctx context.Context, traceID string, actionID string) (Action, error) {
+	query := fmt.Sprintf(`
+query {
+	getAction(id: %q) {
+		id
+		name
+		lat
+		lng
+		user
+		org
+		version
+		updated_at
+	}
+}`, actionID)
+
+	s.log.Debug("%s: %s: %s", traceID, "action.QueryByID", data.Log(query))
+
+	// the response from the call has the name of the calling function in it
+
+	var result struct {
+		GetAction Action `json:"getAction"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Action{}, errors.Wrap(err, "query failed")
+	}
+
+	if result.GetAction.ID == "" {
+		return Action{}, ErrNotFound
+	}
+
+	return result.GetAction, nil
+}
+
 func (s Store) add(ctx context.Context, traceID string, act Action) (Action, error) {
+	// Actions outside of any organization have no org at all, so they can
+	// be found with a has filter.
+	var org string
+	if act.Org != "" {
+		org = fmt.Sprintf("org: %q", act.Org)
+	}
+
+	// Actions start at the first version, restored ones keep theirs.
+	if act.Version == 0 {
+		act.Version = 1
+	}
+
 	var result id
 	mutation := fmt.Sprintf(`
 	mutation {
@@ -120,9 +412,11 @@ func (s Store) add(ctx context.Context, traceID string, act Action) (Action, err
 			lat: %f 
 			lng: %f
 			user: %q
+			version: %d
+			%s
 		}])
 		%s
-	}`, act.Name, act.Lat, act.Lng, act.User, result.document())
+	}`, act.Name, act.Lat, act.Lng, act.User, act.Version, org, result.document())
 
 	// s.log.Printf("%s: %s: %s", traceID, "city.Upsert", data.Log(mutation))
 
@@ -137,3 +431,44 @@ func (s Store) add(ctx context.Context, traceID string, act Action) (Action, err
 	act.ID = result.Resp.Entities[0].ID
 	return act, nil
 }
+
+// tenantFilter limits a query to the actions of the organization of the
+// caller. Callers without a tenant only see actions outside of any
+// organization and internal callers see everything.
+func tenantFilter(ctx context.Context) string {
+	tenant, restricted := auth.GetTenant(ctx)
+	switch {
+	case !restricted:
+		return ""
+	case tenant == "":
+		return ", not: { has: org }"
+	default:
+		return fmt.Sprintf(", org: { eq: %q }", tenant)
+	}
+}
+
+// allFilter is the tenantFilter for queries that have no other filter.
+func allFilter(ctx context.Context) string {
+	f := tenantFilter(ctx)
+	if f == "" {
+		return ""
+	}
+	return fmt.Sprintf("filter: { %s }, ", strings.TrimPrefix(f, ", "))
+}
+
+// readable reports whether the caller in the context can read the action.
+// Like tenantFilter it limits callers to their organization, and like the
+// rules of the database it lets users outside of one read only their own
+// actions unless they are admins. Internal callers read everything.
+func readable(ctx context.Context, act Action) bool {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return true
+	}
+
+	if act.Org != claims.Tenant {
+		return false
+	}
+
+	return claims.Tenant != "" || claims.Authorized(auth.RoleAdmin) || act.User == claims.Subject
+}
@@ -1,12 +1,42 @@
 package action
 
+import (
+	"time"
+
+	"github.com/jnkroeker/makulu/foundation/geojson"
+)
+
 // Action represents an action and its coordinates
+//
+// Version counts the changes of the action, so a change can be made to the
+// version the caller read only.
 type Action struct {
-	ID   string  `json:"id,omitempty"`
-	Name string  `json:"name" validate:"required"`
-	Lat  float64 `json:"lat" validate:"required"`
-	Lng  float64 `json:"lng" validate:"required"`
-	User string  `json:"user" validate:"required"`
+	ID        string     `json:"id,omitempty"`
+	Name      string     `json:"name" validate:"required"`
+	Lat       float64    `json:"lat" validate:"required"`
+	Lng       float64    `json:"lng" validate:"required"`
+	User      string     `json:"user" validate:"required"`
+	Org       string     `json:"org,omitempty"`
+	Version   int        `json:"version"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Feature returns the action as a GeoJSON feature, so lists of actions can
+// be drawn on a map.
+func (a Action) Feature() geojson.Feature {
+	props := map[string]interface{}{
+		"name": a.Name,
+		"user": a.User,
+	}
+	if a.Org != "" {
+		props["org"] = a.Org
+	}
+
+	return geojson.Feature{
+		ID:         a.ID,
+		Geometry:   geojson.Point(a.Lat, a.Lng),
+		Properties: props,
+	}
 }
 
 // Action represents an action and its coordinates
@@ -17,6 +47,14 @@ type NewAction struct {
 	User string  `json:"user" validate:"required"`
 }
 
+// UpdateAction contains the fields of an action that can be changed. Fields
+// left out keep their value.
+type UpdateAction struct {
+	Name *string  `json:"name" validate:"omitempty,min=1"`
+	Lat  *float64 `json:"lat" validate:"omitempty,latitude"`
+	Lng  *float64 `json:"lng" validate:"omitempty,longitude"`
+}
+
 // ==============================================================
 
 type id struct {
@@ -0,0 +1,328 @@
+// Package apikey provides support for managing the API keys users issue for
+// scripts and devices that can't log in interactively.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/user"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Set of error variables for CRUD operations.
+var (
+	ErrNotFound              = errors.New("api key not found")
+	ErrAuthenticationFailure = errors.New("api key is not valid")
+)
+
+// keyPrefix starts every key so they are easy to spot in scripts and logs.
+const keyPrefix = "mk"
+
+// lastUsedInterval limits how often use of a key is written to the database.
+const lastUsedInterval = time.Minute
+
+// Store manages the set of APIs for api key access.
+type Store struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+}
+
+// NewStore constructs an api key store for api access.
+func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
+	return Store{
+		log: log,
+		gql: gql,
+	}
+}
+
+// Add generates a new key for the user. The returned value holds the key
+// itself, which can't be recovered later.
+func (s Store) Add(ctx context.Context, traceID string, userID string, nk NewKey, now time.Time) (CreatedKey, error) {
+	if err := validate.Check(nk); err != nil {
+		return CreatedKey{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	prefix, secret, err := generate()
+	if err != nil {
+		return CreatedKey{}, errors.Wrap(err, "generating key")
+	}
+
+	key := Key{
+		Prefix:      prefix,
+		Hash:        hash(secret),
+		User:        userID,
+		Name:        nk.Name,
+		Scopes:      nk.Scopes,
+		DateCreated: now,
+		Expires:     nk.Expires,
+	}
+
+	key, err = s.add(ctx, traceID, key)
+	if err != nil {
+		return CreatedKey{}, err
+	}
+	key.Hash = ""
+
+	return CreatedKey{Key: key, Secret: secret}, nil
+}
+
+// QueryByUser returns the keys issued by the specified user.
+func (s Store) QueryByUser(ctx context.Context, traceID string, userID string) ([]Key, error) {
+	query := fmt.Sprintf(`
+query {
+	queryApiKey(filter: { user: { eq: %q } }) {
+		id
+		prefix
+		user
+		name
+		scopes
+		date_created
+		last_used
+		expires
+	}
+}`, userID)
+
+	s.log.Debug("%s: %s: %s", traceID, "apikey.QueryByUser", data.Log(query))
+
+	var result struct {
+		QueryApiKey []Key `json:"queryApiKey"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryApiKey, nil
+}
+
+// Delete revokes the specified key of the user.
+func (s Store) Delete(ctx context.Context, traceID string, userID string, keyID string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteApiKey(filter: { id: [%q], user: { eq: %q } }) {
+			numUids
+		}
+	}`, keyID, userID)
+
+	s.log.Debug("%s: %s: %s", traceID, "apikey.Delete", data.Log(mutation))
+
+	var result struct {
+		DeleteApiKey struct {
+			NumUids int `json:"numUids"`
+		} `json:"deleteApiKey"`
+	}
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return errors.Wrap(err, "failed to delete api key")
+	}
+
+	if result.DeleteApiKey.NumUids == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Authenticate finds the key and verifies it is valid at the specified time.
+func (s Store) Authenticate(ctx context.Context, traceID string, secret string, now time.Time) (Key, error) {
+	parts := strings.Split(secret, "_")
+	if len(parts) != 3 || parts[0] != keyPrefix {
+		return Key{}, ErrAuthenticationFailure
+	}
+
+	key, err := s.queryByPrefix(ctx, traceID, parts[1])
+	if err != nil {
+		if errors.Cause(err) == ErrNotFound {
+			return Key{}, ErrAuthenticationFailure
+		}
+		return Key{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash(secret))) != 1 {
+		return Key{}, ErrAuthenticationFailure
+	}
+
+	if key.Expired(now) {
+		return Key{}, ErrAuthenticationFailure
+	}
+
+	if now.Sub(key.LastUsed) > lastUsedInterval {
+		if err := s.touch(ctx, traceID, key.ID, now); err != nil {
+			return Key{}, err
+		}
+		key.LastUsed = now
+	}
+
+	key.Hash = ""
+	return key, nil
+}
+
+// =============================================================================
+
+func (s Store) queryByPrefix(ctx context.Context, traceID string, prefix string) (Key, error) {
+	query := fmt.Sprintf(`
+query {
+	queryApiKey(filter: { prefix: { eq: %q } }) {
+		id
+		prefix
+		hash
+		user
+		name
+		scopes
+		date_created
+		last_used
+		expires
+	}
+}`, prefix)
+
+	s.log.Debug("%s: %s: %s", traceID, "apikey.queryByPrefix", data.Log(query))
+
+	var result struct {
+		QueryApiKey []Key `json:"queryApiKey"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Key{}, errors.Wrap(err, "query failed")
+	}
+
+	if len(result.QueryApiKey) != 1 {
+		return Key{}, ErrNotFound
+	}
+
+	return result.QueryApiKey[0], nil
+}
+
+func (s Store) add(ctx context.Context, traceID string, key Key) (Key, error) {
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = fmt.Sprintf("%q", scope)
+	}
+
+	var expires string
+	if !key.Expires.IsZero() {
+		expires = fmt.Sprintf("expires: %q", key.Expires.UTC().Format(time.RFC3339))
+	}
+
+	var result addResult
+	mutation := fmt.Sprintf(`
+	mutation {
+		resp: addApiKey(input: [{
+			prefix: %q
+			hash: %q
+			user: %q
+			name: %q
+			scopes: [%s]
+			date_created: %q
+			%s
+		}])
+		%s
+	}`, key.Prefix, key.Hash, key.User, key.Name, strings.Join(scopes, ", "),
+		key.DateCreated.UTC().Format(time.RFC3339), expires, result.document())
+
+	s.log.Debug("%s: %s: %s", traceID, "apikey.Add", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return Key{}, errors.Wrap(err, "failed to add api key")
+	}
+
+	if len(result.Resp.ApiKey) != 1 {
+		return Key{}, errors.New("api key id not returned")
+	}
+
+	key.ID = result.Resp.ApiKey[0].ID
+	return key, nil
+}
+
+func (s Store) touch(ctx context.Context, traceID string, keyID string, now time.Time) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateApiKey(input: {
+			filter: { id: [%q] }
+			set: { last_used: %q }
+		}) {
+			numUids
+		}
+	}`, keyID, now.UTC().Format(time.RFC3339))
+
+	s.log.Debug("%s: %s: %s", traceID, "apikey.touch", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to update api key")
+	}
+
+	return nil
+}
+
+// generate returns a new key along with the prefix used to look it up. The
+// key has the form mk_<prefix>_<secret>.
+func generate() (string, string, error) {
+	p := make([]byte, 6)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	prefix := hex.EncodeToString(p)
+	secret := keyPrefix + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(b)
+
+	return prefix, secret, nil
+}
+
+// hash returns the hash stored for a key. Keys are long and random, so a
+// fast hash is enough and keeps authentication cheap on every request.
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// =============================================================================
+
+// Lookup implements the auth.APIKeyLookup interface using the key and user
+// stores.
+type Lookup struct {
+	keys  Store
+	users user.Store
+}
+
+// NewLookup constructs a Lookup for use by the auth package.
+func NewLookup(log *zap.SugaredLogger, gql *graphql.GraphQL) Lookup {
+	return Lookup{
+		keys:  NewStore(log, gql),
+		users: user.NewStore(log, gql),
+	}
+}
+
+// ClaimsForKey validates the key and returns the claims of the user that
+// owns it, limited to the scopes of the key.
+func (l Lookup) ClaimsForKey(ctx context.Context, traceID string, secret string) (auth.Claims, error) {
+	now := time.Now()
+
+	key, err := l.keys.Authenticate(ctx, traceID, secret, now)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	usr, err := l.users.QueryByID(ctx, traceID, key.User)
+	if err != nil {
+		return auth.Claims{}, errors.Wrap(err, "query key owner")
+	}
+
+	claims := user.NewClaims(usr, now, auth.AMRAPIKey)
+	claims.Scopes = key.Scopes
+
+	return claims, nil
+}
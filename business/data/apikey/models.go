@@ -0,0 +1,55 @@
+package apikey
+
+import "time"
+
+// Key represents an API key a user has issued for scripts and devices. The
+// key itself is only known at creation, the database holds its hash.
+type Key struct {
+	ID          string    `json:"id"`
+	Prefix      string    `json:"prefix"`
+	Hash        string    `json:"hash,omitempty"`
+	User        string    `json:"user"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	DateCreated time.Time `json:"date_created"`
+	LastUsed    time.Time `json:"last_used"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Expired reports whether the key can no longer be used at the specified time.
+func (k Key) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// NewKey contains information needed to create a new Key. A zero Expires
+// creates a key that doesn't expire.
+type NewKey struct {
+	Name    string    `json:"name" validate:"required"`
+	Scopes  []string  `json:"scopes" validate:"dive,required"`
+	Expires time.Time `json:"expires"`
+}
+
+// CreatedKey is returned when a key is created. It is the only time the
+// key is shown.
+type CreatedKey struct {
+	Key
+	Secret string `json:"key"`
+}
+
+// =============================================================================
+
+type addResult struct {
+	Resp struct {
+		ApiKey []struct {
+			ID string `json:"id"`
+		} `json:"apiKey"`
+	} `json:"resp"`
+}
+
+func (addResult) document() string {
+	return `{
+		apiKey {
+			id
+		}
+	}`
+}
@@ -0,0 +1,119 @@
+// Package audit provides support for recording who did what in the system.
+package audit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"go.uber.org/zap"
+)
+
+// Set of actions recorded by the system.
+const (
+	ActionUserCreate      = "user.create"
+	ActionUserLink        = "user.link"
+	ActionLogin           = "login"
+	ActionTokenIssue      = "token.issue"
+	ActionKeyCreate       = "apikey.create"
+	ActionKeyRevoke       = "apikey.revoke"
+	ActionAuthorize       = "authorize"
+	ActionUserUpdate      = "user.update"
+	ActionUserDelete      = "user.delete"
+	ActionActionCreate    = "action.create"
+	ActionActionUpdate    = "action.update"
+	ActionActionDelete    = "action.delete"
+	ActionOrgCreate       = "org.create"
+	ActionOrgMemberAdd    = "org.member.add"
+	ActionOrgMemberRemove = "org.member.remove"
+	ActionRecoveryCodeUse = "mfa.recovery_code.use"
+)
+
+// Set of outcomes of recorded actions.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Anonymous is the actor of events recorded for callers without claims.
+const Anonymous = "anonymous"
+
+// Limits on the number of events returned by a query.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// writeTimeout is how long recording an event may take.
+const writeTimeout = 5 * time.Second
+
+// Sink keeps the recorded events. Events are only ever added to a sink.
+type Sink interface {
+	Write(ctx context.Context, e Event) error
+	Query(ctx context.Context, f Filter) ([]Event, error)
+}
+
+// Auditor records events to its sink. A nil Auditor records nothing.
+type Auditor struct {
+	log  *zap.SugaredLogger
+	sink Sink
+}
+
+// New constructs an Auditor recording events to the sink.
+func New(log *zap.SugaredLogger, sink Sink) *Auditor {
+	return &Auditor{
+		log:  log,
+		sink: sink,
+	}
+}
+
+// Record completes the event with what is known about the request and adds
+// it to the sink. The actor is taken from the claims of the caller unless it
+// is set. Failing to record is logged but doesn't fail the request.
+func (a *Auditor) Record(ctx context.Context, r *http.Request, e Event) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Actor == "" {
+		e.Actor = Anonymous
+		if claims, err := auth.GetClaims(ctx); err == nil {
+			e.Actor = claims.Subject
+		}
+	}
+	if e.TraceID == "" {
+		e.TraceID = web.GetTraceID(ctx)
+	}
+	if e.ClientIP == "" && r != nil {
+		e.ClientIP = web.ClientIP(r)
+	}
+
+	a.log.Infow("AUDIT", "traceid", e.TraceID, "actor", e.Actor, "action", e.Action, "target", e.Target, "outcome", e.Outcome, "clientip", e.ClientIP)
+
+	// The event is recorded even when the caller went away and always with
+	// the access of the service, callers can't write to the sink themselves.
+	wctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	if err := a.sink.Write(wctx, e); err != nil {
+		a.log.Errorw("AUDIT", "traceid", e.TraceID, "status", "recording event", "action", e.Action, "ERROR", err)
+	}
+}
+
+// Query returns the events selected by the filter, newest first.
+func (a *Auditor) Query(ctx context.Context, f Filter) ([]Event, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultLimit
+	}
+	if f.Limit > MaxLimit {
+		f.Limit = MaxLimit
+	}
+
+	return a.sink.Query(ctx, f)
+}
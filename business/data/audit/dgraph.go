@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Store is a sink keeping events in the database. The schema only lets
+// events be added and read by admins, never changed or removed.
+type Store struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+}
+
+// NewStore constructs an audit store for api access.
+func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
+	return Store{
+		log: log,
+		gql: gql,
+	}
+}
+
+// Write implements the Sink interface. The event is sent as a variable
+// since its detail can hold anything.
+func (s Store) Write(ctx context.Context, e Event) error {
+	mutation := `
+	mutation addAuditEvent($input: [AddAuditEventInput!]!) {
+		addAuditEvent(input: $input) {
+			numUids
+		}
+	}`
+
+	input := map[string]interface{}{
+		"time":      e.Time.UTC().Format(time.RFC3339Nano),
+		"actor":     e.Actor,
+		"action":    e.Action,
+		"target":    e.Target,
+		"outcome":   e.Outcome,
+		"trace_id":  e.TraceID,
+		"client_ip": e.ClientIP,
+		"detail":    e.Detail,
+	}
+
+	s.log.Debug("%s: %s: %s", e.TraceID, "audit.Write", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil, graphql.WithVariable("input", []interface{}{input})); err != nil {
+		return errors.Wrap(err, "failed to add audit event")
+	}
+
+	return nil
+}
+
+// Query implements the Sink interface.
+func (s Store) Query(ctx context.Context, f Filter) ([]Event, error) {
+	var conds []string
+	for _, eq := range []struct{ field, value string }{
+		{"actor", f.Actor},
+		{"action", f.Action},
+		{"target", f.Target},
+		{"outcome", f.Outcome},
+	} {
+		if eq.value != "" {
+			conds = append(conds, fmt.Sprintf("{ %s: { eq: %q } }", eq.field, eq.value))
+		}
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, fmt.Sprintf("{ time: { ge: %q } }", f.From.UTC().Format(time.RFC3339Nano)))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, fmt.Sprintf("{ time: { le: %q } }", f.To.UTC().Format(time.RFC3339Nano)))
+	}
+
+	var filter string
+	if len(conds) > 0 {
+		filter = fmt.Sprintf("filter: { and: [%s] }, ", strings.Join(conds, ", "))
+	}
+
+	query := fmt.Sprintf(`
+query {
+	queryAuditEvent(%sorder: { desc: time }, first: %d) {
+		id
+		time
+		actor
+		action
+		target
+		outcome
+		trace_id
+		client_ip
+		detail
+	}
+}`, filter, f.Limit)
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "audit.Query", data.Log(query))
+
+	var result struct {
+		QueryAuditEvent []Event `json:"queryAuditEvent"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryAuditEvent, nil
+}
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File is a sink keeping events as lines of JSON in a file that is only
+// ever appended to.
+type File struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// NewFile opens the file at the path, creating it when needed.
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+
+	return &File{
+		path: path,
+		f:    f,
+	}, nil
+}
+
+// Write implements the Sink interface.
+func (s *File) Write(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshal event")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "writing event")
+	}
+
+	return nil
+}
+
+// Query implements the Sink interface. The file is read from the start, so
+// queries get slower as it grows; rotate it with the logs.
+func (s *File) Query(ctx context.Context, f Filter) ([]Event, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", s.path)
+	}
+	defer file.Close()
+
+	// Events are in the order they happened, so only the last matches are
+	// kept while reading.
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+
+		if !f.match(e) {
+			continue
+		}
+
+		events = append(events, e)
+		if len(events) > f.Limit {
+			events = events[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", s.path)
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
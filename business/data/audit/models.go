@@ -0,0 +1,46 @@
+package audit
+
+import "time"
+
+// Event represents something done in the system worth keeping a record of.
+type Event struct {
+	ID       string    `json:"id,omitempty"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	Outcome  string    `json:"outcome"`
+	TraceID  string    `json:"trace_id,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Filter selects the events to return. Empty fields match every event.
+type Filter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Limit   int
+}
+
+// match reports whether the event is selected by the filter.
+func (f Filter) match(e Event) bool {
+	switch {
+	case f.Actor != "" && e.Actor != f.Actor:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Target != "" && e.Target != f.Target:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.From.IsZero() && e.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && e.Time.After(f.To):
+		return false
+	}
+	return true
+}
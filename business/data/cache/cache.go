@@ -0,0 +1,78 @@
+// Package cache provides support for keeping database values close to the
+// service so repeated reads don't reach the database.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/jnkroeker/makulu/business/sys/metrics"
+	"github.com/pkg/errors"
+)
+
+// Cache represents a store of values by key. Values expire after the time to
+// live the cache was constructed with.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Key returns the key of a value of the kind, like user or action, with the
+// specified id.
+func Key(kind string, id string) string {
+	return kind + ":" + id
+}
+
+// Get looks the key up and unmarshals the value into v. It reports whether
+// the key was found and counts the hit or miss by kind. A nil cache always
+// misses without counting.
+func Get(ctx context.Context, c Cache, key string, v interface{}) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+
+	kind := key
+	if i := strings.Index(key, ":"); i >= 0 {
+		kind = key[:i]
+	}
+
+	data, ok, err := c.Get(ctx, key)
+	if err != nil || !ok {
+		metrics.AddCacheMiss(kind)
+		return false, err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		metrics.AddCacheMiss(kind)
+		return false, errors.Wrapf(err, "unmarshal %s", key)
+	}
+
+	metrics.AddCacheHit(kind)
+	return true, nil
+}
+
+// Set marshals v and stores it under the key. A nil cache stores nothing.
+func Set(ctx context.Context, c Cache, key string, v interface{}) error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s", key)
+	}
+
+	return c.Set(ctx, key, data)
+}
+
+// Delete removes the key so the next read goes to the database. A nil cache
+// removes nothing.
+func Delete(ctx context.Context, c Cache, key string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.Delete(ctx, key)
+}
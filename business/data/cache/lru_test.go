@@ -0,0 +1,147 @@
+package cache_test
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/cache"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+// counter returns the count of the kind in the expvar map of the name.
+func counter(name string, kind string) int64 {
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	v, ok := m.Get(kind).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+
+	type value struct {
+		Name string
+	}
+
+	t.Log("Given the need to keep values close to the service.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen reading values through the cache.", testID)
+		{
+			c := cache.NewLRU(2, time.Hour)
+			hits, misses := counter("cache_hits", "lrutest"), counter("cache_misses", "lrutest")
+
+			var v value
+			if ok, err := cache.Get(ctx, c, cache.Key("lrutest", "1"), &v); ok || err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould miss a value that was never set: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould miss a value that was never set.", tests.Success, testID)
+
+			if err := cache.Set(ctx, c, cache.Key("lrutest", "1"), value{Name: "one"}); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to set a value: %v", tests.Failed, testID, err)
+			}
+
+			if ok, err := cache.Get(ctx, c, cache.Key("lrutest", "1"), &v); !ok || err != nil || v.Name != "one" {
+				t.Fatalf("\t%s\tTest %d:\tShould get back the value that was set: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get back the value that was set.", tests.Success, testID)
+
+			if got := counter("cache_hits", "lrutest") - hits; got != 1 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould count the hit by kind.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould count the hit by kind.", tests.Success, testID)
+
+			if got := counter("cache_misses", "lrutest") - misses; got != 1 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould count the miss by kind.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould count the miss by kind.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen a value is changed.", testID)
+		{
+			c := cache.NewLRU(2, time.Hour)
+			key := cache.Key("lrutest", "1")
+
+			cache.Set(ctx, c, key, value{Name: "one"})
+			cache.Set(ctx, c, key, value{Name: "uno"})
+
+			var v value
+			if ok, _ := cache.Get(ctx, c, key, &v); !ok || v.Name != "uno" {
+				t.Fatalf("\t%s\tTest %d:\tShould replace the value when it is set again.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould replace the value when it is set again.", tests.Success, testID)
+
+			if err := cache.Delete(ctx, c, key); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to delete the value: %v", tests.Failed, testID, err)
+			}
+			if ok, _ := cache.Get(ctx, c, key, &v); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould miss the value once it was deleted.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould miss the value once it was deleted.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the cache is full.", testID)
+		{
+			c := cache.NewLRU(2, time.Hour)
+
+			c.Set(ctx, "a", []byte("a"))
+			c.Set(ctx, "b", []byte("b"))
+			c.Get(ctx, "a")
+			c.Set(ctx, "c", []byte("c"))
+
+			if _, ok, _ := c.Get(ctx, "b"); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould evict the least recently used value.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould evict the least recently used value.", tests.Success, testID)
+
+			for _, key := range []string{"a", "c"} {
+				if _, ok, _ := c.Get(ctx, key); !ok {
+					t.Fatalf("\t%s\tTest %d:\tShould keep value %q.", tests.Failed, testID, key)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the recently used values.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen a value outlived the time to live.", testID)
+		{
+			c := cache.NewLRU(2, 10*time.Millisecond)
+
+			c.Set(ctx, "a", []byte("a"))
+			if _, ok, _ := c.Get(ctx, "a"); !ok {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the value until it expires.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the value until it expires.", tests.Success, testID)
+
+			time.Sleep(20 * time.Millisecond)
+			if _, ok, _ := c.Get(ctx, "a"); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould miss the value once it expired.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould miss the value once it expired.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen there is no cache.", testID)
+		{
+			var v value
+			if ok, err := cache.Get(ctx, nil, cache.Key("lrutest", "1"), &v); ok || err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould always miss.", tests.Failed, testID)
+			}
+			if err := cache.Set(ctx, nil, cache.Key("lrutest", "1"), v); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould store nothing without failing.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould always miss and store nothing.", tests.Success, testID)
+		}
+	}
+}
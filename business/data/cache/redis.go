@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RedisConfig represents the settings to reach a server speaking the Redis
+// protocol.
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	Timeout  time.Duration
+	MaxIdle  int
+}
+
+// Redis is a cache kept in a server speaking the Redis protocol, so it is
+// shared by every instance of the service.
+type Redis struct {
+	cfg  RedisConfig
+	ttl  time.Duration
+	idle chan *redisConn
+}
+
+// redisConn is a connection to the server with its buffered reader.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedis constructs a Redis cache keeping values for the time to live.
+// Connections are made when they are first needed.
+func NewRedis(cfg RedisConfig, ttl time.Duration) *Redis {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 10
+	}
+
+	return &Redis{
+		cfg:  cfg,
+		ttl:  ttl,
+		idle: make(chan *redisConn, cfg.MaxIdle),
+	}
+}
+
+// Get implements the Cache interface.
+func (c *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	return reply, true, nil
+}
+
+// Set implements the Cache interface.
+func (c *Redis) Set(ctx context.Context, key string, value []byte) error {
+	ms := strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	_, err := c.do(ctx, "SET", key, string(value), "PX", ms)
+	return err
+}
+
+// Delete implements the Cache interface.
+func (c *Redis) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", key)
+	return err
+}
+
+// =============================================================================
+
+// do sends the command and returns the reply. Connections that failed are
+// closed, the others are kept for the next command.
+func (c *Redis) do(ctx context.Context, args ...string) ([]byte, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.command(ctx, c.cfg.Timeout, args...)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "redis %s", args[0])
+	}
+
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+
+	return reply, nil
+}
+
+// conn returns an idle connection or dials a new one.
+func (c *Redis) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	d := net.Dialer{Timeout: c.cfg.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "redis dial")
+	}
+
+	conn := redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if c.cfg.Password != "" {
+		if _, err := conn.command(ctx, c.cfg.Timeout, "AUTH", c.cfg.Password); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "redis auth")
+		}
+	}
+
+	if c.cfg.DB != 0 {
+		if _, err := conn.command(ctx, c.cfg.Timeout, "SELECT", strconv.Itoa(c.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "redis select")
+		}
+	}
+
+	return &conn, nil
+}
+
+// command writes the arguments as an array of bulk strings and reads the
+// reply. Bulk replies are returned as is, a nil bulk reply as nil and
+// simple strings and integers as their text.
+func (conn *redisConn) command(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+
+	case '-':
+		return nil, errors.New(line[1:])
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Errorf("malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+
+	return nil, errors.Errorf("unexpected reply %q", line)
+}
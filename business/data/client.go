@@ -0,0 +1,399 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/metrics"
+	"github.com/jnkroeker/makulu/foundation/trace"
+)
+
+// ErrUnavailable is returned when the database can't be reached, either
+// because requests keep failing or because the circuit breaker is open.
+var ErrUnavailable = errors.New("database unavailable")
+
+// Policy represents how requests to the database are protected against
+// failures. The zero value applies no timeout, retries or circuit breaker.
+type Policy struct {
+	Timeout          time.Duration
+	Retries          int
+	RetryBase        time.Duration
+	RetryMax         time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// IsUnavailable reports whether the error, or any error it wraps, is
+// ErrUnavailable.
+func IsUnavailable(err error) bool {
+	for err != nil {
+		if err == ErrUnavailable {
+			return true
+		}
+		if _, ok := err.(*deadlineError); ok {
+			return true
+		}
+
+		// Errors wrapped by github.com/pkg/errors only expose Cause.
+		if next := errors.Unwrap(err); next != nil {
+			err = next
+			continue
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// =============================================================================
+
+// breakers holds a circuit breaker per database url and settings, so every
+// client talking to the same database shares its view of whether it is down.
+var breakers = struct {
+	sync.Mutex
+	m map[string]*breaker
+}{
+	m: make(map[string]*breaker),
+}
+
+// breakerFor returns the circuit breaker for the database url. Clients with
+// other settings for the breaker get their own, so the settings of the first
+// client don't silently apply to every other.
+func breakerFor(url string, threshold int, cooldown time.Duration) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	key := fmt.Sprintf("%s|%d|%s", url, threshold, cooldown)
+
+	b, ok := breakers.m[key]
+	if !ok {
+		b = &breaker{threshold: threshold, cooldown: cooldown}
+		breakers.m[key] = b
+	}
+	return b
+}
+
+// breaker opens after a number of consecutive failures and fails requests
+// fast until the cooldown passed. Then a single request is let through to
+// find out if the database is back.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openTill time.Time
+	probing  bool
+}
+
+// allow reports whether a request can be made.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if now.Before(b.openTill) || b.probing {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// abandon ends a request that has no outcome, like one its caller gave up
+// on, so the next request can probe the database instead.
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// record updates the breaker with the outcome of a request.
+func (b *breaker) record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openTill = now.Add(b.cooldown)
+	}
+}
+
+// =============================================================================
+
+// resilient applies the policy to every request sent to the database.
+type resilient struct {
+	next    http.RoundTripper
+	policy  Policy
+	breaker *breaker
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (r *resilient) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	op, query := operation(body)
+
+	// Every call to the database is a span of the trace of the request.
+	ctx, span := trace.Start(req.Context(), "graphql "+op, trace.KindClient)
+	span.SetAttribute("db.system", "dgraph")
+	span.SetAttribute("db.operation", op)
+	defer span.End()
+	req = req.WithContext(ctx)
+
+	// Mutations are not idempotent, so they are only ever sent once.
+	attempts := 1
+	if query {
+		attempts += r.policy.Retries
+	}
+
+	resp, err := r.retry(req, body, op, attempts)
+	span.SetError(err)
+	if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+		span.SetError(errors.New(resp.Status))
+	}
+
+	return resp, err
+}
+
+// retry sends the request until it succeeds or the attempts run out.
+func (r *resilient) retry(req *http.Request, body []byte, op string, attempts int) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := r.backoff(attempt)
+
+			// The caller would run out of time before trying again, so it
+			// is told the deadline can't be met while it can still answer.
+			if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) <= wait {
+				return nil, &deadlineError{deadline: deadline, err: lastErr}
+			}
+
+			if err := sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		}
+
+		if r.breaker != nil && !r.breaker.allow(time.Now()) {
+			metrics.AddDBFailure(op)
+			return nil, ErrUnavailable
+		}
+
+		metrics.AddDBAttempt(op)
+		start := time.Now()
+		resp, err := r.attempt(req, body)
+		metrics.ObserveDB(op, time.Since(start))
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+
+		// The caller gave up, which says nothing about the database, so
+		// it is neither counted as a failure nor tried again.
+		if failed && req.Context().Err() != nil {
+			if r.breaker != nil {
+				r.breaker.abandon()
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+
+		if r.breaker != nil {
+			r.breaker.record(time.Now(), failed)
+		}
+
+		if !failed {
+			return resp, nil
+		}
+
+		metrics.AddDBFailure(op)
+
+		if err == nil {
+			if attempt == attempts-1 {
+				return resp, nil
+			}
+			resp.Body.Close()
+			continue
+		}
+		lastErr = err
+	}
+
+	return nil, &unavailableError{err: lastErr}
+}
+
+// attempt sends the request once with the timeout of the policy.
+func (r *resilient) attempt(req *http.Request, body []byte) (*http.Response, error) {
+	ctx := req.Context()
+	cancel := func() {}
+	if r.policy.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, r.policy.Timeout)
+	}
+
+	req = req.Clone(ctx)
+	trace.Inject(ctx, req.Header)
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout covers reading the body, so it is only released when the
+	// body is closed.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff returns a random wait before the attempt that grows exponentially
+// with the attempt, so clients don't retry in lockstep.
+func (r *resilient) backoff(attempt int) time.Duration {
+	base := r.policy.RetryBase
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+
+	d := base << uint(attempt-1)
+	if r.policy.RetryMax > 0 && (d > r.policy.RetryMax || d <= 0) {
+		d = r.policy.RetryMax
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// unavailableError keeps the cause of the last failure while being
+// recognized as ErrUnavailable.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return ErrUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return ErrUnavailable
+}
+
+// deadlineError is returned when the deadline of the caller would pass
+// before the request could be tried again. It is recognized as both
+// ErrUnavailable and context.DeadlineExceeded, since the database failed but
+// the request gave up because of the deadline.
+type deadlineError struct {
+	deadline time.Time
+	err      error
+}
+
+func (e *deadlineError) Error() string {
+	if e.err == nil {
+		return ErrUnavailable.Error() + ": no time left to retry"
+	}
+	return ErrUnavailable.Error() + ": no time left to retry: " + e.err.Error()
+}
+
+func (e *deadlineError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Deadline returns the deadline the request gave up on.
+func (e *deadlineError) Deadline() time.Time {
+	return e.deadline
+}
+
+// cancelBody releases the context of a request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// operation returns the name of the first field of the GraphQL document in
+// the body, like queryUser or addAction, and whether it is a query. Bodies
+// that aren't GraphQL documents are treated as not idempotent.
+func operation(body []byte) (string, bool) {
+	var doc struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil || doc.Query == "" {
+		return "unknown", false
+	}
+
+	q := strings.TrimSpace(doc.Query)
+	query := !strings.HasPrefix(q, "mutation")
+
+	// Skip the operation keyword, name and variables up to the selection set.
+	if i := strings.Index(q, "{"); i >= 0 {
+		q = q[i+1:]
+	}
+
+	for {
+		q = strings.TrimSpace(q)
+		end := strings.IndexFunc(q, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		})
+		if end <= 0 {
+			return "unknown", query
+		}
+
+		name, rest := q[:end], strings.TrimSpace(q[end:])
+
+		// An alias like resp: addAction names the result, not the operation.
+		if strings.HasPrefix(rest, ":") {
+			q = rest[1:]
+			continue
+		}
+
+		return name, query
+	}
+}
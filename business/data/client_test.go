@@ -0,0 +1,319 @@
+package data_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+// fakeTransport answers requests with the statuses in order, and with the
+// last one once they run out. A status of 0 fails the request like a
+// connection error, and a status of -1 waits until the caller gives up.
+type fakeTransport struct {
+	mu       sync.Mutex
+	statuses []int
+	calls    int
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	status := f.statuses[len(f.statuses)-1]
+	if f.calls < len(f.statuses) {
+		status = f.statuses[f.calls]
+	}
+	f.calls++
+	f.mu.Unlock()
+
+	switch status {
+	case 0:
+		return nil, errors.New("connection refused")
+	case -1:
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"data":{}}`)),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeTransport) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// dbCounter returns the count of the operation in the expvar map of the name.
+func dbCounter(name string, op string) int64 {
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	v, ok := m.Get(op).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// newClient returns a client for a database of its own, so the circuit
+// breakers of the tests don't affect each other.
+func newClient(t *testing.T, policy data.Policy, f *fakeTransport) func(ctx context.Context, q string) error {
+	gql := data.NewGraphQL(data.GraphQLConfig{
+		URL:       fmt.Sprintf("http://%s.test", strings.ReplaceAll(t.Name(), "/", "-")),
+		Policy:    policy,
+		Transport: f,
+	})
+
+	return func(ctx context.Context, q string) error {
+		var result struct{}
+		return gql.Execute(ctx, q, &result)
+	}
+}
+
+func TestResilient(t *testing.T) {
+	fast := data.Policy{Retries: 2, RetryBase: time.Hour, RetryMax: time.Millisecond}
+
+	tt := []struct {
+		name        string
+		policy      data.Policy
+		q           string
+		statuses    []int
+		calls       int
+		fail        bool
+		unavailable bool
+	}{
+		{"query recovers", fast, "query { queryUser { id } }", []int{503, 200}, 2, false, false},
+		{"query keeps failing", fast, "query { queryUser { id } }", []int{0}, 3, true, true},
+		{"query keeps answering 5xx", fast, "query { queryUser { id } }", []int{502}, 3, true, false},
+		{"query not retried on 4xx", fast, "query { queryUser { id } }", []int{400}, 1, true, false},
+		{"mutation sent once", fast, "mutation { addUser { id } }", []int{503, 200}, 1, true, false},
+		{"mutation connection error", fast, "mutation { addUser { id } }", []int{0}, 1, true, true},
+		{"no policy", data.Policy{}, "query { queryUser { id } }", []int{503, 200}, 1, true, false},
+	}
+
+	t.Log("Given the need to protect requests against a failing database.")
+	{
+		for testID, tst := range tt {
+			t.Logf("\tTest %d:\tWhen sending a request for %q.", testID, tst.name)
+			{
+				f := fakeTransport{statuses: tst.statuses}
+				execute := newClient(t, tst.policy, &f)
+
+				start := time.Now()
+				err := execute(context.Background(), tst.q)
+
+				if got := f.count(); got != tst.calls {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+					t.Logf("\t\tTest %d:\texp: %v", testID, tst.calls)
+					t.Fatalf("\t%s\tTest %d:\tShould send the request the expected number of times.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould send the request the expected number of times.", tests.Success, testID)
+
+				if (err != nil) != tst.fail {
+					t.Fatalf("\t%s\tTest %d:\tShould fail only when the database does: %v", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould fail only when the database does.", tests.Success, testID)
+
+				if data.IsUnavailable(err) != tst.unavailable {
+					t.Fatalf("\t%s\tTest %d:\tShould report the database unavailable only when it can't be reached: %v", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould report the database unavailable only when it can't be reached.", tests.Success, testID)
+
+				if d := time.Since(start); d > time.Second {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, d)
+					t.Fatalf("\t%s\tTest %d:\tShould wait no longer than the maximum backoff.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould wait no longer than the maximum backoff.", tests.Success, testID)
+			}
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	policy := data.Policy{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	q := "mutation { addUser { id } }"
+
+	t.Log("Given the need to fail fast while the database is down.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen requests keep failing.", testID)
+		{
+			f := fakeTransport{statuses: []int{503, 503, 200}}
+			execute := newClient(t, policy, &f)
+
+			execute(ctx, q)
+			execute(ctx, q)
+
+			if err := execute(ctx, q); !data.IsUnavailable(err) {
+				t.Fatalf("\t%s\tTest %d:\tShould fail with the database unavailable once open: %v", tests.Failed, testID, err)
+			}
+			if got := f.count(); got != 2 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould not send requests once open.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not send requests once open.", tests.Success, testID)
+
+			time.Sleep(policy.BreakerCooldown)
+
+			if err := execute(ctx, q); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould let a request probe the database after the cooldown: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould let a request probe the database after the cooldown.", tests.Success, testID)
+
+			if err := execute(ctx, q); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould close once the probe succeeds: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould close once the probe succeeds.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen callers give up on their requests.", testID)
+		{
+			f := fakeTransport{statuses: []int{-1, -1, 200}}
+			execute := newClient(t, policy, &f)
+			failures := dbCounter("db_failures", "addBreakerTest")
+
+			for i := 0; i < 2; i++ {
+				ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+				err := execute(ctx, "mutation { addBreakerTest { id } }")
+				cancel()
+
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("\t%s\tTest %d:\tShould return the error of the caller: %v", tests.Failed, testID, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould return the error of the caller.", tests.Success, testID)
+
+			if err := execute(ctx, q); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not open the breaker: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not open the breaker.", tests.Success, testID)
+
+			if got := dbCounter("db_failures", "addBreakerTest") - failures; got != 0 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould not count them as failures of the database.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not count them as failures of the database.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen clients of the same database use other settings.", testID)
+		{
+			f := fakeTransport{statuses: []int{503, 200}}
+			strict := data.NewGraphQL(data.GraphQLConfig{URL: "http://shared.test", Policy: data.Policy{BreakerThreshold: 1, BreakerCooldown: time.Hour}, Transport: &f})
+			lenient := data.NewGraphQL(data.GraphQLConfig{URL: "http://shared.test", Policy: data.Policy{BreakerThreshold: 5, BreakerCooldown: time.Hour}, Transport: &f})
+
+			var result struct{}
+			strict.Execute(ctx, q, &result)
+
+			if err := lenient.Execute(ctx, q, &result); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould apply their own settings: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply their own settings.", tests.Success, testID)
+		}
+	}
+}
+
+func TestOperation(t *testing.T) {
+	tt := []struct {
+		name  string
+		q     string
+		op    string
+		query bool
+	}{
+		{"query", "query { queryOpTest(filter: {}) { id } }", "queryOpTest", true},
+		{"named query", "query Users($id: ID!) { getOpTest(id: $id) { id } }", "getOpTest", true},
+		{"shorthand query", "{ shortOpTest { id } }", "shortOpTest", true},
+		{"mutation", "mutation { addOpTest(input: []) { id } }", "addOpTest", false},
+		{"aliased mutation", "mutation { resp: updateOpTest(input: {}) { id } }", "updateOpTest", false},
+	}
+
+	t.Log("Given the need to measure every database operation on its own.")
+	{
+		for testID, tst := range tt {
+			t.Logf("\tTest %d:\tWhen sending a %s.", testID, tst.name)
+			{
+				f := fakeTransport{statuses: []int{503, 200}}
+				execute := newClient(t, data.Policy{Retries: 1, RetryMax: time.Millisecond}, &f)
+				attempts := dbCounter("db_attempts", tst.op)
+
+				execute(context.Background(), tst.q)
+
+				calls := 1
+				if tst.query {
+					calls = 2
+				}
+				if got := dbCounter("db_attempts", tst.op) - attempts; got != int64(calls) {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+					t.Logf("\t\tTest %d:\texp: %v", testID, calls)
+					t.Fatalf("\t%s\tTest %d:\tShould count the attempts by the name of the operation.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould count the attempts by the name of the operation.", tests.Success, testID)
+
+				if got := f.count(); got != calls {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+					t.Fatalf("\t%s\tTest %d:\tShould only retry queries.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould only retry queries.", tests.Success, testID)
+			}
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	t.Log("Given the need to answer while the caller still has time.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen the deadline would pass before the request is tried again.", testID)
+		{
+			f := fakeTransport{statuses: []int{503}}
+			execute := newClient(t, data.Policy{Retries: 2, RetryBase: time.Hour}, &f)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			start := time.Now()
+			err := execute(ctx, "query { queryUser { id } }")
+
+			if time.Since(start) > 500*time.Millisecond || f.count() != 1 {
+				t.Fatalf("\t%s\tTest %d:\tShould give up without waiting for the next attempt.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould give up without waiting for the next attempt.", tests.Success, testID)
+
+			if !data.IsUnavailable(err) {
+				t.Fatalf("\t%s\tTest %d:\tShould report the database unavailable: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould report the database unavailable.", tests.Success, testID)
+
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("\t%s\tTest %d:\tShould report the deadline as the reason: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould report the deadline as the reason.", tests.Success, testID)
+
+			var d interface{ Deadline() time.Time }
+			if !errors.As(err, &d) {
+				t.Fatalf("\t%s\tTest %d:\tShould say which deadline it gave up on: %v", tests.Failed, testID, err)
+			}
+			if dl, _ := ctx.Deadline(); !d.Deadline().Equal(dl) {
+				t.Fatalf("\t%s\tTest %d:\tShould give up on the deadline of the caller.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould say which deadline it gave up on.", tests.Success, testID)
+		}
+	}
+}
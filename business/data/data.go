@@ -22,12 +22,30 @@ type GraphQLConfig struct {
 	AuthToken       string
 	CloudHeaderName string
 	CloudToken      string
+
+	// CallerToken returns the token of the caller in the context. When it
+	// returns true the token is sent in place of AuthToken so the database
+	// authorizes the caller instead of the service.
+	CallerToken func(ctx context.Context) (string, bool, error)
+
+	// ServiceToken returns the token of the service. It is asked for on
+	// every request made without a caller, so the token can be short lived,
+	// and takes the place of AuthToken when set.
+	ServiceToken func() (string, error)
+
+	// Policy protects requests against a slow or failing database.
+	Policy Policy
+
+	// Transport sends the requests to the database. It defaults to an
+	// http.Transport and is replaced by tests.
+	Transport http.RoundTripper
 }
 
 // NewGraphQL constructs a graphql value for use to access the database.
 func NewGraphQL(gqlConfig GraphQLConfig) *graphql.GraphQL {
-	client := http.Client{
-		Transport: &http.Transport{
+	transport := gqlConfig.Transport
+	if transport == nil {
+		transport = &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
@@ -39,7 +57,31 @@ func NewGraphQL(gqlConfig GraphQLConfig) *graphql.GraphQL {
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-		},
+		}
+	}
+
+	// Every request goes through the policy, even the zero one, so the
+	// attempts, failures and latency are measured.
+	r := resilient{
+		next:   transport,
+		policy: gqlConfig.Policy,
+	}
+	if gqlConfig.Policy.BreakerThreshold > 0 {
+		r.breaker = breakerFor(gqlConfig.URL, gqlConfig.Policy.BreakerThreshold, gqlConfig.Policy.BreakerCooldown)
+	}
+	transport = &r
+
+	if gqlConfig.CallerToken != nil || gqlConfig.ServiceToken != nil {
+		transport = &callerAuth{
+			next:    transport,
+			header:  gqlConfig.AuthHeaderName,
+			caller:  gqlConfig.CallerToken,
+			service: gqlConfig.ServiceToken,
+		}
+	}
+
+	client := http.Client{
+		Transport: transport,
 	}
 
 	graphql := graphql.New(gqlConfig.URL,
@@ -130,3 +172,44 @@ func checkDB(ctx context.Context, url string) error {
 
 	return nil
 }
+
+// =============================================================================
+
+// callerAuth replaces the configured token with the token of the caller in
+// the context of the request, so the database enforces its rules on the
+// caller, or with a fresh token of the service when there is no caller.
+type callerAuth struct {
+	next    http.RoundTripper
+	header  string
+	caller  func(ctx context.Context) (string, bool, error)
+	service func() (string, error)
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (c *callerAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	var tkn string
+	var ok bool
+	if c.caller != nil {
+		var err error
+		tkn, ok, err = c.caller(req.Context())
+		if err != nil {
+			return nil, errors.Wrap(err, "caller token")
+		}
+	}
+
+	if !ok && c.service != nil {
+		var err error
+		tkn, err = c.service()
+		if err != nil {
+			return nil, errors.Wrap(err, "service token")
+		}
+		ok = true
+	}
+
+	if ok {
+		req = req.Clone(req.Context())
+		req.Header.Set(c.header, tkn)
+	}
+
+	return c.next.RoundTrip(req)
+}
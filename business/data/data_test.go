@@ -2,6 +2,7 @@ package data_test
 
 import (
 	"context"
+	"os"
 	"testing"
 	"time"
 
@@ -11,6 +12,8 @@ import (
 	"github.com/jnkroeker/makulu/business/data/schema"
 	"github.com/jnkroeker/makulu/business/data/user"
 	"github.com/jnkroeker/makulu/business/ready"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/foundation/keystore"
 	"github.com/jnkroeker/makulu/foundation/tests"
 	"go.uber.org/zap"
 )
@@ -67,7 +70,26 @@ func waitReady(t *testing.T, ctx context.Context, testID int, url string) *graph
 	}
 	gql := data.NewGraphQL(gqlConfig)
 
-	schema, err := schema.New(gql)
+	// The database verifies tokens with the public key of the development key.
+	ks, err := keystore.NewFS(os.DirFS("../../zarf/keys"))
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to read the keys: %v", tests.Failed, testID, err)
+	}
+	a, err := auth.New("54bb2165-71e1-41a6-af3e-7da4a0e1e2c1", ks)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create an authenticator: %v", tests.Failed, testID, err)
+	}
+	publicKeyPEM, err := a.PublicKeyPEM()
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to encode the public key: %v", tests.Failed, testID, err)
+	}
+
+	schema, err := schema.New(gql, schema.Config{
+		Authorization: schema.Authorization{
+			Header:    gqlConfig.AuthHeaderName,
+			PublicKey: publicKeyPEM,
+		},
+	})
 	if err != nil {
 		t.Fatalf("\t%s\tTest %d:\tShould be able to prepare the schema: %v", tests.Failed, testID, err)
 	}
@@ -0,0 +1,218 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Dgraph is a store that keeps the records in the database, so retries are
+// recognized by every instance of the service.
+type Dgraph struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+}
+
+// NewDgraph constructs a store that keeps the records in the database.
+func NewDgraph(log *zap.SugaredLogger, gql *graphql.GraphQL) *Dgraph {
+	return &Dgraph{
+		log: log,
+		gql: gql,
+	}
+}
+
+// Reserve implements the Store interface. The key is unique in the
+// database, so only one of the requests reserving it at once adds it.
+func (s *Dgraph) Reserve(ctx context.Context, rec Record, now time.Time) (Record, bool, error) {
+	existing, ok, err := s.query(ctx, rec.Key)
+	if err != nil {
+		return Record{}, false, err
+	}
+	if ok {
+		if !existing.Expired(now) {
+			return existing, false, nil
+		}
+		if err := s.releaseExpired(ctx, rec.Key, now); err != nil {
+			return Record{}, false, err
+		}
+	}
+
+	mutation := `
+	mutation addIdempotencyRecord($input: [AddIdempotencyRecordInput!]!) {
+		addIdempotencyRecord(input: $input) {
+			numUids
+		}
+	}`
+
+	input, err := toInput(rec)
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "idempotency.Reserve", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil, graphql.WithVariable("input", []interface{}{input})); err != nil {
+
+		// Another request reserved the key since it was looked up.
+		if existing, ok, qerr := s.query(ctx, rec.Key); qerr == nil && ok {
+			return existing, false, nil
+		}
+		return Record{}, false, errors.Wrap(err, "failed to reserve idempotency key")
+	}
+
+	return rec, true, nil
+}
+
+// Complete implements the Store interface.
+func (s *Dgraph) Complete(ctx context.Context, rec Record) error {
+	mutation := `
+	mutation updateIdempotencyRecord($key: String!, $set: IdempotencyRecordPatch!) {
+		updateIdempotencyRecord(input: { filter: { key: { eq: $key } }, set: $set }) {
+			numUids
+		}
+	}`
+
+	set, err := toInput(rec)
+	if err != nil {
+		return err
+	}
+	delete(set, "key")
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "idempotency.Complete", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil, graphql.WithVariable("key", rec.Key), graphql.WithVariable("set", set)); err != nil {
+		return errors.Wrap(err, "failed to complete idempotency record")
+	}
+
+	return nil
+}
+
+// Release implements the Store interface.
+func (s *Dgraph) Release(ctx context.Context, key string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteIdempotencyRecord(filter: { key: { eq: %q } }) {
+			msg
+		}
+	}`, key)
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "idempotency.Release", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to release idempotency key")
+	}
+
+	return nil
+}
+
+// releaseExpired deletes the record of the key only if it expired. Requests
+// that found the same expired record can't delete the one another of them
+// reserved since.
+func (s *Dgraph) releaseExpired(ctx context.Context, key string, now time.Time) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteIdempotencyRecord(filter: { key: { eq: %q }, expires: { le: %q } }) {
+			msg
+		}
+	}`, key, now.UTC().Format(time.RFC3339Nano))
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "idempotency.releaseExpired", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to release expired idempotency key")
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// record is how a Record is kept in the database, which has no type for
+// headers or bytes.
+type record struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	Header      string    `json:"header"`
+	Body        []byte    `json:"body"`
+	Expires     time.Time `json:"expires"`
+}
+
+func (s *Dgraph) query(ctx context.Context, key string) (Record, bool, error) {
+	query := fmt.Sprintf(`
+query {
+	getIdempotencyRecord(key: %q) {
+		key
+		fingerprint
+		status
+		header
+		body
+		expires
+	}
+}`, key)
+
+	s.log.Debug("%s: %s: %s", web.GetTraceID(ctx), "idempotency.query", data.Log(query))
+
+	var result struct {
+		GetIdempotencyRecord *record `json:"getIdempotencyRecord"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Record{}, false, errors.Wrap(err, "query failed")
+	}
+
+	r := result.GetIdempotencyRecord
+	if r == nil {
+		return Record{}, false, nil
+	}
+
+	rec := Record{
+		Key:         r.Key,
+		Fingerprint: r.Fingerprint,
+		Status:      r.Status,
+		Body:        r.Body,
+		Expires:     r.Expires,
+	}
+	if r.Header != "" {
+		if err := json.Unmarshal([]byte(r.Header), &rec.Header); err != nil {
+			return Record{}, false, errors.Wrap(err, "unmarshal header")
+		}
+	}
+
+	return rec, true, nil
+}
+
+// toInput returns the fields of the record as the database takes them.
+func toInput(rec Record) (map[string]interface{}, error) {
+	header := rec.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal header")
+	}
+
+	// encoding/json sends the body as base64, which is how it's kept.
+	body, err := json.Marshal(rec.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal body")
+	}
+
+	input := map[string]interface{}{
+		"key":         rec.Key,
+		"fingerprint": rec.Fingerprint,
+		"status":      rec.Status,
+		"header":      string(h),
+		"body":        json.RawMessage(body),
+		"expires":     rec.Expires.UTC().Format(time.RFC3339Nano),
+	}
+	return input, nil
+}
@@ -0,0 +1,152 @@
+// Package idempotency provides support for keeping the responses to requests
+// with an Idempotency-Key, so retries of the request get the same response
+// instead of repeating what the request did.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Set of error variables for idempotency operations.
+var (
+	ErrInvalidKey = errors.New("idempotency key must be at most 255 characters")
+	ErrMismatch   = errors.New("idempotency key was used with another request")
+	ErrInProgress = errors.New("request with the idempotency key is still in progress")
+)
+
+// MaxKeyLength is the length of the longest key a client can send.
+const MaxKeyLength = 255
+
+// Record represents a request with an Idempotency-Key and, once it
+// completed, its response.
+type Record struct {
+	Key         string      `json:"key"`
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// Done reports whether the request completed and its response is kept.
+func (r Record) Done() bool {
+	return r.Status != 0
+}
+
+// Expired reports whether the record is no longer kept at the specified
+// time.
+func (r Record) Expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+// Key returns the key of the record of a request. The key the client sent
+// only identifies requests of the same owner to the same route.
+func Key(owner string, method string, path string, key string) string {
+	sum := sha256.Sum256([]byte(owner + "|" + method + " " + path + "|" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Fingerprint returns what identifies the body of a request, so a key used
+// again with another body can be told apart from a retry.
+func Fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// credentials are the fields of responses that are never kept, since a
+// record outlives the response and its store isn't meant for secrets.
+var credentials = map[string]bool{
+	"password":               true,
+	"password_hash":          true,
+	"current_password":       true,
+	"hash":                   true,
+	"secret":                 true,
+	"pending_secret":         true,
+	"recovery_codes":         true,
+	"pending_recovery_codes": true,
+	"token":                  true,
+}
+
+// Redact returns the body of a response without the credential fields, at
+// any depth, and reports whether it can be kept. Bodies without credentials
+// are returned as they are. Only JSON bodies can be looked into, so other
+// bodies that aren't empty are never kept.
+func Redact(body []byte, contentType string) ([]byte, bool) {
+	if len(body) == 0 {
+		return body, true
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !(mt == "application/json" || strings.HasSuffix(mt, "+json")) {
+		return nil, false
+	}
+
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, false
+	}
+
+	if !redact(v) {
+		return body, true
+	}
+
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	return redacted, true
+}
+
+// redact removes the credential fields from the decoded JSON value and
+// reports whether it removed any.
+func redact(v interface{}) bool {
+	var removed bool
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if credentials[k] {
+				delete(v, k)
+				removed = true
+				continue
+			}
+			if redact(field) {
+				removed = true
+			}
+		}
+	case []interface{}:
+		for _, field := range v {
+			if redact(field) {
+				removed = true
+			}
+		}
+	}
+	return removed
+}
+
+// Store keeps the records until they expire.
+type Store interface {
+
+	// Reserve stores the record of a request that started, unless the key
+	// has a record that hasn't expired, which is returned instead. It
+	// reports whether the record was stored.
+	Reserve(ctx context.Context, rec Record, now time.Time) (Record, bool, error)
+
+	// Complete stores the response of the request of the record.
+	Complete(ctx context.Context, rec Record) error
+
+	// Release removes the record, so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
@@ -0,0 +1,48 @@
+package idempotency_test
+
+import (
+	"testing"
+
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestRedact(t *testing.T) {
+	tt := []struct {
+		name        string
+		body        string
+		contentType string
+		exp         string
+		kept        bool
+	}{
+		{"no credentials", `{"id":"1", "name":"Jill"}`, "application/json", `{"id":"1", "name":"Jill"}`, true},
+		{"password hash", `{"id":"1","password_hash":"$2a$10$x"}`, "application/json; charset=utf-8", `{"id":"1"}`, true},
+		{"nested secret", `{"items":[{"id":"1","secret":"s"}],"total":1}`, "application/json", `{"items":[{"id":"1"}],"total":1}`, true},
+		{"large number", `{"id":12345678901234567890,"token":"t"}`, "application/json", `{"id":12345678901234567890}`, true},
+		{"json suffix", `{"type":"FeatureCollection","hash":"h"}`, "application/geo+json", `{"type":"FeatureCollection"}`, true},
+		{"empty body", ``, "", ``, true},
+		{"msgpack", "\x81\xa2id\xa11", "application/msgpack", ``, false},
+		{"invalid json", `{"id":`, "application/json", ``, false},
+	}
+
+	t.Log("Given the need to never keep credentials of responses.")
+	{
+		for testID, tst := range tt {
+			t.Logf("\tTest %d:\tWhen redacting a body with %s.", testID, tst.name)
+			{
+				got, kept := idempotency.Redact([]byte(tst.body), tst.contentType)
+				if kept != tst.kept {
+					t.Fatalf("\t%s\tTest %d:\tShould keep only bodies it can look into: %v", tests.Failed, testID, kept)
+				}
+				t.Logf("\t%s\tTest %d:\tShould keep only bodies it can look into.", tests.Success, testID)
+
+				if kept && string(got) != tst.exp {
+					t.Logf("\t\tTest %d:\tgot: %s", testID, got)
+					t.Logf("\t\tTest %d:\texp: %s", testID, tst.exp)
+					t.Fatalf("\t%s\tTest %d:\tShould remove the credential fields.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould remove the credential fields.", tests.Success, testID)
+			}
+		}
+	}
+}
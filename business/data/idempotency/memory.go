@@ -0,0 +1,72 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often expired records are dropped.
+const sweepInterval = time.Minute
+
+// Memory is a store that keeps the records in the memory of the instance.
+// Retries reaching another instance aren't recognized.
+type Memory struct {
+	mu        sync.Mutex
+	records   map[string]Record
+	lastSweep time.Time
+}
+
+// NewMemory constructs a store that keeps the records in memory.
+func NewMemory() *Memory {
+	return &Memory{
+		records: make(map[string]Record),
+	}
+}
+
+// Reserve implements the Store interface.
+func (m *Memory) Reserve(ctx context.Context, rec Record, now time.Time) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(now)
+
+	if existing, ok := m.records[rec.Key]; ok && !existing.Expired(now) {
+		return existing, false, nil
+	}
+
+	m.records[rec.Key] = rec
+	return rec, true, nil
+}
+
+// Complete implements the Store interface.
+func (m *Memory) Complete(ctx context.Context, rec Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[rec.Key] = rec
+	return nil
+}
+
+// Release implements the Store interface.
+func (m *Memory) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+// sweep drops the records that expired.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, rec := range m.records {
+		if rec.Expired(now) {
+			delete(m.records, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package idempotency_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	rec := idempotency.Record{
+		Key:         idempotency.Key("user:1", http.MethodPost, "/v1/users", "abc"),
+		Fingerprint: idempotency.Fingerprint([]byte(`{"name":"Jill"}`)),
+		Expires:     start.Add(time.Hour),
+	}
+
+	t.Log("Given the need to keep the responses to requests with a key in memory.")
+	{
+		m := idempotency.NewMemory()
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen the key is used for the first time.", testID)
+		{
+			got, reserved, err := m.Reserve(ctx, rec, start)
+			if err != nil || !reserved {
+				t.Fatalf("\t%s\tTest %d:\tShould reserve the key: %v", tests.Failed, testID, err)
+			}
+			if got.Done() {
+				t.Fatalf("\t%s\tTest %d:\tShould not be done before it completed.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reserve the key.", tests.Success, testID)
+
+			existing, reserved, err := m.Reserve(ctx, rec, start.Add(time.Minute))
+			if err != nil || reserved {
+				t.Fatalf("\t%s\tTest %d:\tShould not reserve the key twice: %v", tests.Failed, testID, err)
+			}
+			if existing.Fingerprint != rec.Fingerprint || existing.Done() {
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, existing)
+				t.Fatalf("\t%s\tTest %d:\tShould return the request in progress.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould return the request in progress.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the request completed.", testID)
+		{
+			done := rec
+			done.Status, done.Body = http.StatusCreated, []byte(`{"id":"1"}`)
+			if err := m.Complete(ctx, done); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the response: %v", tests.Failed, testID, err)
+			}
+
+			existing, reserved, err := m.Reserve(ctx, rec, start.Add(time.Minute))
+			if err != nil || reserved {
+				t.Fatalf("\t%s\tTest %d:\tShould not reserve a completed key: %v", tests.Failed, testID, err)
+			}
+			if !existing.Done() || existing.Status != http.StatusCreated || string(existing.Body) != `{"id":"1"}` {
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, existing)
+				t.Fatalf("\t%s\tTest %d:\tShould return the kept response.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould return the kept response.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the record expired.", testID)
+		{
+			if _, reserved, err := m.Reserve(ctx, rec, rec.Expires); err != nil || !reserved {
+				t.Fatalf("\t%s\tTest %d:\tShould reserve the key again once the record expired: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reserve the key again once the record expired.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the key is released.", testID)
+		{
+			if err := m.Release(ctx, rec.Key); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould release the key: %v", tests.Failed, testID, err)
+			}
+
+			if _, reserved, err := m.Reserve(ctx, rec, start.Add(time.Minute)); err != nil || !reserved {
+				t.Fatalf("\t%s\tTest %d:\tShould reserve the key again: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reserve the key again.", tests.Success, testID)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package lockout provides support for tracking failed credential checks
+// and locking out accounts and clients that keep failing them.
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Set of error variables for lockout operations.
+var (
+	ErrLocked     = errors.New("too many failed attempts, try again later")
+	ErrContention = errors.New("failure could not be recorded, too many at once")
+)
+
+// AccountKey returns the key used to track failures for an account.
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+// IPKey returns the key used to track failures for a client address.
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Store manages the set of APIs for lockout access.
+type Store struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+	cfg Config
+}
+
+// NewStore constructs a lockout store for api access.
+func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL, cfg Config) Store {
+	return Store{
+		log: log,
+		gql: gql,
+		cfg: cfg,
+	}
+}
+
+// Check returns ErrLocked if either the account or the client address is
+// locked out at the specified time. The time the longest lock expires is
+// returned so callers can tell the client when to try again.
+func (s Store) Check(ctx context.Context, traceID string, now time.Time, email string, ip string) (time.Time, error) {
+	var until time.Time
+	for _, key := range []string{AccountKey(email), IPKey(ip)} {
+		lck, err := s.QueryByKey(ctx, traceID, key)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "checking key[%s]", key)
+		}
+
+		if lck.Locked(now) && lck.LockedUntil.After(until) {
+			until = lck.LockedUntil
+		}
+	}
+
+	if !until.IsZero() {
+		return until, ErrLocked
+	}
+
+	return time.Time{}, nil
+}
+
+// Fail records a failed credential check against both the account and the
+// client address. The resulting lockout state for each key is returned.
+func (s Store) Fail(ctx context.Context, traceID string, now time.Time, email string, ip string) ([]Lockout, error) {
+	keys := []struct {
+		key    string
+		policy Policy
+	}{
+		{AccountKey(email), s.cfg.Account},
+		{IPKey(ip), s.cfg.IP},
+	}
+
+	lcks := make([]Lockout, 0, len(keys))
+	for _, k := range keys {
+		lck, err := s.fail(ctx, traceID, now, k.key, k.policy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recording failure key[%s]", k.key)
+		}
+		lcks = append(lcks, lck)
+	}
+
+	return lcks, nil
+}
+
+// Succeed clears the failures of both the account and the client address
+// once a login completed.
+func (s Store) Succeed(ctx context.Context, traceID string, email string, ip string) error {
+	for _, key := range []string{AccountKey(email), IPKey(ip)} {
+		if err := s.Reset(ctx, traceID, key); err != nil {
+			return errors.Wrapf(err, "resetting key[%s]", key)
+		}
+	}
+
+	return nil
+}
+
+// Reset clears any failures and lockout recorded for the specified key.
+func (s Store) Reset(ctx context.Context, traceID string, key string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteLockout(filter: { key: { eq: %q } }) {
+			msg
+		}
+	}`, key)
+
+	s.log.Debug("%s: %s: %s", traceID, "lockout.Reset", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to reset lockout")
+	}
+
+	return nil
+}
+
+// QueryByKey returns the lockout state for the specified key. A key that has
+// never failed is returned as a zero Lockout with the key set.
+func (s Store) QueryByKey(ctx context.Context, traceID string, key string) (Lockout, error) {
+	query := fmt.Sprintf(`
+query {
+	queryLockout(filter: { key: { eq: %q } }) {
+		id
+		key
+		failures
+		last_failure
+		locked_until
+	}
+}`, key)
+
+	s.log.Debug("%s: %s: %s", traceID, "lockout.QueryByKey", data.Log(query))
+
+	var result struct {
+		QueryLockout []Lockout `json:"queryLockout"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Lockout{}, errors.Wrap(err, "query failed")
+	}
+
+	if len(result.QueryLockout) != 1 {
+		return Lockout{Key: key}, nil
+	}
+
+	return result.QueryLockout[0], nil
+}
+
+// =============================================================================
+
+// maxAttempts is how often recording a failure is tried when other failures
+// of the key are recorded at the same time.
+const maxAttempts = 5
+
+// fail records a failure of the key. The count is only written when nobody
+// else changed it since it was read, so failures made at once are all
+// counted.
+func (s Store) fail(ctx context.Context, traceID string, now time.Time, key string, policy Policy) (Lockout, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		lck, err := s.QueryByKey(ctx, traceID, key)
+		if err != nil {
+			return Lockout{}, err
+		}
+
+		next := policy.Fail(lck, now)
+
+		var swapped bool
+		if lck.ID == "" {
+			next, swapped, err = s.add(ctx, traceID, next)
+		} else {
+			swapped, err = s.update(ctx, traceID, lck.Failures, next)
+		}
+		if err != nil {
+			return Lockout{}, err
+		}
+		if !swapped {
+			continue
+		}
+
+		if next.Locked(now) {
+
+			// Lockouts are security relevant, so they are always logged.
+			s.log.Infow("AUDIT", "traceid", traceID, "event", "lockout", "key", key, "failures", next.Failures, "until", next.LockedUntil)
+		}
+
+		return next, nil
+	}
+
+	return Lockout{}, ErrContention
+}
+
+// add stores the first failure of the key. It reports false when another
+// failure of the key was stored first.
+func (s Store) add(ctx context.Context, traceID string, lck Lockout) (Lockout, bool, error) {
+	var result addResult
+	mutation := fmt.Sprintf(`
+	mutation {
+		resp: addLockout(input: [{
+			key: %q
+			failures: %d
+			last_failure: %q
+			locked_until: %q
+		}])
+		%s
+	}`, lck.Key, lck.Failures, lck.LastFailure.UTC().Format(time.RFC3339), lck.LockedUntil.UTC().Format(time.RFC3339), result.document())
+
+	s.log.Debug("%s: %s: %s", traceID, "lockout.add", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+
+		// The key is unique, so the add fails when it was stored since it
+		// was looked up.
+		if existing, qerr := s.QueryByKey(ctx, traceID, lck.Key); qerr == nil && existing.ID != "" {
+			return Lockout{}, false, nil
+		}
+		return Lockout{}, false, errors.Wrap(err, "failed to add lockout")
+	}
+
+	if len(result.Resp.Lockout) != 1 {
+		return Lockout{}, false, errors.New("lockout id not returned")
+	}
+
+	lck.ID = result.Resp.Lockout[0].ID
+	return lck, true, nil
+}
+
+// update stores the next state of the key, as long as the key still has the
+// number of failures it was read with. It reports false when it doesn't.
+func (s Store) update(ctx context.Context, traceID string, failures int, lck Lockout) (bool, error) {
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateLockout(input: {
+			filter: { key: { eq: %q }, failures: { eq: %d } }
+			set: {
+				failures: %d
+				last_failure: %q
+				locked_until: %q
+			}
+		}) {
+			numUids
+		}
+	}`, lck.Key, failures, lck.Failures, lck.LastFailure.UTC().Format(time.RFC3339), lck.LockedUntil.UTC().Format(time.RFC3339))
+
+	s.log.Debug("%s: %s: %s", traceID, "lockout.update", data.Log(mutation))
+
+	var result struct {
+		UpdateLockout struct {
+			NumUids int `json:"numUids"`
+		} `json:"updateLockout"`
+	}
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return false, errors.Wrap(err, "failed to update lockout")
+	}
+
+	return result.UpdateLockout.NumUids == 1, nil
+}
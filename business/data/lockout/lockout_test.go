@@ -0,0 +1,100 @@
+package lockout_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/lockout"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := lockout.Policy{
+		Threshold: 3,
+		BaseDelay: time.Minute,
+		MaxDelay:  4 * time.Minute,
+		Window:    15 * time.Minute,
+	}
+
+	// Failures a second apart, with the lock they leave the key in.
+	tt := []struct {
+		failures int
+		lock     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 4 * time.Minute},
+	}
+
+	t.Log("Given the need to lock out keys that keep failing.")
+	{
+		start := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+		lck := lockout.Lockout{Key: lockout.AccountKey("Admin@Example.com")}
+
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen handling failure %d.", testID, test.failures)
+			{
+				now := start.Add(time.Duration(testID) * time.Second)
+				lck = policy.Fail(lck, now)
+
+				if lck.Failures != test.failures {
+					t.Logf("\t\tTest %d:\texp: %v", testID, test.failures)
+					t.Logf("\t\tTest %d:\tgot: %v", testID, lck.Failures)
+					t.Fatalf("\t%s\tTest %d:\tShould count the failure.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould count the failure.", tests.Success, testID)
+
+				if test.lock == 0 {
+					if lck.Locked(now) {
+						t.Fatalf("\t%s\tTest %d:\tShould not lock the key below the threshold.", tests.Failed, testID)
+					}
+					t.Logf("\t%s\tTest %d:\tShould not lock the key below the threshold.", tests.Success, testID)
+					continue
+				}
+
+				if got := lck.LockedUntil.Sub(now); got != test.lock {
+					t.Logf("\t\tTest %d:\texp: %v", testID, test.lock)
+					t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+					t.Fatalf("\t%s\tTest %d:\tShould lock the key for the doubled delay up to the maximum.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould lock the key for the doubled delay up to the maximum.", tests.Success, testID)
+
+				if !lck.Locked(now) || lck.Locked(lck.LockedUntil) {
+					t.Fatalf("\t%s\tTest %d:\tShould be locked until the lock expires.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be locked until the lock expires.", tests.Success, testID)
+			}
+		}
+
+		testID := len(tt)
+		t.Logf("\tTest %d:\tWhen failing again after the window.", testID)
+		{
+			now := lck.LastFailure.Add(policy.Window + time.Second)
+			lck = policy.Fail(lck, now)
+
+			if lck.Failures != 1 || lck.Locked(now) {
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, lck)
+				t.Fatalf("\t%s\tTest %d:\tShould start counting again.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould start counting again.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the policy has no threshold.", testID)
+		{
+			var lck lockout.Lockout
+			for i := 0; i < 10; i++ {
+				lck = lockout.Policy{}.Fail(lck, start)
+			}
+
+			if lck.Failures != 10 || lck.Locked(start) {
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, lck)
+				t.Fatalf("\t%s\tTest %d:\tShould count failures without locking the key.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould count failures without locking the key.", tests.Success, testID)
+		}
+	}
+}
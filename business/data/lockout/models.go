@@ -0,0 +1,90 @@
+package lockout
+
+import "time"
+
+// Lockout represents the failed login state tracked for a single key. A key
+// identifies either an account or the address of a client.
+type Lockout struct {
+	ID          string    `json:"id,omitempty"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked reports whether the key is locked out at the specified time.
+func (l Lockout) Locked(now time.Time) bool {
+	return now.Before(l.LockedUntil)
+}
+
+// Policy defines how failed attempts for a kind of key turn into lockouts.
+type Policy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+// Config contains the policies applied to accounts and client addresses.
+type Config struct {
+	Account Policy
+	IP      Policy
+}
+
+// Fail returns the state of the key after another failure at the specified
+// time. Failures spread out further than the window start counting again.
+func (p Policy) Fail(lck Lockout, now time.Time) Lockout {
+	if p.Window > 0 && now.Sub(lck.LastFailure) > p.Window {
+		lck.Failures = 0
+	}
+
+	lck.Failures++
+	lck.LastFailure = now
+
+	if delay := p.lockFor(lck.Failures); delay > 0 {
+		lck.LockedUntil = now.Add(delay)
+	}
+
+	return lck
+}
+
+// =============================================================================
+
+// lockFor returns how long a key is locked after the specified number of
+// consecutive failures. Every failure past the threshold doubles the delay
+// until the maximum is reached.
+func (p Policy) lockFor(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.Threshold; i < failures; i++ {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+type addResult struct {
+	Resp struct {
+		Lockout []struct {
+			ID string `json:"id"`
+		} `json:"lockout"`
+	} `json:"resp"`
+}
+
+func (addResult) document() string {
+	return `{
+		lockout {
+			id
+		}
+	}`
+}
@@ -0,0 +1,340 @@
+// Package mfa provides support for managing the second authentication
+// factor of users in the database.
+package mfa
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/sys/totp"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Set of error variables for MFA operations.
+var (
+	ErrNotFound     = errors.New("mfa not enrolled")
+	ErrNotEnabled   = errors.New("mfa not enabled")
+	ErrInvalidCode  = errors.New("invalid code")
+	ErrCodeRequired = errors.New("code of the enabled factor is required to replace it")
+)
+
+// recoveryCodes is the number of recovery codes handed out at enrollment.
+const recoveryCodes = 10
+
+// Store manages the set of APIs for mfa access.
+type Store struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+}
+
+// NewStore constructs a mfa store for api access.
+func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
+	return Store{
+		log: log,
+		gql: gql,
+	}
+}
+
+// Enroll generates a new secret and set of recovery codes for the user. The
+// factor is not enabled until a code from the new secret is confirmed. A
+// user with an enabled factor must provide a code of it to enroll another,
+// and keeps it until the new one is confirmed. Any enrollment that wasn't
+// confirmed is replaced. It reports whether the code was a recovery code, so
+// its use can be audited.
+func (s Store) Enroll(ctx context.Context, traceID string, userID string, issuer string, account string, code string, now time.Time) (Enrollment, bool, error) {
+	fct, err := s.QueryByUser(ctx, traceID, userID)
+	if err != nil && errors.Cause(err) != ErrNotFound {
+		return Enrollment{}, false, err
+	}
+
+	var recovery bool
+	if fct.Enabled {
+		if code == "" {
+			return Enrollment{}, false, ErrCodeRequired
+		}
+		if recovery, err = s.Verify(ctx, traceID, userID, code, now); err != nil {
+			return Enrollment{}, false, err
+		}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, recovery, errors.Wrap(err, "generating secret")
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return Enrollment{}, recovery, errors.Wrap(err, "generating recovery codes")
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return Enrollment{}, recovery, errors.Wrap(err, "generating recovery code hash")
+		}
+		hashes[i] = string(hash)
+	}
+
+	enr := Enrollment{
+		Secret:        secret,
+		URI:           totp.URI(issuer, account, secret),
+		RecoveryCodes: codes,
+	}
+
+	// The enabled factor keeps protecting the user while the new one waits
+	// to be confirmed.
+	if fct.Enabled {
+		patch := fmt.Sprintf("set: { pending_secret: %q, pending_recovery_codes: [%s] }", secret, list(hashes))
+		if len(fct.PendingRecoveryCodes) > 0 {
+			patch += fmt.Sprintf(" remove: { pending_recovery_codes: [%s] }", list(fct.PendingRecoveryCodes))
+		}
+		if err := s.update(ctx, traceID, userID, patch); err != nil {
+			return Enrollment{}, recovery, err
+		}
+		return enr, recovery, nil
+	}
+
+	if err := s.delete(ctx, traceID, userID); err != nil {
+		return Enrollment{}, recovery, err
+	}
+
+	fct = Factor{
+		User:          userID,
+		Secret:        secret,
+		RecoveryCodes: hashes,
+	}
+	if _, err := s.add(ctx, traceID, fct); err != nil {
+		return Enrollment{}, recovery, err
+	}
+
+	return enr, recovery, nil
+}
+
+// Confirm enables the factor for the user once they prove their
+// authenticator produces valid codes. A factor waiting to replace the
+// enabled one takes its place.
+func (s Store) Confirm(ctx context.Context, traceID string, userID string, code string, now time.Time) error {
+	fct, err := s.QueryByUser(ctx, traceID, userID)
+	if err != nil {
+		return err
+	}
+
+	if fct.PendingSecret != "" {
+		step, ok := totp.Validate(fct.PendingSecret, code, now, 1)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		patch := fmt.Sprintf(`set: { secret: %q, recovery_codes: [%s], enabled: true, last_step: %d }
+			remove: { recovery_codes: [%s], pending_secret: %q, pending_recovery_codes: [%s] }`,
+			fct.PendingSecret, list(fct.PendingRecoveryCodes), step,
+			list(fct.RecoveryCodes), fct.PendingSecret, list(fct.PendingRecoveryCodes))
+
+		return s.update(ctx, traceID, userID, patch)
+	}
+
+	step, ok := totp.Validate(fct.Secret, code, now, 1)
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	return s.update(ctx, traceID, userID, fmt.Sprintf("set: { enabled: true, last_step: %d }", step))
+}
+
+// Verify checks the code against the enabled factor of the user. The code is
+// either a one-time password or one of the recovery codes, which is consumed
+// on use. One-time passwords can't be replayed. It reports whether the code
+// was a recovery code, so its use can be audited.
+func (s Store) Verify(ctx context.Context, traceID string, userID string, code string, now time.Time) (bool, error) {
+	fct, err := s.QueryByUser(ctx, traceID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !fct.Enabled {
+		return false, ErrNotEnabled
+	}
+
+	// One-time passwords are only digits, so anything else can only be a
+	// recovery code. The code is only accepted if nobody used one since the
+	// factor was read, so the same code sent twice at once passes only once.
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(fct.Secret, code, now, 1)
+		if !ok || step <= fct.LastStep {
+			return false, ErrInvalidCode
+		}
+		return false, s.consume(ctx, traceID, userID, fmt.Sprintf("last_step: { eq: %d }", fct.LastStep), fmt.Sprintf("set: { last_step: %d }", step))
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, hash := range fct.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			if err := s.consume(ctx, traceID, userID, fmt.Sprintf("recovery_codes: { eq: %q }", hash), fmt.Sprintf("remove: { recovery_codes: [%q] }", hash)); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+
+	return false, ErrInvalidCode
+}
+
+// Enabled reports whether the user has confirmed a second factor.
+func (s Store) Enabled(ctx context.Context, traceID string, userID string) (bool, error) {
+	fct, err := s.QueryByUser(ctx, traceID, userID)
+	if err != nil {
+		if errors.Cause(err) == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return fct.Enabled, nil
+}
+
+// QueryByUser returns the factor enrolled for the specified user.
+func (s Store) QueryByUser(ctx context.Context, traceID string, userID string) (Factor, error) {
+	query := fmt.Sprintf(`
+query {
+	queryFactor(filter: { user: { eq: %q } }) {
+		id
+		user
+		secret
+		enabled
+		recovery_codes
+		last_step
+		pending_secret
+		pending_recovery_codes
+	}
+}`, userID)
+
+	s.log.Debug("%s: %s: %s", traceID, "mfa.QueryByUser", data.Log(query))
+
+	var result struct {
+		QueryFactor []Factor `json:"queryFactor"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Factor{}, errors.Wrap(err, "query failed")
+	}
+
+	if len(result.QueryFactor) != 1 {
+		return Factor{}, ErrNotFound
+	}
+
+	return result.QueryFactor[0], nil
+}
+
+// =============================================================================
+
+func (s Store) add(ctx context.Context, traceID string, fct Factor) (Factor, error) {
+	var result addResult
+	mutation := fmt.Sprintf(`
+	mutation {
+		resp: addFactor(input: [{
+			user: %q
+			secret: %q
+			enabled: %t
+			recovery_codes: [%s]
+			last_step: %d
+		}])
+		%s
+	}`, fct.User, fct.Secret, fct.Enabled, list(fct.RecoveryCodes), fct.LastStep, result.document())
+
+	s.log.Debug("%s: %s: %s", traceID, "mfa.add", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return Factor{}, errors.Wrap(err, "failed to add factor")
+	}
+
+	if len(result.Resp.Factor) != 1 {
+		return Factor{}, errors.New("factor id not returned")
+	}
+
+	fct.ID = result.Resp.Factor[0].ID
+	return fct, nil
+}
+
+func (s Store) update(ctx context.Context, traceID string, userID string, patch string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateFactor(input: {
+			filter: { user: { eq: %q } }
+			%s
+		}) {
+			numUids
+		}
+	}`, userID, patch)
+
+	s.log.Debug("%s: %s: %s", traceID, "mfa.update", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to update factor")
+	}
+
+	return nil
+}
+
+// consume applies the patch to the factor of the user only if it still
+// matches the condition. A factor that no longer does had the code used in
+// the meantime, so the code is refused as a replay.
+func (s Store) consume(ctx context.Context, traceID string, userID string, cond string, patch string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateFactor(input: {
+			filter: { user: { eq: %q }, %s }
+			%s
+		}) {
+			numUids
+		}
+	}`, userID, cond, patch)
+
+	s.log.Debug("%s: %s: %s", traceID, "mfa.consume", data.Log(mutation))
+
+	var result struct {
+		UpdateFactor struct {
+			NumUids int `json:"numUids"`
+		} `json:"updateFactor"`
+	}
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return errors.Wrap(err, "failed to update factor")
+	}
+
+	if result.UpdateFactor.NumUids == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+func (s Store) delete(ctx context.Context, traceID string, userID string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteFactor(filter: { user: { eq: %q } }) {
+			msg
+		}
+	}`, userID)
+
+	s.log.Debug("%s: %s: %s", traceID, "mfa.delete", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to delete factor")
+	}
+
+	return nil
+}
+
+// list returns the values as the elements of a list in a mutation.
+func list(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted, ", ")
+}
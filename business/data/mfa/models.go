@@ -0,0 +1,53 @@
+package mfa
+
+// Factor represents the second factor enrolled for a user. Recovery codes
+// are only ever stored as hashes. The pending secret and recovery codes are
+// those of a factor enrolled to replace the enabled one, until it is
+// confirmed.
+type Factor struct {
+	ID                   string   `json:"id,omitempty"`
+	User                 string   `json:"user"`
+	Secret               string   `json:"secret"`
+	Enabled              bool     `json:"enabled"`
+	RecoveryCodes        []string `json:"recovery_codes"`
+	LastStep             int64    `json:"last_step"`
+	PendingSecret        string   `json:"pending_secret,omitempty"`
+	PendingRecoveryCodes []string `json:"pending_recovery_codes,omitempty"`
+}
+
+// Enrollment is what the user needs to set up their authenticator. It is
+// only available at the time of enrollment.
+type Enrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// NewEnrollment contains what a user provides to enroll a second factor.
+// Users with an enabled factor provide a code of it to replace it.
+type NewEnrollment struct {
+	Code string `json:"code"`
+}
+
+// Code contains a one-time password or a recovery code provided by a user.
+type Code struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// =============================================================================
+
+type addResult struct {
+	Resp struct {
+		Factor []struct {
+			ID string `json:"id"`
+		} `json:"factor"`
+	} `json:"resp"`
+}
+
+func (addResult) document() string {
+	return `{
+		factor {
+			id
+		}
+	}`
+}
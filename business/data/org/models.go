@@ -0,0 +1,66 @@
+package org
+
+import "time"
+
+// Organization represents a club or team whose members share data that is
+// isolated from every other organization.
+type Organization struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// NewOrganization contains information needed to create a new Organization.
+type NewOrganization struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// Membership represents a user belonging to an organization. The role
+// applies only within the organization.
+type Membership struct {
+	ID   string `json:"id"`
+	Key  string `json:"key"`
+	Org  string `json:"org"`
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+// NewMembership contains information needed to add a user to an organization.
+type NewMembership struct {
+	User string `json:"user" validate:"required"`
+	Role string `json:"role" validate:"required,oneof=ADMIN USER"`
+}
+
+// =============================================================================
+
+type addOrganizationResult struct {
+	Resp struct {
+		Organization []struct {
+			ID string `json:"id"`
+		} `json:"organization"`
+	} `json:"resp"`
+}
+
+func (addOrganizationResult) document() string {
+	return `{
+		organization {
+			id
+		}
+	}`
+}
+
+type addMembershipResult struct {
+	Resp struct {
+		Membership []struct {
+			ID string `json:"id"`
+		} `json:"membership"`
+	} `json:"resp"`
+}
+
+func (addMembershipResult) document() string {
+	return `{
+		membership {
+			id
+		}
+	}`
+}
@@ -0,0 +1,234 @@
+// Package org provides support for managing organizations and the users
+// that are members of them.
+package org
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Set of error variables for CRUD operations.
+var (
+	ErrNotFound  = errors.New("organization not found")
+	ErrNotMember = errors.New("user is not a member of the organization")
+)
+
+// Store manages the set of APIs for organization access.
+type Store struct {
+	log *zap.SugaredLogger
+	gql *graphql.GraphQL
+}
+
+// NewStore constructs an organization store for api access.
+func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
+	return Store{
+		log: log,
+		gql: gql,
+	}
+}
+
+// Add creates a new organization with the specified user as its first admin.
+func (s Store) Add(ctx context.Context, traceID string, userID string, no NewOrganization, now time.Time) (Organization, error) {
+	if err := validate.Check(no); err != nil {
+		return Organization{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	o := Organization{
+		Name:        no.Name,
+		DateCreated: now,
+	}
+
+	var result addOrganizationResult
+	mutation := fmt.Sprintf(`
+	mutation {
+		resp: addOrganization(input: [{
+			name: %q
+			date_created: %q
+		}])
+		%s
+	}`, o.Name, o.DateCreated.UTC().Format(time.RFC3339), result.document())
+
+	s.log.Debug("%s: %s: %s", traceID, "org.Add", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return Organization{}, errors.Wrap(err, "failed to add organization")
+	}
+
+	if len(result.Resp.Organization) != 1 {
+		return Organization{}, errors.New("organization id not returned")
+	}
+	o.ID = result.Resp.Organization[0].ID
+
+	nm := NewMembership{
+		User: userID,
+		Role: "ADMIN",
+	}
+	if _, err := s.AddMember(ctx, traceID, o.ID, nm); err != nil {
+		return Organization{}, err
+	}
+
+	return o, nil
+}
+
+// QueryByID returns the specified organization.
+func (s Store) QueryByID(ctx context.Context, traceID string, orgID string) (Organization, error) {
+	query := fmt.Sprintf(`
+query {
+	getOrganization(id: %q) {
+		id
+		name
+		date_created
+	}
+}`, orgID)
+
+	s.log.Debug("%s: %s: %s", traceID, "org.QueryByID", data.Log(query))
+
+	var result struct {
+		GetOrganization Organization `json:"getOrganization"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Organization{}, errors.Wrap(err, "query failed")
+	}
+
+	if result.GetOrganization.ID == "" {
+		return Organization{}, ErrNotFound
+	}
+
+	return result.GetOrganization, nil
+}
+
+// AddMember adds the user to the organization with the role, or changes the
+// role of an existing member.
+func (s Store) AddMember(ctx context.Context, traceID string, orgID string, nm NewMembership) (Membership, error) {
+	if err := validate.Check(nm); err != nil {
+		return Membership{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	m := Membership{
+		Key:  memberKey(orgID, nm.User),
+		Org:  orgID,
+		User: nm.User,
+		Role: nm.Role,
+	}
+
+	var result addMembershipResult
+	mutation := fmt.Sprintf(`
+	mutation {
+		resp: addMembership(input: [{
+			key: %q
+			org: %q
+			user: %q
+			role: %s
+		}], upsert: true)
+		%s
+	}`, m.Key, m.Org, m.User, m.Role, result.document())
+
+	s.log.Debug("%s: %s: %s", traceID, "org.AddMember", data.Log(mutation))
+
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return Membership{}, errors.Wrap(err, "failed to add membership")
+	}
+
+	if len(result.Resp.Membership) != 1 {
+		return Membership{}, errors.New("membership id not returned")
+	}
+
+	m.ID = result.Resp.Membership[0].ID
+	return m, nil
+}
+
+// RemoveMember removes the user from the organization.
+func (s Store) RemoveMember(ctx context.Context, traceID string, orgID string, userID string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteMembership(filter: { key: { eq: %q } }) {
+			numUids
+		}
+	}`, memberKey(orgID, userID))
+
+	s.log.Debug("%s: %s: %s", traceID, "org.RemoveMember", data.Log(mutation))
+
+	var result struct {
+		DeleteMembership struct {
+			NumUids int `json:"numUids"`
+		} `json:"deleteMembership"`
+	}
+	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+		return errors.Wrap(err, "failed to remove membership")
+	}
+
+	if result.DeleteMembership.NumUids == 0 {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+// QueryMembership returns the membership of the user in the organization.
+func (s Store) QueryMembership(ctx context.Context, traceID string, orgID string, userID string) (Membership, error) {
+	query := fmt.Sprintf(`
+query {
+	queryMembership(filter: { key: { eq: %q } }) {
+		id
+		key
+		org
+		user
+		role
+	}
+}`, memberKey(orgID, userID))
+
+	s.log.Debug("%s: %s: %s", traceID, "org.QueryMembership", data.Log(query))
+
+	var result struct {
+		QueryMembership []Membership `json:"queryMembership"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return Membership{}, errors.Wrap(err, "query failed")
+	}
+
+	if len(result.QueryMembership) != 1 {
+		return Membership{}, ErrNotMember
+	}
+
+	return result.QueryMembership[0], nil
+}
+
+// QueryMembers returns the memberships of the organization.
+func (s Store) QueryMembers(ctx context.Context, traceID string, orgID string) ([]Membership, error) {
+	query := fmt.Sprintf(`
+query {
+	queryMembership(filter: { org: { eq: %q } }) {
+		id
+		key
+		org
+		user
+		role
+	}
+}`, orgID)
+
+	s.log.Debug("%s: %s: %s", traceID, "org.QueryMembers", data.Log(query))
+
+	var result struct {
+		QueryMembership []Membership `json:"queryMembership"`
+	}
+	if err := s.gql.Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryMembership, nil
+}
+
+// =============================================================================
+
+// memberKey identifies the membership of a user in an organization so a
+// user can only be a member once.
+func memberKey(orgID string, userID string) string {
+	return orgID + "|" + userID
+}
@@ -0,0 +1,30 @@
+package schema
+
+import (
+	"context"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/pkg/errors"
+)
+
+// backfillVersions gives the users and actions from before versions were
+// recorded their first version.
+func backfillVersions(ctx context.Context, gql *graphql.GraphQL) error {
+	for _, typ := range []string{"User", "Action"} {
+		mutation := `
+	mutation {
+		update` + typ + `(input: {
+			filter: { not: { has: version } }
+			set: { version: 1 }
+		}) {
+			numUids
+		}
+	}`
+
+		if err := gql.Execute(ctx, mutation, nil); err != nil {
+			return errors.Wrapf(err, "versioning %s", typ)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package schema
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/graphql"
+	"github.com/pkg/errors"
+)
+
+// files holds every version of the schema. Versions are named NNN_name and
+// are applied in order. A version is never changed once it is released, a
+// new version is added instead.
+//
+//go:embed versions/*.graphql
+var files embed.FS
+
+// marker is the type holding the version of the schema applied to the
+// database. It is part of every version so the version can be recorded.
+const marker = `
+type SchemaVersion {
+  id: ID!
+  key: String! @id
+  version: Int!
+  name: String!
+  applied: DateTime!
+}
+`
+
+// markerKey identifies the single SchemaVersion value.
+const markerKey = "schema"
+
+// Backfill updates existing data after the schema of its version is applied.
+// It must be safe to run more than once.
+type Backfill func(ctx context.Context, gql *graphql.GraphQL) error
+
+// backfills holds the backfill of every version that needs one, by number.
+var backfills = map[int]Backfill{
+	10: backfillVersions,
+}
+
+// Version represents a version of the schema.
+type Version struct {
+	Number int
+	Name   string
+	source string
+}
+
+// document returns the document applied to the database for the version.
+func (v Version) document(auth string) string {
+	return v.source + marker + auth
+}
+
+// versions holds the versions of the schema in order.
+var versions = load()
+
+// Status describes the schema in the database compared to the compiled one.
+type Status struct {
+	Applied int       `json:"applied"`
+	Latest  int       `json:"latest"`
+	Pending []Version `json:"pending"`
+	Drift   bool      `json:"drift"`
+}
+
+// Status returns the version of the schema in the database and the versions
+// that still have to be applied. Databases created before versions were
+// recorded have their version detected from the schema itself.
+func (s *Schema) Status(ctx context.Context) (Status, error) {
+	schema, err := s.retrieve(ctx)
+	if err != nil {
+		return Status{}, errors.Wrap(err, "can't read schema, db not ready")
+	}
+
+	st := Status{
+		Latest: versions[len(versions)-1].Number,
+	}
+
+	if err := s.validate(ctx, schema); err == ErrNoSchemaExists {
+		st.Pending = versions
+		return st, nil
+	}
+
+	st.Applied, err = s.applied(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+
+	if st.Applied == 0 {
+		st.Applied = s.detect(schema)
+	}
+
+	for _, v := range versions {
+		if v.Number > st.Applied {
+			st.Pending = append(st.Pending, v)
+		}
+	}
+
+	// The schema drifted when it isn't what the applied version defines.
+	st.Drift = true
+	for _, v := range versions {
+		if v.Number == st.Applied && same(v.document(s.auth), schema) {
+			st.Drift = false
+		}
+	}
+
+	return st, nil
+}
+
+// Migrate applies the pending versions in order, running the backfill of
+// each version after its schema is applied. A schema that drifted from the
+// applied version is replaced by the latest version.
+func (s *Schema) Migrate(ctx context.Context, now time.Time) ([]Version, error) {
+	st, err := s.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := st.Pending
+	if len(pending) == 0 && st.Drift {
+		pending = versions[len(versions)-1:]
+	}
+
+	for _, v := range pending {
+		if err := s.update(ctx, v.document(s.auth)); err != nil {
+			return nil, errors.Wrapf(err, "applying version %d", v.Number)
+		}
+
+		if backfill, ok := backfills[v.Number]; ok {
+			if err := backfill(ctx, s.graphql); err != nil {
+				return nil, errors.Wrapf(err, "backfilling version %d", v.Number)
+			}
+		}
+
+		if err := s.mark(ctx, v, now); err != nil {
+			return nil, errors.Wrapf(err, "recording version %d", v.Number)
+		}
+	}
+
+	return pending, nil
+}
+
+// Diff returns the line differences between the schema in the database and
+// the compiled one. Lines only in the database start with - and lines only
+// in the compiled schema start with +.
+func (s *Schema) Diff(ctx context.Context) (string, error) {
+	schema, err := s.retrieve(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "can't read schema, db not ready")
+	}
+
+	var result struct {
+		GetGQLSchema *struct {
+			Schema string `json:"schema"`
+		} `json:"getGQLSchema"`
+	}
+	if err := json.Unmarshal([]byte(schema), &result); err != nil {
+		return "", errors.Wrap(err, "unmarshal schema")
+	}
+
+	var live string
+	if result.GetGQLSchema != nil {
+		live = result.GetGQLSchema.Schema
+	}
+
+	return diff(lines(live), lines(s.document)), nil
+}
+
+// =============================================================================
+
+// load reads the versions of the schema from the embedded files.
+func load() []Version {
+	entries, err := files.ReadDir("versions")
+	if err != nil {
+		panic(err)
+	}
+
+	var vs []Version
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".graphql")
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("schema version %q must be named NNN_name", entry.Name()))
+		}
+
+		number, err := strconv.Atoi(parts[0])
+		if err != nil {
+			panic(fmt.Sprintf("schema version %q must start with a number", entry.Name()))
+		}
+
+		source, err := files.ReadFile(path.Join("versions", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		vs = append(vs, Version{
+			Number: number,
+			Name:   parts[1],
+			source: string(source),
+		})
+	}
+
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Number < vs[j].Number })
+
+	return vs
+}
+
+// applied returns the version recorded in the database, zero when none is.
+func (s *Schema) applied(ctx context.Context) (int, error) {
+	query := fmt.Sprintf(`
+query {
+	getSchemaVersion(key: %q) {
+		version
+	}
+}`, markerKey)
+
+	var result struct {
+		GetSchemaVersion *struct {
+			Version int `json:"version"`
+		} `json:"getSchemaVersion"`
+	}
+	if err := s.graphql.Execute(ctx, query, &result); err != nil {
+
+		// Schemas from before versions were recorded don't have the type.
+		if strings.Contains(err.Error(), "getSchemaVersion") {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "query schema version")
+	}
+
+	if result.GetSchemaVersion == nil {
+		return 0, nil
+	}
+
+	return result.GetSchemaVersion.Version, nil
+}
+
+// detect finds the version of a schema applied before versions were
+// recorded. Zero is returned when it matches no version.
+func (s *Schema) detect(schema string) int {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if same(v.source, schema) || same(v.source+s.auth, schema) {
+			return v.Number
+		}
+	}
+	return 0
+}
+
+// mark records the version as applied to the database. The database can
+// take a moment to serve a new schema, so this is retried until the context
+// is done.
+func (s *Schema) mark(ctx context.Context, v Version, now time.Time) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		addSchemaVersion(input: [{
+			key: %q
+			version: %d
+			name: %q
+			applied: %q
+		}], upsert: true) {
+			numUids
+		}
+	}`, markerKey, v.Number, v.Name, now.UTC().Format(time.RFC3339))
+
+	for {
+		err := s.graphql.Execute(ctx, mutation, nil)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return errors.Wrap(err, "add schema version")
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// lines splits the document into lines without surrounding blank lines.
+func lines(document string) []string {
+	document = strings.TrimSpace(document)
+	if document == "" {
+		return nil
+	}
+	return strings.Split(document, "\n")
+}
+
+// diff returns the lines of a and b marked by where they are found, based on
+// the longest common subsequence of lines.
+func diff(a []string, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+
+	return sb.String()
+}
@@ -3,8 +3,8 @@ package schema
 
 import (
 	"context"
-	_ "embed" // Embed all documents
 	"encoding/json"
+	"fmt"
 	"regexp"
 	"strings"
 	"time"
@@ -13,30 +13,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-// document represents the schema for the project.
-var document = `
-enum Role {
-	ADMIN
-	USER
-}
-
-type User {
-  id: ID!
-  email: String! @search(by: [hash]) @id
-  name: String!
-  role: Role!
-  password_hash: String!
-}
-
-type Action {
-  id: ID!
-  name: String! @search(by: [hash]) @id
-  lat: Float!
-  lng: Float!
-  user: String! @search(by: [hash]) @id
-}
-`
-
 // Schema error variables.
 var (
 	ErrNoSchemaExists = errors.New("no schema exitst")
@@ -49,47 +25,71 @@ type CustomFunctions struct {
 	UploadFeedURL string
 }
 
+// Authorization is the information the database needs to verify the tokens
+// it authorizes requests with.
+type Authorization struct {
+	Header    string
+	PublicKey string
+}
+
 // Config contains information required for the schema document.
 type Config struct {
 	CustomFunctions
+	Authorization
 }
 
 // Schema provides support for schema operations against the database
 type Schema struct {
 	graphql  *graphql.GraphQL
+	auth     string
 	document string
 }
 
 // New constructs a Schema value for use to manage the schema.
-func New(graphql *graphql.GraphQL) (*Schema, error) {
+func New(graphql *graphql.GraphQL, cfg Config) (*Schema, error) {
+	if cfg.Header == "" || cfg.PublicKey == "" {
+		return nil, errors.New("authorization header and public key are required")
+	}
+
+	auth, err := authorization(cfg.Authorization)
+	if err != nil {
+		return nil, err
+	}
 
 	schema := Schema{
 		graphql:  graphql,
-		document: document,
+		auth:     auth,
+		document: versions[len(versions)-1].document(auth),
 	}
 
 	return &schema, nil
 }
 
-// Create is used to create the schema in the database.
+// Create is used to create the schema in the database. The latest version
+// of the schema replaces whatever is there and is recorded as applied.
 func (s *Schema) Create(ctx context.Context) error {
-	query := `mutation updateGQLSchema($schema: String!) {
-		updateGQLSchema(input: {
-			set: { schema: $schema }
-		}) {
-			gqlSchema {
-				schema
-			}
-		}
-	}`
-	err := s.graphql.ExecuteOnEndpoint(ctx, "admin", query, nil, graphql.WithVariable("schema", s.document))
-	if err != nil {
+	if err := s.update(ctx, s.document); err != nil {
+		return errors.Wrap(err, "create schema")
+	}
+
+	if err := s.mark(ctx, versions[len(versions)-1], time.Now()); err != nil {
 		return errors.Wrap(err, "create schema")
 	}
 
 	return nil
 }
 
+// Check compares the schema in the database with the compiled one. It
+// returns ErrNoSchemaExists or ErrInvalidSchema when they differ.
+func (s *Schema) Check(ctx context.Context) error {
+	schema, err := s.retrieve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "can't validate schema, db not ready")
+	}
+
+	return s.validate(ctx, schema)
+}
+
 // DropData perform an alter operatation against the configured server
 // to remove all the data and schema.
 func (s *Schema) DropData(ctx context.Context) error {
@@ -123,6 +123,29 @@ func (s *Schema) DropAll(ctx context.Context) error {
 
 // =============================================================================
 
+// authorization generates the line that configures how the database verifies
+// tokens. The claims are read from the Auth namespace of the token.
+func authorization(auth Authorization) (string, error) {
+	cfg := struct {
+		VerificationKey string
+		Header          string
+		Namespace       string
+		Algo            string
+	}{
+		VerificationKey: auth.PublicKey,
+		Header:          auth.Header,
+		Namespace:       "Auth",
+		Algo:            "RS256",
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal authorization")
+	}
+
+	return fmt.Sprintf("\n# Dgraph.Authorization %s\n", data), nil
+}
+
 // retrieve queries the database for the schema and handles situations
 // when the database is not ready for schema operations.
 func (s *Schema) retrieve(ctx context.Context) (string, error) {
@@ -148,6 +171,20 @@ func (s *Schema) retrieve(ctx context.Context) (string, error) {
 	}
 }
 
+// update replaces the schema in the database with the document.
+func (s *Schema) update(ctx context.Context, document string) error {
+	query := `mutation updateGQLSchema($schema: String!) {
+		updateGQLSchema(input: {
+			set: { schema: $schema }
+		}) {
+			gqlSchema {
+				schema
+			}
+		}
+	}`
+	return s.graphql.ExecuteOnEndpoint(ctx, "admin", query, nil, graphql.WithVariable("schema", document))
+}
+
 func (s *Schema) query(ctx context.Context) (string, error) {
 	query := `query { getGQLSchema { schema }}`
 	result := make(map[string]interface{})
@@ -172,20 +209,29 @@ func (s *Schema) validate(ctx context.Context, schema string) error {
 		return ErrInvalidSchema
 	}
 
-	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-	if err != nil {
-		return errors.Wrap(err, "regex compile")
+	if !same(s.document, schema) {
+		return ErrInvalidSchema
 	}
 
-	exp := strings.ReplaceAll(s.document, "\\n", "")
-	exp = reg.ReplaceAllString(exp, "")
-	schema = strings.ReplaceAll(schema[27:], "\\n", "")
-	schema = strings.ReplaceAll(schema, "\\t", "")
-	schema = reg.ReplaceAllString(schema, "")
+	return nil
+}
 
-	if exp != schema {
-		return ErrInvalidSchema
+// nonAlphaNum matches everything that is ignored when comparing schemas, so
+// formatting and escaping differences don't count as changes.
+var nonAlphaNum = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+// same reports whether the document matches the schema as retrieved from
+// the database.
+func same(document string, schema string) bool {
+	if len(schema) < 27 {
+		return false
 	}
 
-	return nil
+	exp := strings.ReplaceAll(document, "\\n", "")
+	exp = nonAlphaNum.ReplaceAllString(exp, "")
+	schema = strings.ReplaceAll(schema[27:], "\\n", "")
+	schema = strings.ReplaceAll(schema, "\\t", "")
+	schema = nonAlphaNum.ReplaceAllString(schema, "")
+
+	return exp == schema
 }
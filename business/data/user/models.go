@@ -1,21 +1,41 @@
 package user
 
+import "time"
+
 // User represents someone with access to the system.
+//
+// Version counts the changes of the user, so a change can be made to the
+// version the caller read only.
 type User struct {
-	ID           string `json:"id"`
-	Name         string `json:"name"`
-	Email        string `json:"email"`
-	Role         string `json:"role"`
-	PasswordHash string `json:"password_hash"`
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Email        string     `json:"email"`
+	Role         string     `json:"role"`
+	PasswordHash string     `json:"password_hash"`
+	ExternalID   string     `json:"external_id,omitempty"`
+	Version      int        `json:"version"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
 }
 
 // NewUser contains information needed to create a new User.
 type NewUser struct {
 	Name            string `json:"name" validate:"required"`
 	Email           string `json:"email" validate:"required"`
-	Role            string `json:"role" validate:"required"`
+	Role            string `json:"role" validate:"required,oneof=ADMIN USER"`
 	Password        string `json:"password" validate:"required"`
-	PasswordConfirm string `json:"password_confirm" validate:"required"`
+	PasswordConfirm string `json:"password_confirm" validate:"required,eqfield=Password"`
+}
+
+// UpdateUser contains the fields of a user that can be changed. Fields left
+// out keep their value. Users changing their own email or password confirm
+// it with their current password.
+type UpdateUser struct {
+	Name            *string `json:"name" validate:"omitempty,min=1"`
+	Email           *string `json:"email" validate:"omitempty,email"`
+	Role            *string `json:"role" validate:"omitempty,oneof=ADMIN USER"`
+	Password        *string `json:"password" validate:"omitempty,min=1"`
+	PasswordConfirm *string `json:"password_confirm" validate:"omitempty,eqfield=Password"`
+	CurrentPassword *string `json:"current_password"`
 }
 
 // =============================================================================
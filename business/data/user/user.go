@@ -4,9 +4,16 @@ package user
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/ardanlabs/graphql"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/data/cache"
+	"github.com/jnkroeker/makulu/business/data/org"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/validate"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
@@ -14,15 +21,35 @@ import (
 
 // Set of error variables for CRUD operations.
 var (
-	ErrNotExists = errors.New("user does not exist")
-	ErrExists    = errors.New("user exists")
-	ErrNotFound  = errors.New("user not found")
+	ErrNotExists             = errors.New("user does not exist")
+	ErrExists                = errors.New("user exists")
+	ErrNotFound              = errors.New("user not found")
+	ErrAuthenticationFailure = errors.New("authentication failed")
+	ErrNotAllowed            = errors.New("callers limited to an organization can't change the email or password of other users")
+	ErrRoleNotAllowed        = errors.New("callers limited to an organization can't set roles of users, roles in the organization are set by the membership")
 )
 
+// dummyHash is compared against the password of logins for users that don't
+// exist, so they take as long as the logins of users that do.
+var dummyHash = struct {
+	once sync.Once
+	hash []byte
+}{}
+
+// compareDummy spends the time a password check takes.
+func compareDummy(password string) {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(password))
+}
+
 // Store manages the set of APIs for user access.
 type Store struct {
-	log *zap.SugaredLogger
-	gql *graphql.GraphQL
+	log     *zap.SugaredLogger
+	gql     *graphql.GraphQL
+	service *graphql.GraphQL
+	cache   cache.Cache
 }
 
 // NewStore constructs a user store for api access.
@@ -33,11 +60,49 @@ func NewStore(log *zap.SugaredLogger, gql *graphql.GraphQL) Store {
 	}
 }
 
+// WithCache returns a copy of the store that reads users by id through the
+// cache. Users changed through the store are removed from the cache.
+func (s Store) WithCache(c cache.Cache) Store {
+	s.cache = c
+	return s
+}
+
+// WithService returns a copy of the store that reaches the database as the
+// service for callers limited to an organization. The database doesn't know
+// which users are members, so the store checks that itself and the rules of
+// the database can't limit these callers.
+func (s Store) WithService(gql *graphql.GraphQL) Store {
+	s.service = gql
+	return s
+}
+
+// client returns the client the requests of the caller in the context are
+// made with.
+func (s Store) client(ctx context.Context) *graphql.GraphQL {
+	if tenant, _ := auth.GetTenant(ctx); tenant != "" && s.service != nil {
+		return s.service
+	}
+	return s.gql
+}
+
 // Add adds a new user to the database. If the user already exists
 // this function will fail but the found user is returned. If the user is
-// being added, the user with the id from the database is returned.
+// being added, the user with the id from the database is returned. Users
+// added by a caller limited to an organization become members of it, and
+// can only have the USER role outside of it.
 func (s Store) Add(ctx context.Context, traceID string, nu NewUser) (User, error) {
-	if usr, err := s.QueryByEmail(ctx, traceID, nu.Email); err == nil {
+	if err := validate.Check(nu); err != nil {
+		return User{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	// A user without a tenant in their token can act on every organization,
+	// so only callers that can too hand out roles beyond USER.
+	tenant, _ := auth.GetTenant(ctx)
+	if tenant != "" && nu.Role != auth.RoleUser {
+		return User{}, ErrRoleNotAllowed
+	}
+
+	if usr, err := s.queryByEmail(ctx, traceID, nu.Email); err == nil {
 		return usr, ErrExists
 	}
 
@@ -53,11 +118,385 @@ func (s Store) Add(ctx context.Context, traceID string, nu NewUser) (User, error
 		PasswordHash: string(hash),
 	}
 
-	return s.add(ctx, traceID, usr)
+	usr, err = s.add(ctx, traceID, usr)
+	if err != nil {
+		return User{}, err
+	}
+
+	if tenant != "" {
+		nm := org.NewMembership{
+			User: usr.ID,
+			Role: auth.RoleUser,
+		}
+		if _, err := org.NewStore(s.log, s.client(ctx)).AddMember(ctx, traceID, tenant, nm); err != nil {
+			return User{}, errors.Wrap(err, "adding membership")
+		}
+	}
+
+	return usr, nil
+}
+
+// Update changes the user if it still has the version the caller read.
+// ErrConflict of package data is returned when it changed since, and
+// ErrExists when the email belongs to another user.
+func (s Store) Update(ctx context.Context, traceID string, userID string, version int, uu UpdateUser, now time.Time) (User, error) {
+	if err := validate.Check(uu); err != nil {
+		return User{}, fmt.Errorf("validating data: %w", err)
+	}
+
+	// The role and credentials count in every organization, so callers
+	// limited to one can't change the role and only change their own
+	// credentials.
+	if tenant, _ := auth.GetTenant(ctx); tenant != "" {
+		if uu.Role != nil {
+			return User{}, ErrRoleNotAllowed
+		}
+		if uu.Email != nil || uu.Password != nil {
+			claims, err := auth.GetClaims(ctx)
+			if err != nil || claims.Subject != userID {
+				return User{}, ErrNotAllowed
+			}
+		}
+	}
+
+	usr, err := s.queryForChange(ctx, traceID, userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Checked by the mutation as well, in case it changes in between.
+	if usr.Version != version {
+		return User{}, data.ErrConflict
+	}
+
+	// A stolen token mustn't be enough to take the account over, so users
+	// prove who they are before changing what they log in with.
+	if claims, err := auth.GetClaims(ctx); err == nil && claims.Subject == userID && (uu.Email != nil || uu.Password != nil) {
+		if uu.CurrentPassword == nil || bcrypt.CompareHashAndPassword([]byte(usr.PasswordHash), []byte(*uu.CurrentPassword)) != nil {
+			return User{}, ErrAuthenticationFailure
+		}
+	}
+
+	if uu.Name != nil {
+		usr.Name = *uu.Name
+	}
+	if uu.Email != nil && *uu.Email != usr.Email {
+		if _, err := s.queryByEmail(ctx, traceID, *uu.Email); err == nil {
+			return User{}, ErrExists
+		}
+		usr.Email = *uu.Email
+	}
+	if uu.Role != nil {
+		usr.Role = *uu.Role
+	}
+	if uu.Password != nil {
+		hash, err := bcrypt.GenerateFromPassword([]byte(*uu.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, errors.Wrap(err, "generating password hash")
+		}
+		usr.PasswordHash = string(hash)
+	}
+	usr.Version = version + 1
+	usr.UpdatedAt = &now
+
+	var result struct {
+		UpdateUser struct {
+			NumUids int `json:"numUids"`
+		} `json:"updateUser"`
+	}
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateUser(input: {
+			filter: { id: [%q], %s }
+			set: {
+				name: %q
+				email: %q
+				role: %s
+				password_hash: %q
+				version: %d
+				updated_at: %q
+			}
+		}) {
+			numUids
+		}
+	}`, userID, data.VersionFilter(version), usr.Name, usr.Email, usr.Role, usr.PasswordHash, usr.Version, now.UTC().Format(time.RFC3339Nano))
+
+	s.log.Debug("%s: %s: %s", traceID, "user.Update", data.Log(mutation))
+
+	if err := s.client(ctx).Execute(ctx, mutation, &result); err != nil {
+		return User{}, errors.Wrap(err, "failed to update user")
+	}
+
+	if err := cache.Delete(ctx, s.cache, cache.Key("user", userID)); err != nil {
+		return User{}, errors.Wrap(err, "removing cached user")
+	}
+
+	if result.UpdateUser.NumUids != 1 {
+		return User{}, data.ErrConflict
+	}
+
+	return usr, nil
+}
+
+// Delete removes the user if it still has the version the caller read.
+// ErrConflict of package data is returned when it changed since.
+func (s Store) Delete(ctx context.Context, traceID string, userID string, version int) error {
+	usr, err := s.queryForChange(ctx, traceID, userID)
+	if err != nil {
+		return err
+	}
+
+	// Checked by the mutation as well, in case it changes in between.
+	if usr.Version != version {
+		return data.ErrConflict
+	}
+
+	var result struct {
+		DeleteUser struct {
+			NumUids int `json:"numUids"`
+		} `json:"deleteUser"`
+	}
+	mutation := fmt.Sprintf(`
+	mutation {
+		deleteUser(filter: { id: [%q], %s }) {
+			numUids
+		}
+	}`, userID, data.VersionFilter(version))
+
+	s.log.Debug("%s: %s: %s", traceID, "user.Delete", data.Log(mutation))
+
+	if err := s.client(ctx).Execute(ctx, mutation, &result); err != nil {
+		return errors.Wrap(err, "failed to delete user")
+	}
+
+	if err := cache.Delete(ctx, s.cache, cache.Key("user", userID)); err != nil {
+		return errors.Wrap(err, "removing cached user")
+	}
+
+	if result.DeleteUser.NumUids != 1 {
+		return data.ErrConflict
+	}
+
+	return nil
 }
 
 // QueryByID returns the specified user from the database by the user id.
+// Password hashes are never cached, so users read from the cache have none.
 func (s Store) QueryByID(ctx context.Context, traceID string, userID string) (User, error) {
+	key := cache.Key("user", userID)
+
+	var usr User
+	ok, err := cache.Get(ctx, s.cache, key, &usr)
+	if err != nil {
+		s.log.Warnw("cache", "traceid", traceID, "key", key, "ERROR", err)
+	}
+
+	if !ok {
+		if usr, err = s.queryByID(ctx, traceID, userID); err != nil {
+			return User{}, err
+		}
+
+		cached := usr
+		cached.PasswordHash = ""
+		if err := cache.Set(ctx, s.cache, key, cached); err != nil {
+			s.log.Warnw("cache", "traceid", traceID, "key", key, "ERROR", err)
+		}
+	}
+
+	// Users found in the cache never went past the rules of the database,
+	// so the store applies them to every caller.
+	if err := s.checkCaller(ctx, traceID, usr.ID); err != nil {
+		return User{}, err
+	}
+
+	return usr, nil
+}
+
+// QueryByEmail returns the specified user from the database by email
+func (s Store) QueryByEmail(ctx context.Context, traceID string, email string) (User, error) {
+	usr, err := s.queryByEmail(ctx, traceID, email)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.checkTenant(ctx, traceID, usr.ID); err != nil {
+		return User{}, err
+	}
+
+	return usr, nil
+}
+
+// QueryByExternalID returns the user linked to an identity at an external
+// identity provider.
+func (s Store) QueryByExternalID(ctx context.Context, traceID string, externalID string) (User, error) {
+	query := fmt.Sprintf(`
+query {
+	queryUser(filter: { external_id: { eq: %q } }) {
+		id
+		name
+		email
+		role
+		password_hash
+		external_id
+		version
+		updated_at
+	}
+}`, externalID)
+
+	s.log.Debug("%s: %s: %s", traceID, "user.QueryByExternalID", data.Log(query))
+
+	var result struct {
+		QueryUser []User `json:"queryUser"`
+	}
+	if err := s.client(ctx).Execute(ctx, query, &result); err != nil {
+		return User{}, errors.Wrap(err, "query failed")
+	}
+
+	if len(result.QueryUser) != 1 {
+		return User{}, ErrNotFound
+	}
+
+	return result.QueryUser[0], nil
+}
+
+// Link records the identity at an external identity provider for the user
+// so future logins through that provider find the same user.
+func (s Store) Link(ctx context.Context, traceID string, userID string, externalID string) error {
+	mutation := fmt.Sprintf(`
+	mutation {
+		updateUser(input: {
+			filter: { id: [%q] }
+			set: { external_id: %q }
+		}) {
+			numUids
+		}
+	}`, userID, externalID)
+
+	s.log.Debug("%s: %s: %s", traceID, "user.Link", data.Log(mutation))
+
+	if err := s.client(ctx).Execute(ctx, mutation, nil); err != nil {
+		return errors.Wrap(err, "failed to link user")
+	}
+
+	if err := cache.Delete(ctx, s.cache, cache.Key("user", userID)); err != nil {
+		return errors.Wrap(err, "removing cached user")
+	}
+
+	return nil
+}
+
+// QueryAll returns a page of users ordered by email. It is meant for the
+// admin tooling and isn't limited to an organization.
+func (s Store) QueryAll(ctx context.Context, traceID string, offset int, limit int) ([]User, error) {
+	query := fmt.Sprintf(`
+query {
+	queryUser(order: { asc: email }, first: %d, offset: %d) {
+		id
+		name
+		email
+		role
+		password_hash
+		external_id
+		version
+		updated_at
+	}
+}`, limit, offset)
+
+	s.log.Debug("%s: %s: %s", traceID, "user.QueryAll", data.Log(query))
+
+	var result struct {
+		QueryUser []User `json:"queryUser"`
+	}
+	if err := s.client(ctx).Execute(ctx, query, &result); err != nil {
+		return nil, errors.Wrap(err, "query failed")
+	}
+
+	return result.QueryUser, nil
+}
+
+// Restore adds a user exactly as it was exported, keeping the password hash.
+// If a user with the email already exists it is returned with ErrExists.
+func (s Store) Restore(ctx context.Context, traceID string, usr User) (User, error) {
+	if existing, err := s.queryByEmail(ctx, traceID, usr.Email); err == nil {
+		return existing, ErrExists
+	}
+
+	nu, err := s.add(ctx, traceID, usr)
+	if err != nil {
+		return User{}, err
+	}
+
+	if usr.ExternalID != "" {
+		if err := s.Link(ctx, traceID, nu.ID, usr.ExternalID); err != nil {
+			return User{}, err
+		}
+	}
+
+	return nu, nil
+}
+
+// Authenticate finds a user by their email and verifies their password. On
+// success it returns a Claims value representing this user. The claims can be
+// used to generate a token for future authentication.
+func (s Store) Authenticate(ctx context.Context, traceID string, now time.Time, email, password string) (auth.Claims, error) {
+	usr, err := s.QueryByEmail(ctx, traceID, email)
+	if err != nil {
+		if errors.Cause(err) == ErrNotFound {
+
+			// The password is still checked, so how long the login takes
+			// doesn't tell which emails have an account.
+			compareDummy(password)
+			return auth.Claims{}, ErrAuthenticationFailure
+		}
+		return auth.Claims{}, errors.Wrap(err, "query user")
+	}
+
+	// Compare the provided password with the saved hash. Use the bcrypt
+	// comparison function so it is cryptographically secure.
+	if err := bcrypt.CompareHashAndPassword([]byte(usr.PasswordHash), []byte(password)); err != nil {
+		return auth.Claims{}, ErrAuthenticationFailure
+	}
+
+	// If we are this far the request is valid. Create some claims for the user
+	// and generate their token.
+	return NewClaims(usr, now, auth.AMRPassword), nil
+}
+
+// NewClaims constructs the claims for a token representing the user. The
+// methods used to authenticate the user are recorded in the claims.
+func NewClaims(usr User, now time.Time, amr ...string) auth.Claims {
+	return auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "service project",
+			Subject:   usr.ID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Roles: []string{usr.Role},
+		AMR:   amr,
+	}
+}
+
+// =============================================================================
+
+// queryForChange reads the user about to be changed from the database
+// rather than the cache, which may not have the latest version.
+func (s Store) queryForChange(ctx context.Context, traceID string, userID string) (User, error) {
+	usr, err := s.queryByID(ctx, traceID, userID)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.checkTenant(ctx, traceID, usr.ID); err != nil {
+		return User{}, err
+	}
+
+	return usr, nil
+}
+
+// queryByID reads the user from the database without checking the
+// organization of the caller.
+func (s Store) queryByID(ctx context.Context, traceID string, userID string) (User, error) {
 	query := fmt.Sprintf(`
 query {
 	getUser(id: %q) {
@@ -66,6 +505,9 @@ query {
 		email
 		role
 		password_hash
+		external_id
+		version
+		updated_at
 	}
 }`, userID)
 
@@ -76,7 +518,7 @@ query {
 	var result struct {
 		GetUser User `json:"getUser"`
 	}
-	if err := s.gql.Execute(ctx, query, &result); err != nil {
+	if err := s.client(ctx).Execute(ctx, query, &result); err != nil {
 		return User{}, errors.Wrap(err, "query failed")
 	}
 
@@ -87,8 +529,9 @@ query {
 	return result.GetUser, nil
 }
 
-// QueryByEmail returns the specified user from the database by email
-func (s Store) QueryByEmail(ctx context.Context, traceID string, email string) (User, error) {
+// queryByEmail finds the user by email no matter which organizations they
+// are a member of.
+func (s Store) queryByEmail(ctx context.Context, traceID string, email string) (User, error) {
 	query := fmt.Sprintf(`
 query {
 	queryUser(filter: { email: { eq: %q } }) {
@@ -96,7 +539,10 @@ query {
 		name
 		email
 		role
-		password_hash 
+		password_hash
+		external_id
+		version
+		updated_at
 	}
 }`, email)
 
@@ -106,7 +552,7 @@ query {
 	var result struct {
 		QueryUser []User `json:"queryUser"`
 	}
-	if err := s.gql.Execute(ctx, query, &result); err != nil {
+	if err := s.client(ctx).Execute(ctx, query, &result); err != nil {
 		return User{}, errors.Wrap(err, "query failed")
 	}
 
@@ -117,9 +563,50 @@ query {
 	return result.QueryUser[0], nil
 }
 
-// =============================================================================
+// checkCaller returns ErrNotFound when the caller in the context can't read
+// the user by the rules of the database: admins read everyone and users
+// only themselves, callers limited to an organization read its members.
+func (s Store) checkCaller(ctx context.Context, traceID string, userID string) error {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return nil
+	}
+
+	if claims.Tenant != "" {
+		return s.checkTenant(ctx, traceID, userID)
+	}
+
+	if !claims.Authorized(auth.RoleAdmin) && claims.Subject != userID {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// checkTenant returns ErrNotFound when the caller is limited to an
+// organization the user isn't a member of.
+func (s Store) checkTenant(ctx context.Context, traceID string, userID string) error {
+	tenant, _ := auth.GetTenant(ctx)
+	if tenant == "" {
+		return nil
+	}
+
+	if _, err := org.NewStore(s.log, s.client(ctx)).QueryMembership(ctx, traceID, tenant, userID); err != nil {
+		if errors.Cause(err) == org.ErrNotMember {
+			return ErrNotFound
+		}
+		return errors.Wrap(err, "query membership")
+	}
+
+	return nil
+}
 
 func (s Store) add(ctx context.Context, traceID string, usr User) (User, error) {
+	// Users start at the first version, restored ones keep theirs.
+	if usr.Version == 0 {
+		usr.Version = 1
+	}
+
 	var result addResult
 	mutation := fmt.Sprintf(`
 	mutation {
@@ -128,15 +615,16 @@ func (s Store) add(ctx context.Context, traceID string, usr User) (User, error)
 			email: %q 
 			role: %s 
 			password_hash: %q 
+			version: %d
 		}])
 		%s
-	}`, usr.Name, usr.Email, usr.Role, usr.PasswordHash, result.document())
+	}`, usr.Name, usr.Email, usr.Role, usr.PasswordHash, usr.Version, result.document())
 
 	s.log.Debug("%s: %s: %s", traceID, "user.Add", data.Log(mutation))
 
 	// marshal the result of the mutation executed against the database into the result
 
-	if err := s.gql.Execute(ctx, mutation, &result); err != nil {
+	if err := s.client(ctx).Execute(ctx, mutation, &result); err != nil {
 		return User{}, errors.Wrap(err, "failed to add user")
 	}
 
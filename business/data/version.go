@@ -0,0 +1,21 @@
+package data
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrConflict is returned when an entity changed since the caller read the
+// version it asked to change.
+var ErrConflict = errors.New("entity changed since it was read")
+
+// VersionFilter returns the part of a mutation filter that only matches an
+// entity that still has the version. Entities from before versions were
+// recorded have none, which is version zero.
+func VersionFilter(version int) string {
+	if version == 0 {
+		return "not: { has: version }"
+	}
+	return fmt.Sprintf("version: { eq: %d }", version)
+}
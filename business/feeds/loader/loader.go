@@ -33,7 +33,7 @@ type Filter struct {
 }
 
 // UpdateSchema creates/updates the schema for the database.
-func UpdateSchema(gqlConfig data.GraphQLConfig) error {
+func UpdateSchema(gqlConfig data.GraphQLConfig, schemaConfig schema.Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -44,7 +44,7 @@ func UpdateSchema(gqlConfig data.GraphQLConfig) error {
 
 	gql := data.NewGraphQL(gqlConfig)
 
-	schema, err := schema.New(gql)
+	schema, err := schema.New(gql, schemaConfig)
 	if err != nil {
 		return errors.Wrapf(err, "preparing schema")
 	}
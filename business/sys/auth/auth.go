@@ -2,17 +2,40 @@
 package auth
 
 import (
+	"context"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
 var (
 	ErrorForbidden = errors.New("attempted action is not allowed")
+	ErrMFARequired = errors.New("multi-factor authentication required")
 )
 
+// ChallengeAudience marks tokens that only prove the password step of a
+// login. They can't be used to access the API.
+const ChallengeAudience = "mfa-challenge"
+
+// DatabaseAudience marks tokens signed for the database on behalf of a
+// caller that didn't present a token of its own. They can't be used to
+// access the API.
+const DatabaseAudience = "database"
+
+// StateAudience marks tokens that carry state the service needs back from a
+// client later, like the secrets of a login at an identity provider. They
+// can't be used to access the API.
+const StateAudience = "state"
+
+// databaseTTL is how long a token signed for the database is valid.
+const databaseTTL = 5 * time.Minute
+
 // TODO: Swap out DIY in-memory keystore for Vault
 
 // KeyLookup declares a method set of behavior for looking up
@@ -25,6 +48,12 @@ type KeyLookup interface {
 	PublicKey(kid string) (*rsa.PublicKey, error)
 }
 
+// APIKeyLookup declares a method set of behavior for validating API keys
+// and returning the claims of the user that owns the key.
+type APIKeyLookup interface {
+	ClaimsForKey(ctx context.Context, traceID string, key string) (Claims, error)
+}
+
 // Auth is used to authenticate clients. It can generate a token for a
 // set of user claims and recreate the claims by parsing the token.
 //
@@ -36,6 +65,9 @@ type Auth struct {
 	method    jwt.SigningMethod
 	keyFunc   func(t *jwt.Token) (interface{}, error)
 	parser    jwt.Parser
+	mfaRoles  []string
+	apiKeys   APIKeyLookup
+	perms     Permissions
 }
 
 // New creates an Auth to support authentication/authorization.
@@ -85,14 +117,282 @@ func New(activeKID string, keyLookup KeyLookup) (*Auth, error) {
 		method:    method,
 		keyFunc:   keyFunc,
 		parser:    parser,
+		perms:     DefaultPermissions(),
 	}
 
 	return &a, nil
 
 }
 
+// RequireMFA sets the roles that can only be placed in a token when the
+// claims show a second factor was used. This must be called before the
+// Auth is used to handle requests.
+func (a *Auth) RequireMFA(roles ...string) {
+	a.mfaRoles = roles
+}
+
+// SetAPIKeyLookup sets the lookup used to validate API keys. Without a
+// lookup every API key is rejected. This must be called before the Auth is
+// used to handle requests.
+func (a *Auth) SetAPIKeyLookup(apiKeys APIKeyLookup) {
+	a.apiKeys = apiKeys
+}
+
+// SetPermissions replaces the mapping of roles to scopes. This must be
+// called before the Auth is used to handle requests.
+func (a *Auth) SetPermissions(perms Permissions) {
+	a.perms = perms
+}
+
 // GenerateToken generates a signed JWT token string representing the user Claims.
+// The token carries the scopes granted by the roles of the claims, limited
+// to the scopes already in the claims if there are any.
 func (a *Auth) GenerateToken(claims Claims) (string, error) {
+	if claims.Authorized(a.mfaRoles...) && !claims.HasAMR(AMROTP) {
+		return "", ErrMFARequired
+	}
+
+	claims.Scopes = a.perms.Limit(claims.Scopes, claims.Roles...)
+	if claims.Scopes == nil {
+		claims.Scopes = []string{}
+	}
+	claims.Database = newDatabaseClaims(claims)
+
+	return a.sign(claims)
+}
+
+// GenerateChallenge generates a short lived token for a subject that has
+// passed the first step of a login and still has to provide a second
+// factor. The token carries no roles, only the methods of the first step,
+// which is the password unless others are given.
+func (a *Auth) GenerateChallenge(subject string, now time.Time, amr ...string) (string, error) {
+	if len(amr) == 0 {
+		amr = []string{AMRPassword}
+	}
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "service project",
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{ChallengeAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		AMR: amr,
+	}
+
+	return a.sign(claims)
+}
+
+// ValidateChallenge recreates the Claims of a token generated by
+// GenerateChallenge.
+func (a *Auth) ValidateChallenge(tokenStr string) (Claims, error) {
+	claims, err := a.parse(tokenStr)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if !claims.VerifyAudience(ChallengeAudience, true) {
+		return Claims{}, errors.New("not a challenge token")
+	}
+
+	return claims, nil
+}
+
+// stateClaims are the claims of a token generated by GenerateState.
+type stateClaims struct {
+	jwt.RegisteredClaims
+	Values map[string]string `json:"values"`
+}
+
+// GenerateState generates a token holding the values until it expires, so a
+// client can keep state the service needs back later and any instance can
+// take it. The values are signed, not encrypted, so the client can read them.
+func (a *Auth) GenerateState(values map[string]string, now time.Time, expires time.Time) (string, error) {
+	claims := stateClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "service project",
+			Audience:  jwt.ClaimStrings{StateAudience},
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Values: values,
+	}
+
+	return a.sign(claims)
+}
+
+// ValidateState returns the values of a token generated by GenerateState.
+func (a *Auth) ValidateState(tokenStr string) (map[string]string, error) {
+	var claims stateClaims
+	token, err := a.parser.ParseWithClaims(tokenStr, &claims, a.keyFunc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token: %w", err)
+	}
+
+	switch {
+	case !token.Valid:
+		return nil, errors.New("invalid token")
+	case !claims.VerifyAudience(StateAudience, true):
+		return nil, errors.New("not a state token")
+	}
+
+	return claims.Values, nil
+}
+
+// ValidateToken recreates the Claims that were used to generate a token. It
+// verifies that the token was signed using our key.
+func (a *Auth) ValidateToken(tokenStr string) (Claims, error) {
+	claims, err := a.parse(tokenStr)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	switch {
+	case claims.VerifyAudience(ChallengeAudience, true):
+		return Claims{}, errors.New("challenge token can't be used for access")
+	case claims.VerifyAudience(DatabaseAudience, true):
+		return Claims{}, errors.New("database token can't be used for access")
+	case claims.VerifyAudience(StateAudience, true):
+		return Claims{}, errors.New("state token can't be used for access")
+	}
+
+	// Tokens generated before scopes existed get what their roles grant. A
+	// token with an empty list has no scopes.
+	if claims.Scopes == nil {
+		claims.Scopes = a.perms.Scopes(claims.Roles...)
+	}
+
+	return claims, nil
+}
+
+// ValidateAPIKey returns the Claims of the user that owns the API key. Keys
+// of users with a role that requires a second factor are refused.
+func (a *Auth) ValidateAPIKey(ctx context.Context, traceID string, key string) (Claims, error) {
+	if a.apiKeys == nil {
+		return Claims{}, errors.New("api keys are not supported")
+	}
+
+	claims, err := a.apiKeys.ClaimsForKey(ctx, traceID, key)
+	if err != nil {
+		return Claims{}, fmt.Errorf("validating api key: %w", err)
+	}
+
+	// A key is no second factor, so roles that need one can't use keys.
+	if claims.Authorized(a.mfaRoles...) {
+		return Claims{}, ErrMFARequired
+	}
+
+	// A key can never grant more than the roles of its owner.
+	claims.Scopes = a.perms.Limit(claims.Scopes, claims.Roles...)
+
+	return claims, nil
+}
+
+// DatabaseToken returns the token the database authorizes the caller in the
+// context with. The token the caller presented is forwarded when it carries
+// the database claims, otherwise a short lived one is signed from the claims.
+// The returned bool is false when the context holds no caller, in which case
+// the database is accessed as the service itself.
+func (a *Auth) DatabaseToken(ctx context.Context) (string, bool, error) {
+	claims, err := GetClaims(ctx)
+	if err != nil {
+		return "", false, nil
+	}
+
+	if tkn, ok := getToken(ctx); ok && claims.Database != nil {
+		return tkn, true, nil
+	}
+
+	now := time.Now()
+	claims.Audience = jwt.ClaimStrings{DatabaseAudience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(databaseTTL))
+	claims.Database = newDatabaseClaims(claims)
+
+	tkn, err := a.sign(claims)
+	if err != nil {
+		return "", false, err
+	}
+
+	return tkn, true, nil
+}
+
+// GenerateServiceToken generates a token the service accesses the database
+// with when it acts on its own behalf, like while logging a user in.
+func (a *Auth) GenerateServiceToken(subject string, now time.Time, ttl time.Duration) (string, error) {
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "service project",
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{DatabaseAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Database: &DatabaseClaims{
+			Role: RoleAdmin,
+			User: subject,
+		},
+	}
+
+	return a.sign(claims)
+}
+
+// ServiceTokens returns a function that hands out the token the service
+// accesses the database with. The tokens live as long as the ones signed
+// for callers and a new one is signed once half of that passed, so no token
+// of the service stays valid for long.
+func (a *Auth) ServiceTokens(subject string) func() (string, error) {
+	var mu sync.Mutex
+	var tkn string
+	var renew time.Time
+
+	f := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if tkn != "" && now.Before(renew) {
+			return tkn, nil
+		}
+
+		t, err := a.GenerateServiceToken(subject, now, databaseTTL)
+		if err != nil {
+			return "", err
+		}
+		tkn, renew = t, now.Add(databaseTTL/2)
+
+		return tkn, nil
+	}
+
+	return f
+}
+
+// PublicKeyPEM returns the PEM encoding of the public key tokens are
+// currently signed with, so others like the database can verify them.
+func (a *Auth) PublicKeyPEM() (string, error) {
+	publicKey, err := a.keyLookup.PublicKey(a.activeKID)
+	if err != nil {
+		return "", errors.New("kid lookup failed")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("marshaling public key: %w", err)
+	}
+
+	block := pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}
+
+	return string(pem.EncodeToMemory(&block)), nil
+}
+
+// =============================================================================
+
+// sign generates the signed token string for the claims using the active key.
+func (a *Auth) sign(claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(a.method, claims)
 	token.Header["kid"] = a.activeKID
 
@@ -109,9 +409,8 @@ func (a *Auth) GenerateToken(claims Claims) (string, error) {
 	return str, nil
 }
 
-// ValidateToken recreates the Claims that were used to generate a token. It
-// verifies that the token was signed using our key.
-func (a *Auth) ValidateToken(tokenStr string) (Claims, error) {
+// parse recreates the Claims from the token and verifies the signature.
+func (a *Auth) parse(tokenStr string) (Claims, error) {
 	var claims Claims
 	token, err := a.parser.ParseWithClaims(tokenStr, &claims, a.keyFunc)
 	if err != nil {
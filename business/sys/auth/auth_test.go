@@ -1,8 +1,10 @@
 package auth_test
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"testing"
 	"time"
 
@@ -83,3 +85,293 @@ func (ks *keyStore) PrivateKey(kid string) (*rsa.PrivateKey, error) {
 func (ks *keyStore) PublicKey(kid string) (*rsa.PublicKey, error) {
 	return &ks.pk.PublicKey, nil
 }
+
+// keyLookup accepts every api key as a key of the user with the claims.
+type keyLookup struct {
+	claims auth.Claims
+}
+
+func (kl keyLookup) ClaimsForKey(ctx context.Context, traceID string, key string) (auth.Claims, error) {
+	return kl.claims, nil
+}
+
+func TestMFAPolicy(t *testing.T) {
+	t.Log("Given the need to require a second factor for admins.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen the policy covers the admin role,", testID)
+		{
+			const keyID = "54bb2165-71e1-41a6-af3e-7da4a0e1e2c1"
+			privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a private key: %v", tests.Failed, testID, err)
+			}
+
+			a, err := auth.New(keyID, &keyStore{pk: privateKey})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create an authenticator: %v", tests.Failed, testID, err)
+			}
+			a.RequireMFA(auth.RoleAdmin)
+
+			now := time.Now()
+			claims := auth.Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "0x1",
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+					IssuedAt:  jwt.NewNumericDate(now),
+				},
+				Roles: []string{auth.RoleAdmin},
+				AMR:   []string{auth.AMRPassword},
+			}
+
+			if _, err := a.GenerateToken(claims); !errors.Is(err, auth.ErrMFARequired) {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse a token without a second factor: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse a token without a second factor.", tests.Success, testID)
+
+			claims.AMR = append(claims.AMR, auth.AMROTP)
+			if _, err := a.GenerateToken(claims); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould generate a token with a second factor: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould generate a token with a second factor.", tests.Success, testID)
+
+			chl, err := a.GenerateChallenge(claims.Subject, now)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a challenge: %v", tests.Failed, testID, err)
+			}
+
+			if _, err := a.ValidateToken(chl); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not accept a challenge as a token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not accept a challenge as a token.", tests.Success, testID)
+
+			if _, err := a.ValidateChallenge(chl); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate the challenge: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to validate the challenge.", tests.Success, testID)
+
+			a.SetAPIKeyLookup(keyLookup{claims: auth.Claims{Roles: []string{auth.RoleAdmin}, AMR: []string{auth.AMRAPIKey}}})
+			if _, err := a.ValidateAPIKey(context.Background(), "", "mk_key"); !errors.Is(err, auth.ErrMFARequired) {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse an api key of an admin: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse an api key of an admin.", tests.Success, testID)
+
+			a.SetAPIKeyLookup(keyLookup{claims: auth.Claims{Roles: []string{auth.RoleUser}, AMR: []string{auth.AMRAPIKey}}})
+			if _, err := a.ValidateAPIKey(context.Background(), "", "mk_key"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould accept an api key of a user: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould accept an api key of a user.", tests.Success, testID)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	t.Log("Given the need to let clients keep state the service needs back.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a login waits for an identity provider,", testID)
+		{
+			const keyID = "54bb2165-71e1-41a6-af3e-7da4a0e1e2c1"
+			privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a private key: %v", tests.Failed, testID, err)
+			}
+
+			a, err := auth.New(keyID, &keyStore{pk: privateKey})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create an authenticator: %v", tests.Failed, testID, err)
+			}
+
+			now := time.Now()
+			values := map[string]string{"state": "s", "verifier": "v"}
+
+			state, err := a.GenerateState(values, now, now.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a state token: %v", tests.Failed, testID, err)
+			}
+
+			got, err := a.ValidateState(state)
+			if err != nil || got["state"] != "s" || got["verifier"] != "v" {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould get back the values: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get back the values.", tests.Success, testID)
+
+			if _, err := a.ValidateToken(state); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not accept a state token as a token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not accept a state token as a token.", tests.Success, testID)
+
+			chl, err := a.GenerateChallenge("0x1", now, auth.AMRExternal)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a challenge: %v", tests.Failed, testID, err)
+			}
+			if _, err := a.ValidateState(chl); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not accept a challenge as a state token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not accept a challenge as a state token.", tests.Success, testID)
+
+			claims, err := a.ValidateChallenge(chl)
+			if err != nil || len(claims.AMR) != 1 || claims.AMR[0] != auth.AMRExternal {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, claims.AMR)
+				t.Fatalf("\t%s\tTest %d:\tShould keep the methods of the first step in the challenge: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the methods of the first step in the challenge.", tests.Success, testID)
+
+			expired, err := a.GenerateState(values, now.Add(-time.Hour), now.Add(-time.Minute))
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a state token: %v", tests.Failed, testID, err)
+			}
+			if _, err := a.ValidateState(expired); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not accept an expired state token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not accept an expired state token.", tests.Success, testID)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	t.Log("Given the need to grant scopes based on roles.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen handling a user token.", testID)
+		{
+			const keyID = "54bb2165-71e1-41a6-af3e-7da4a0e1e2c1"
+			privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a private key: %v", tests.Failed, testID, err)
+			}
+
+			a, err := auth.New(keyID, &keyStore{pk: privateKey})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create an authenticator: %v", tests.Failed, testID, err)
+			}
+
+			perms, err := auth.ParsePermissions([]string{"USER=actions:read actions:write"})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to parse permissions: %v", tests.Failed, testID, err)
+			}
+			a.SetPermissions(perms)
+
+			now := time.Now()
+			claims := auth.Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "0x1",
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+					IssuedAt:  jwt.NewNumericDate(now),
+				},
+				Roles:  []string{auth.RoleUser},
+				Scopes: []string{auth.ScopeActionsRead, auth.ScopeUsersAdmin},
+			}
+
+			token, err := a.GenerateToken(claims)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a token: %v", tests.Failed, testID, err)
+			}
+
+			parsed, err := a.ValidateToken(token)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate the token: %v", tests.Failed, testID, err)
+			}
+
+			if !parsed.HasScopes(auth.ScopeActionsRead) {
+				t.Fatalf("\t%s\tTest %d:\tShould keep a scope granted by the role.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep a scope granted by the role.", tests.Success, testID)
+
+			if parsed.HasScopes(auth.ScopeUsersAdmin) {
+				t.Fatalf("\t%s\tTest %d:\tShould drop a scope not granted by the role.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould drop a scope not granted by the role.", tests.Success, testID)
+
+			claims.Scopes = []string{auth.ScopeUsersAdmin}
+			token, err = a.GenerateToken(claims)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a token: %v", tests.Failed, testID, err)
+			}
+
+			parsed, err = a.ValidateToken(token)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate the token: %v", tests.Failed, testID, err)
+			}
+
+			if len(parsed.Scopes) != 0 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, parsed.Scopes)
+				t.Fatalf("\t%s\tTest %d:\tShould have no scopes when none was granted.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have no scopes when none was granted.", tests.Success, testID)
+
+			if !auth.OwnerOrAdmin(parsed, "0x1") || auth.OwnerOrAdmin(parsed, "0x2") {
+				t.Fatalf("\t%s\tTest %d:\tShould only allow acting on owned resources.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould only allow acting on owned resources.", tests.Success, testID)
+
+			svc, err := a.GenerateServiceToken("action-api", now, time.Hour)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to generate a service token: %v", tests.Failed, testID, err)
+			}
+
+			if _, err := a.ValidateToken(svc); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not accept a database token as a token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not accept a database token as a token.", tests.Success, testID)
+
+			service := a.ServiceTokens("action-api")
+			first, err := service()
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign a service token: %v", tests.Failed, testID, err)
+			}
+
+			if next, err := service(); err != nil || next != first {
+				t.Fatalf("\t%s\tTest %d:\tShould reuse the service token until it is due for renewal.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reuse the service token until it is due for renewal.", tests.Success, testID)
+
+			if _, err := auth.ParsePermissions([]string{"USER=actions:delete"}); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould reject an unknown scope.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject an unknown scope.", tests.Success, testID)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	admin := auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "0x1"},
+		Roles:            []string{auth.RoleAdmin},
+		Scopes:           []string{auth.ScopeUsersAdmin},
+	}
+	orgAdmin := admin
+	orgAdmin.Tenant = "0x9"
+
+	t.Log("Given the need to keep admins of an organization within it.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a user admin acts on another user.", testID)
+		{
+			if !auth.OwnerOrAdmin(admin, "0x2") {
+				t.Fatalf("\t%s\tTest %d:\tShould allow an admin of every organization.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould allow an admin of every organization.", tests.Success, testID)
+
+			if auth.OwnerOrAdmin(orgAdmin, "0x2") {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse an admin limited to an organization.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse an admin limited to an organization.", tests.Success, testID)
+
+			if !auth.OwnerOrAdmin(orgAdmin, "0x1") {
+				t.Fatalf("\t%s\tTest %d:\tShould still allow acting on their own resources.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould still allow acting on their own resources.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen a user admin manages an organization.", testID)
+		{
+			if !auth.OrgAdmin(orgAdmin, "0x9") || auth.OrgAdmin(orgAdmin, "0x8") {
+				t.Fatalf("\t%s\tTest %d:\tShould only allow managing the organization of the token.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould only allow managing the organization of the token.", tests.Success, testID)
+		}
+	}
+}
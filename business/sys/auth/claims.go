@@ -15,10 +15,90 @@ const (
 	RoleUser  = "USER"
 )
 
-// Claims represents the authorization claims transmitted via a JWT.
+// These are the expected values for Claims.AMR. They record how the
+// subject proved who they are.
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRAPIKey   = "apikey"
+	AMRExternal = "ext"
+)
+
+// Claims represents the authorization claims transmitted via a JWT. Scopes
+// is always sent, an empty list being a token without scopes, so tokens
+// from before scopes existed are told apart by the claim missing.
 type Claims struct {
 	jwt.RegisteredClaims
-	Roles []string `json:"roles"`
+	Roles  []string `json:"roles"`
+	AMR    []string `json:"amr,omitempty"`
+	Scopes []string `json:"scopes"`
+	Tenant string   `json:"tenant,omitempty"`
+
+	// Database holds the claims the database authorization rules use.
+	Database *DatabaseClaims `json:"Auth,omitempty"`
+}
+
+// DatabaseClaims represents the claims the database authorizes queries with.
+// The names match the variables used by the rules in the schema.
+type DatabaseClaims struct {
+	Role   string `json:"ROLE"`
+	User   string `json:"USER"`
+	Tenant string `json:"TENANT,omitempty"`
+}
+
+// newDatabaseClaims derives the database claims for the claims. Admins get
+// the admin role at the database, everyone else is a user. The rules of the
+// database let admins reach every organization, so admins limited to one
+// are users there as well.
+func newDatabaseClaims(c Claims) *DatabaseClaims {
+	role := RoleUser
+	if c.Authorized(RoleAdmin) && c.Tenant == "" {
+		role = RoleAdmin
+	}
+
+	dc := DatabaseClaims{
+		Role:   role,
+		User:   c.Subject,
+		Tenant: c.Tenant,
+	}
+
+	return &dc
+}
+
+// HasScopes returns true if the claims hold every one of the scopes.
+func (c Claims) HasScopes(scopes ...string) bool {
+	for _, want := range scopes {
+		found := false
+		for _, has := range c.Scopes {
+			if has == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed returns ErrorForbidden unless the policy allows the claims to act
+// on a resource owned by the specified user.
+func (c Claims) Allowed(p Policy, ownerID string) error {
+	if !p(c, ownerID) {
+		return ErrorForbidden
+	}
+	return nil
+}
+
+// HasAMR returns true if the subject authenticated using the method.
+func (c Claims) HasAMR(method string) bool {
+	for _, has := range c.AMR {
+		if has == method {
+			return true
+		}
+	}
+	return false
 }
 
 // Authorized returns true if the claims has at least one of the provided roles.
@@ -40,6 +120,9 @@ type ctxKey int
 // key is used to store/retrieve a Claims value from a context.Context.
 const key ctxKey = 1
 
+// tokenKey is used to store/retrieve the token the claims came from.
+const tokenKey ctxKey = 2
+
 // SetClaims stores the claims in the context.
 func SetClaims(ctx context.Context, claims Claims) context.Context {
 	return context.WithValue(ctx, key, claims)
@@ -53,3 +136,27 @@ func GetClaims(ctx context.Context) (Claims, error) {
 	}
 	return v, nil
 }
+
+// SetToken stores the token the caller presented in the context so it can be
+// forwarded to the database.
+func SetToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// getToken returns the token the caller presented.
+func getToken(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(tokenKey).(string)
+	return v, ok
+}
+
+// GetTenant returns the organization the claims in the context are limited
+// to. Restricted is false when the context holds no claims, which is the case
+// for internal callers like the admin tooling. Claims without a tenant are
+// restricted to data that belongs to no organization.
+func GetTenant(ctx context.Context) (tenant string, restricted bool) {
+	v, ok := ctx.Value(key).(Claims)
+	if !ok {
+		return "", false
+	}
+	return v.Tenant, true
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// These are the expected values for Claims.Scopes. Each scope grants a
+// permission on a kind of resource.
+const (
+	ScopeActionsRead  = "actions:read"
+	ScopeActionsWrite = "actions:write"
+	ScopeUsersRead    = "users:read"
+	ScopeUsersWrite   = "users:write"
+	ScopeUsersAdmin   = "users:admin"
+	ScopeVideosUpload = "videos:upload"
+	ScopeOrgsCreate   = "orgs:create"
+)
+
+// scopes is the set of known scopes, used to catch typos in configuration.
+var scopes = map[string]bool{
+	ScopeActionsRead:  true,
+	ScopeActionsWrite: true,
+	ScopeUsersRead:    true,
+	ScopeUsersWrite:   true,
+	ScopeUsersAdmin:   true,
+	ScopeVideosUpload: true,
+	ScopeOrgsCreate:   true,
+}
+
+// Permissions maps a role to the scopes it grants.
+type Permissions map[string][]string
+
+// DefaultPermissions returns the permissions used when none are configured.
+func DefaultPermissions() Permissions {
+	return Permissions{
+		RoleAdmin: {ScopeActionsRead, ScopeActionsWrite, ScopeUsersRead, ScopeUsersWrite, ScopeUsersAdmin, ScopeVideosUpload, ScopeOrgsCreate},
+		RoleUser:  {ScopeActionsRead, ScopeActionsWrite, ScopeUsersRead, ScopeUsersWrite, ScopeVideosUpload},
+	}
+}
+
+// ParsePermissions parses permissions from configuration. Every entry has
+// the form ROLE=scope scope, for example USER=actions:read actions:write.
+func ParsePermissions(entries []string) (Permissions, error) {
+	perms := make(Permissions)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid permission entry %q, expected ROLE=scope scope", entry)
+		}
+
+		role := strings.TrimSpace(parts[0])
+		for _, scope := range strings.Fields(parts[1]) {
+			if !scopes[scope] {
+				return nil, fmt.Errorf("unknown scope %q for role %s", scope, role)
+			}
+			perms[role] = append(perms[role], scope)
+		}
+	}
+
+	if len(perms) == 0 {
+		return nil, errors.New("no permissions configured")
+	}
+
+	return perms, nil
+}
+
+// Scopes returns the scopes granted by any of the roles.
+func (p Permissions) Scopes(roles ...string) []string {
+	seen := make(map[string]bool)
+	var granted []string
+	for _, role := range roles {
+		for _, scope := range p[role] {
+			if !seen[scope] {
+				seen[scope] = true
+				granted = append(granted, scope)
+			}
+		}
+	}
+	return granted
+}
+
+// Limit returns the requested scopes that are granted by any of the roles.
+// No requested scopes means everything the roles grant.
+func (p Permissions) Limit(requested []string, roles ...string) []string {
+	granted := p.Scopes(roles...)
+	if len(requested) == 0 {
+		return granted
+	}
+
+	var limited []string
+	for _, want := range requested {
+		for _, has := range granted {
+			if want == has {
+				limited = append(limited, want)
+				break
+			}
+		}
+	}
+	return limited
+}
+
+// =============================================================================
+
+// Policy decides if the claims allow acting on a resource owned by the
+// specified user.
+type Policy func(c Claims, ownerID string) bool
+
+// Owner allows subjects to act on their own resources.
+func Owner(c Claims, ownerID string) bool {
+	return ownerID != "" && c.Subject == ownerID
+}
+
+// Scope allows subjects holding the scope to act on any resource.
+func Scope(scope string) Policy {
+	return func(c Claims, ownerID string) bool {
+		return c.HasScopes(scope)
+	}
+}
+
+// Any allows the action when at least one of the policies allows it.
+func Any(policies ...Policy) Policy {
+	return func(c Claims, ownerID string) bool {
+		for _, p := range policies {
+			if p(c, ownerID) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Global allows what the policy allows only to claims that aren't limited to
+// an organization.
+func Global(p Policy) Policy {
+	return func(c Claims, ownerID string) bool {
+		return c.Tenant == "" && p(c, ownerID)
+	}
+}
+
+// OwnerOrAdmin allows users to act on their own resources and user admins
+// to act on anyone's. Admins of an organization only administer it, so
+// they act on their own resources like everyone else.
+var OwnerOrAdmin = Any(Owner, Global(Scope(ScopeUsersAdmin)))
+
+// Member allows subjects whose claims are limited to the organization.
+func Member(c Claims, orgID string) bool {
+	return orgID != "" && c.Tenant == orgID
+}
+
+// OrgAdmin allows user admins of the organization to manage it.
+func OrgAdmin(c Claims, orgID string) bool {
+	return Member(c, orgID) && c.HasScopes(ScopeUsersAdmin)
+}
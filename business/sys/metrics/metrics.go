@@ -4,6 +4,9 @@ package metrics
 import (
 	"context"
 	"expvar"
+	"runtime"
+	"strconv"
+	"time"
 )
 
 // This holds the single instance of the metrics value needed for
@@ -16,11 +19,30 @@ var m *metrics
 
 // Metrics represents the set of metrics we gather. These fields are
 // safe to be accessed concurrently thanks to expvar. Now extra abstraction required.
+//
+// The families hold the same information labelled for Prometheus, along with
+// the latencies expvar can't express.
 type metrics struct {
-	goroutines *expvar.Int
 	requests   *expvar.Int
 	errors     *expvar.Int
 	panics     *expvar.Int
+	limited    *expvar.Int
+	timeouts   *expvar.Int
+	dbAttempts *expvar.Map
+	dbFailures *expvar.Map
+	cacheHits  *expvar.Map
+	cacheMiss  *expvar.Map
+
+	httpRequests  *family
+	httpDuration  *family
+	httpPanics    *family
+	httpLimited   *family
+	httpTimeouts  *family
+	dbAttemptsVec *family
+	dbFailuresVec *family
+	dbDuration    *family
+	cacheHitsVec  *family
+	cacheMissVec  *family
 }
 
 // init constructs the metrics value that will be used to capture metrics.
@@ -28,11 +50,47 @@ type metrics struct {
 // inside of expvar is registered as a singleton. The use of once will make
 // sure this initialization only happens once.
 func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+
 	m = &metrics{
-		goroutines: expvar.NewInt("goroutines"),
 		requests:   expvar.NewInt("requests"),
 		errors:     expvar.NewInt("errors"),
 		panics:     expvar.NewInt("panics"),
+		limited:    expvar.NewInt("rate_limited"),
+		timeouts:   expvar.NewInt("timeouts"),
+		dbAttempts: expvar.NewMap("db_attempts"),
+		dbFailures: expvar.NewMap("db_failures"),
+		cacheHits:  expvar.NewMap("cache_hits"),
+		cacheMiss:  expvar.NewMap("cache_misses"),
+
+		httpRequests:  newCounter("http_requests_total", "Number of requests handled.", "route", "method", "status"),
+		httpDuration:  newHistogram("http_request_duration_seconds", "Time taken to handle requests.", "route", "method", "status"),
+		httpPanics:    newCounter("http_panics_total", "Number of panics recovered while handling requests."),
+		httpLimited:   newCounter("http_rate_limited_total", "Number of requests rejected by the rate limiter.", "route"),
+		httpTimeouts:  newCounter("http_timeouts_total", "Number of requests that ran out of time.", "route"),
+		dbAttemptsVec: newCounter("graphql_attempts_total", "Number of requests sent to the database.", "operation"),
+		dbFailuresVec: newCounter("graphql_failures_total", "Number of requests to the database that failed.", "operation"),
+		dbDuration:    newHistogram("graphql_request_duration_seconds", "Time taken by requests to the database.", "operation"),
+		cacheHitsVec:  newCounter("cache_hits_total", "Number of values found in the cache.", "kind"),
+		cacheMissVec:  newCounter("cache_misses_total", "Number of values that had to be read from the database.", "kind"),
+	}
+}
+
+// families returns the metrics exposed to Prometheus.
+func (m *metrics) families() []*family {
+	return []*family{
+		m.httpRequests,
+		m.httpDuration,
+		m.httpPanics,
+		m.httpLimited,
+		m.httpTimeouts,
+		m.dbAttemptsVec,
+		m.dbFailuresVec,
+		m.dbDuration,
+		m.cacheHitsVec,
+		m.cacheMissVec,
 	}
 }
 
@@ -61,33 +119,86 @@ func Set(ctx context.Context) context.Context {
 	return context.WithValue(ctx, key, m)
 }
 
-// AddGoroutines increments the goroutines metric by 1.
-func AddGoroutines(ctx context.Context) {
-	if v, ok := ctx.Value(key).(*metrics); ok {
-		// for every hundred requests, add goroutine
-		if v.requests.Value()%100 == 0 {
-			v.goroutines.Add(1)
-		}
-	}
-}
-
-// AddGoroutines increments the goroutines metric by 1.
+// AddRequests increments the requests metric by 1.
 func AddRequests(ctx context.Context) {
 	if v, ok := ctx.Value(key).(*metrics); ok {
 		v.requests.Add(1)
 	}
 }
 
-// AddGoroutines increments the goroutines metric by 1.
+// AddErrors increments the errors metric by 1.
 func AddErrors(ctx context.Context) {
 	if v, ok := ctx.Value(key).(*metrics); ok {
 		v.errors.Add(1)
 	}
 }
 
-// AddGoroutines increments the goroutines metric by 1.
+// AddPanics increments the panics metric by 1.
 func AddPanics(ctx context.Context) {
 	if v, ok := ctx.Value(key).(*metrics); ok {
 		v.panics.Add(1)
+		v.httpPanics.add(1)
+	}
+}
+
+// AddRateLimited increments the number of requests to the route rejected by
+// the rate limiter by 1.
+func AddRateLimited(ctx context.Context, route string) {
+	if v, ok := ctx.Value(key).(*metrics); ok {
+		v.limited.Add(1)
+		v.httpLimited.add(1, route)
+	}
+}
+
+// AddTimeouts increments the number of requests to the route that ran out
+// of time by 1.
+func AddTimeouts(ctx context.Context, route string) {
+	if v, ok := ctx.Value(key).(*metrics); ok {
+		v.timeouts.Add(1)
+		v.httpTimeouts.add(1, route)
+	}
+}
+
+// ObserveRequest records a handled request by the route it matched, so
+// requests for different ids count together.
+func ObserveRequest(ctx context.Context, route string, method string, status int, d time.Duration) {
+	if v, ok := ctx.Value(key).(*metrics); ok {
+		code := strconv.Itoa(status)
+		v.httpRequests.add(1, route, method, code)
+		v.httpDuration.observe(d.Seconds(), route, method, code)
 	}
 }
+
+// AddDBAttempt increments the number of requests sent to the database for
+// the operation by 1. Database requests are made outside of web requests as
+// well, so this doesn't depend on the context.
+func AddDBAttempt(op string) {
+	m.dbAttempts.Add(op, 1)
+	m.dbAttemptsVec.add(1, op)
+}
+
+// AddDBFailure increments the number of failed requests to the database for
+// the operation by 1.
+func AddDBFailure(op string) {
+	m.dbFailures.Add(op, 1)
+	m.dbFailuresVec.add(1, op)
+}
+
+// ObserveDB records the time a request to the database took.
+func ObserveDB(op string, d time.Duration) {
+	m.dbDuration.observe(d.Seconds(), op)
+}
+
+// AddCacheHit increments the number of values of the kind found in the
+// cache by 1.
+func AddCacheHit(kind string) {
+	m.cacheHits.Add(kind, 1)
+	m.cacheHitsVec.add(1, kind)
+}
+
+// AddCacheMiss increments the number of values of the kind that had to be
+// read from the database by 1.
+func AddCacheMiss(kind string) {
+	m.cacheMiss.Add(kind, 1)
+	m.cacheMissVec.add(1, kind)
+}
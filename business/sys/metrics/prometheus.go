@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is a metric with a value for every combination of its labels. It
+// is either a counter or a histogram, the expvar package has neither.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series holds the value of a family for one combination of labels.
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newCounter constructs a counter with the labels.
+func newCounter(name string, help string, labels ...string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   "counter",
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+// newHistogram constructs a histogram of latencies with the labels.
+func newHistogram(name string, help string, labels ...string) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		kind:    "histogram",
+		labels:  labels,
+		buckets: latencyBuckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get returns the series for the label values, creating it when needed.
+// The caller must hold the lock.
+func (f *family) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			values: values,
+			counts: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add increments the counter for the label values.
+func (f *family) add(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.get(values).value += v
+}
+
+// observe records the value in the histogram for the label values.
+func (f *family) observe(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.get(values)
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// write writes the family in the Prometheus text format.
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := f.format(s.values)
+
+		if f.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, braces(labels), number(s.value))
+			continue
+		}
+
+		for i, upper := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(join(labels, `le="`+number(upper)+`"`)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, braces(join(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, braces(labels), number(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, braces(labels), s.count)
+	}
+}
+
+// format returns the labels of the family with the values, like
+// method="GET",status="200".
+func (f *family) format(values []string) string {
+	pairs := make([]string, len(f.labels))
+	for i, label := range f.labels {
+		pairs[i] = label + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelEscaper escapes what can't be written as is in a label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func join(labels string, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func number(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// =======================================================================
+
+// writeRuntime writes gauges describing the Go runtime at the moment.
+func writeRuntime(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_gomaxprocs", "Number of operating system threads that can execute Go code at once.", float64(runtime.GOMAXPROCS(0))},
+		{"go_memstats_heap_alloc_bytes", "Number of bytes of allocated heap objects.", float64(ms.HeapAlloc)},
+		{"go_memstats_heap_objects", "Number of allocated heap objects.", float64(ms.HeapObjects)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the operating system.", float64(ms.Sys)},
+		{"go_gc_cycles_total", "Number of completed garbage collection cycles.", float64(ms.NumGC)},
+		{"go_gc_pause_seconds_total", "Time spent in garbage collection pauses.", time.Duration(ms.PauseTotalNs).Seconds()},
+	}
+
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, number(g.value))
+	}
+}
+
+// WritePrometheus writes every metric in the Prometheus text format.
+func WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	writeRuntime(bw)
+	for _, f := range m.families() {
+		f.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns the handler serving the metrics in the Prometheus text
+// format, so they can be scraped.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
@@ -0,0 +1,382 @@
+// Package oidc provides support for logging users in through an external
+// OpenID Connect identity provider using the authorization code flow with
+// PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Set of error variables for the login flow.
+var (
+	ErrUnknownState = errors.New("login state is unknown or expired")
+	ErrInvalidToken = errors.New("id token is not valid")
+)
+
+// pendingTTL is how long a user has to complete the login at the provider.
+const pendingTTL = 10 * time.Minute
+
+// keysRefresh limits how often the signing keys are fetched again when a
+// token is signed with a key we haven't seen.
+const keysRefresh = time.Minute
+
+// Config represents the settings for the relying party.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Pending holds the secrets of a login waiting for the provider to call
+// back. The state identifies the login, the nonce ties the id token to it
+// and the verifier proves to the provider the code is redeemed by whoever
+// started the login.
+type Pending struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// Identity represents the user the provider vouched for.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AMR           []string
+}
+
+// Provider manages logins against a single identity provider.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu       sync.Mutex
+	meta     metadata
+	keys     map[string]*rsa.PublicKey
+	keysTime time.Time
+}
+
+// New constructs a Provider for the configured identity provider. The
+// provider is discovered on first use.
+func New(cfg Config, client *http.Client) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &Provider{
+		cfg:    cfg,
+		client: client,
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+}
+
+// AuthURL returns the url at the provider the user must be sent to along
+// with the login waiting for the provider to call back. The provider keeps
+// no logins, so any instance can complete it; the caller keeps it where
+// only the client that started the login can bring it back.
+func (p *Provider) AuthURL(ctx context.Context, now time.Time) (string, Pending, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", Pending{}, err
+	}
+
+	state, err := random()
+	if err != nil {
+		return "", Pending{}, err
+	}
+	nonce, err := random()
+	if err != nil {
+		return "", Pending{}, err
+	}
+	verifier, err := random()
+	if err != nil {
+		return "", Pending{}, err
+	}
+
+	pnd := Pending{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Expires:  now.Add(pendingTTL),
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	return meta.AuthorizationEndpoint + "?" + q.Encode(), pnd, nil
+}
+
+// Exchange completes the pending login when the provider called back with
+// its state. The code is exchanged for an id token which is verified
+// against the keys of the provider.
+func (p *Provider) Exchange(ctx context.Context, pnd Pending, state string, code string, now time.Time) (Identity, error) {
+	if pnd.State == "" || subtle.ConstantTimeCompare([]byte(pnd.State), []byte(state)) != 1 || now.After(pnd.Expires) {
+		return Identity{}, ErrUnknownState
+	}
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", pnd.Verifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, fmt.Errorf("token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tkn struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.do(req, &tkn); err != nil {
+		return Identity{}, fmt.Errorf("exchanging code: %w", err)
+	}
+
+	return p.verify(ctx, meta, tkn.IDToken, pnd.Nonce)
+}
+
+// =============================================================================
+
+// metadata is the part of the discovery document the flow needs.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// claims are the claims of an id token.
+type claims struct {
+	jwt.RegisteredClaims
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	AMR           []string `json:"amr"`
+}
+
+// discover fetches the discovery document of the provider once.
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+
+	if meta.Issuer != "" {
+		return meta, nil
+	}
+
+	u := strings.TrimRight(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return metadata{}, fmt.Errorf("discovery request: %w", err)
+	}
+
+	if err := p.do(req, &meta); err != nil {
+		return metadata{}, fmt.Errorf("discovering provider: %w", err)
+	}
+
+	// The issuer in the document must be the one we were configured with.
+	if strings.TrimRight(meta.Issuer, "/") != strings.TrimRight(p.cfg.Issuer, "/") {
+		return metadata{}, fmt.Errorf("discovered issuer %q doesn't match %q", meta.Issuer, p.cfg.Issuer)
+	}
+
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+
+	return meta, nil
+}
+
+// verify validates the id token and returns the identity it holds.
+func (p *Provider) verify(ctx context.Context, meta metadata, idToken string, nonce string) (Identity, error) {
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, meta, kid)
+	}
+
+	parser := jwt.Parser{
+		ValidMethods: []string{"RS256"},
+	}
+
+	var clm claims
+	token, err := parser.ParseWithClaims(idToken, &clm, keyFunc)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	switch {
+	case !token.Valid:
+		return Identity{}, ErrInvalidToken
+	case !clm.VerifyIssuer(meta.Issuer, true):
+		return Identity{}, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, clm.Issuer)
+	case !clm.VerifyAudience(p.cfg.ClientID, true):
+		return Identity{}, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	case clm.ExpiresAt == nil:
+		return Identity{}, fmt.Errorf("%w: missing expiration", ErrInvalidToken)
+	case clm.Nonce != nonce:
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	case clm.Subject == "":
+		return Identity{}, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	id := Identity{
+		Issuer:        clm.Issuer,
+		Subject:       clm.Subject,
+		Email:         clm.Email,
+		EmailVerified: clm.EmailVerified,
+		Name:          clm.Name,
+		AMR:           clm.AMR,
+	}
+
+	return id, nil
+}
+
+// key returns the public key of the provider for the kid. The keys are
+// fetched again when the kid is unknown, since providers rotate keys.
+func (p *Provider) key(ctx context.Context, meta metadata, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysTime) > keysRefresh
+	p.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if !stale {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysTime = time.Now()
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	return key, nil
+}
+
+// fetchKeys reads the RSA signing keys from the JWKS document of the provider.
+func (p *Provider) fetchKeys(ctx context.Context, meta metadata) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jwks request: %w", err)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.do(req, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding exponent of key %q: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// do executes the request and decodes the JSON response into v.
+func (p *Provider) do(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Limit what we read from the provider to a megabyte.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, string(body))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// random returns a url safe random string for state, nonce and verifier.
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("reading random: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
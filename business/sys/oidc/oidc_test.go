@@ -0,0 +1,46 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/oidc"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestExchangeState(t *testing.T) {
+	now := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	pnd := oidc.Pending{State: "abc", Nonce: "n", Verifier: "v", Expires: now.Add(time.Minute)}
+
+	tt := []struct {
+		name  string
+		pnd   oidc.Pending
+		state string
+		now   time.Time
+	}{
+		{"no pending login", oidc.Pending{}, "", now},
+		{"another state", pnd, "xyz", now},
+		{"expired login", pnd, "abc", now.Add(time.Hour)},
+	}
+
+	t.Log("Given the need to only complete logins started by the same client.")
+	{
+		for testID, tst := range tt {
+			t.Logf("\tTest %d:\tWhen the provider calls back with %s.", testID, tst.name)
+			{
+				// The provider can't be reached, so the state must be refused
+				// before it is asked for anything.
+				p := oidc.New(oidc.Config{Issuer: "http://127.0.0.1:0"}, &http.Client{Timeout: time.Second})
+
+				_, err := p.Exchange(context.Background(), tst.pnd, tst.state, "code", tst.now)
+				if !errors.Is(err, oidc.ErrUnknownState) {
+					t.Fatalf("\t%s\tTest %d:\tShould refuse the login: %v", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould refuse the login.", tests.Success, testID)
+			}
+		}
+	}
+}
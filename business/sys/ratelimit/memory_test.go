@@ -0,0 +1,86 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	l := ratelimit.Limit{Requests: 1, Period: time.Second, Burst: 3}
+	start := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Log("Given the need to limit clients with buckets kept in memory.")
+	{
+		m := ratelimit.NewMemory()
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a client uses up its burst.", testID)
+		{
+			for i := 0; i < l.Burst; i++ {
+				res, err := m.Take(ctx, "a", l, start)
+				if err != nil || !res.Allowed {
+					t.Fatalf("\t%s\tTest %d:\tShould allow request %d within the burst: %v", tests.Failed, testID, i, err)
+				}
+				if res.Remaining != l.Burst-i-1 {
+					t.Logf("\t\tTest %d:\texp: %v", testID, l.Burst-i-1)
+					t.Logf("\t\tTest %d:\tgot: %v", testID, res.Remaining)
+					t.Fatalf("\t%s\tTest %d:\tShould count the remaining requests.", tests.Failed, testID)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould allow the requests within the burst.", tests.Success, testID)
+
+			res, err := m.Take(ctx, "a", l, start)
+			if err != nil || res.Allowed {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse the request after the burst.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse the request after the burst.", tests.Success, testID)
+
+			if res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, res)
+				t.Fatalf("\t%s\tTest %d:\tShould tell when to retry and when the bucket is full.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould tell when to retry and when the bucket is full.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen another client calls.", testID)
+		{
+			res, err := m.Take(ctx, "b", l, start)
+			if err != nil || !res.Allowed {
+				t.Fatalf("\t%s\tTest %d:\tShould give every client its own bucket.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould give every client its own bucket.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the client waits for the bucket to refill.", testID)
+		{
+			res, err := m.Take(ctx, "a", l, start.Add(time.Second))
+			if err != nil || !res.Allowed {
+				t.Fatalf("\t%s\tTest %d:\tShould allow a request once it was replenished.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould allow a request once it was replenished.", tests.Success, testID)
+
+			if res, _ := m.Take(ctx, "a", l, start.Add(time.Second)); res.Allowed {
+				t.Fatalf("\t%s\tTest %d:\tShould only replenish the rate of the limit.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould only replenish the rate of the limit.", tests.Success, testID)
+
+			later := start.Add(time.Hour)
+			for i := 0; i < l.Burst; i++ {
+				if res, _ := m.Take(ctx, "a", l, later); !res.Allowed {
+					t.Fatalf("\t%s\tTest %d:\tShould refill the bucket up to the burst.", tests.Failed, testID)
+				}
+			}
+			if res, _ := m.Take(ctx, "a", l, later); res.Allowed {
+				t.Fatalf("\t%s\tTest %d:\tShould refill the bucket up to the burst.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refill the bucket up to the burst.", tests.Success, testID)
+		}
+	}
+}
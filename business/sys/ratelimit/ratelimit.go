@@ -0,0 +1,171 @@
+// Package ratelimit provides support for limiting how often clients can call
+// the api using token buckets.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrLimited is returned when a client made too many requests.
+var ErrLimited = errors.New("rate limit exceeded")
+
+// Limit represents how many requests a client can make. Requests are
+// replenished at Requests per Period and up to Burst can be made at once.
+// The zero value doesn't limit requests.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Unlimited reports whether the limit lets every request through.
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0 || l.Period <= 0 || l.Burst <= 0
+}
+
+// Rate returns the number of requests replenished per second.
+func (l Limit) Rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// String implements the fmt.Stringer interface in the form ParseLimit reads.
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "none"
+	}
+	return fmt.Sprintf("%d/%s %d", l.Requests, l.Period, l.Burst)
+}
+
+// ParseLimit parses a limit of the form requests/period burst, for example
+// 5/1m 10. The burst defaults to the number of requests and the period can
+// leave out the 1, as in 20/s. The value none doesn't limit requests.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "none" {
+		return Limit{}, nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected requests/period burst", s)
+	}
+
+	parts := strings.SplitN(fields[0], "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected requests/period burst", s)
+	}
+
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return Limit{}, fmt.Errorf("invalid requests in limit %q", s)
+	}
+
+	period := parts[1]
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid period in limit %q", s)
+	}
+
+	burst := requests
+	if len(fields) == 2 {
+		burst, err = strconv.Atoi(fields[1])
+		if err != nil || burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid burst in limit %q", s)
+		}
+	}
+
+	return Limit{Requests: requests, Period: d, Burst: burst}, nil
+}
+
+// ParseRoutes parses the limits of routes from configuration. Every entry
+// has the form METHOD /path=limit, for example POST /v1/users/token/mfa=5/1m.
+// Paths are the routes as registered, including parameters like :id.
+func ParseRoutes(entries []string) (map[string]Limit, error) {
+	routes := make(map[string]Limit)
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid route limit %q, expected METHOD /path=limit", entry)
+		}
+
+		route := strings.Fields(entry[:i])
+		if len(route) != 2 || !strings.HasPrefix(route[1], "/") {
+			return nil, fmt.Errorf("invalid route limit %q, expected METHOD /path=limit", entry)
+		}
+
+		l, err := ParseLimit(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("route %s %s: %w", route[0], route[1], err)
+		}
+		routes[RouteKey(route[0], route[1])] = l
+	}
+
+	return routes, nil
+}
+
+// RouteKey returns the key a route is configured under.
+func RouteKey(method string, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+// =============================================================================
+
+// Result represents the state of a bucket after a request was taken from it.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of clients. Instances of the api that use the same
+// store, like one backed by a shared database, limit clients together.
+// Implementations must take a request from a bucket atomically.
+type Store interface {
+	Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error)
+}
+
+// Limiter applies the limits of routes to the clients calling them.
+type Limiter struct {
+	store  Store
+	def    Limit
+	routes map[string]Limit
+}
+
+// New constructs a limiter that keeps its buckets in the store. Routes
+// without a limit of their own get the default.
+func New(store Store, def Limit, routes map[string]Limit) *Limiter {
+	return &Limiter{
+		store:  store,
+		def:    def,
+		routes: routes,
+	}
+}
+
+// Limit returns the limit of the route.
+func (l *Limiter) Limit(method string, route string) Limit {
+	if lim, ok := l.routes[RouteKey(method, route)]; ok {
+		return lim
+	}
+	return l.def
+}
+
+// Take takes a request of the client from its bucket for the route. Every
+// route has its own buckets, so a busy route doesn't starve the others.
+func (l *Limiter) Take(ctx context.Context, method string, route string, client string, now time.Time) (Result, error) {
+	lim := l.Limit(method, route)
+	if lim.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	return l.store.Take(ctx, RouteKey(method, route)+"|"+client, lim, now)
+}
@@ -0,0 +1,102 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestParseLimit(t *testing.T) {
+	tt := []struct {
+		in  string
+		exp ratelimit.Limit
+		err bool
+	}{
+		{"5/1m 10", ratelimit.Limit{Requests: 5, Period: time.Minute, Burst: 10}, false},
+		{"20/s", ratelimit.Limit{Requests: 20, Period: time.Second, Burst: 20}, false},
+		{" 3/10s ", ratelimit.Limit{Requests: 3, Period: 10 * time.Second, Burst: 3}, false},
+		{"none", ratelimit.Limit{}, false},
+		{"", ratelimit.Limit{}, true},
+		{"5", ratelimit.Limit{}, true},
+		{"0/s", ratelimit.Limit{}, true},
+		{"5/x", ratelimit.Limit{}, true},
+		{"5/-1s", ratelimit.Limit{}, true},
+		{"5/s 0", ratelimit.Limit{}, true},
+		{"5/s 10 20", ratelimit.Limit{}, true},
+	}
+
+	t.Log("Given the need to read limits from configuration.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen parsing %q.", testID, test.in)
+			{
+				l, err := ratelimit.ParseLimit(test.in)
+				if test.err {
+					if err == nil {
+						t.Fatalf("\t%s\tTest %d:\tShould reject the limit.", tests.Failed, testID)
+					}
+					t.Logf("\t%s\tTest %d:\tShould reject the limit.", tests.Success, testID)
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to parse the limit: %v", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to parse the limit.", tests.Success, testID)
+
+				if l != test.exp {
+					t.Logf("\t\tTest %d:\texp: %+v", testID, test.exp)
+					t.Logf("\t\tTest %d:\tgot: %+v", testID, l)
+					t.Fatalf("\t%s\tTest %d:\tShould get back the expected limit.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get back the expected limit.", tests.Success, testID)
+
+				if back, err := ratelimit.ParseLimit(l.String()); err != nil || back != l {
+					t.Fatalf("\t%s\tTest %d:\tShould read the limit back from its string %q.", tests.Failed, testID, l.String())
+				}
+				t.Logf("\t%s\tTest %d:\tShould read the limit back from its string.", tests.Success, testID)
+			}
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	t.Log("Given the need to read the limits of routes from configuration.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen parsing valid routes.", testID)
+		{
+			routes, err := ratelimit.ParseRoutes([]string{"POST /v1/users/token/mfa=5/1m", "GET /v1/user/:id=none"})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to parse the routes: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to parse the routes.", tests.Success, testID)
+
+			exp := ratelimit.Limit{Requests: 5, Period: time.Minute, Burst: 5}
+			if got := routes[ratelimit.RouteKey("POST", "/v1/users/token/mfa")]; got != exp {
+				t.Logf("\t\tTest %d:\texp: %+v", testID, exp)
+				t.Logf("\t\tTest %d:\tgot: %+v", testID, got)
+				t.Fatalf("\t%s\tTest %d:\tShould key the limit by method and path.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould key the limit by method and path.", tests.Success, testID)
+
+			if l, ok := routes[ratelimit.RouteKey("GET", "/v1/user/:id")]; !ok || !l.Unlimited() {
+				t.Fatalf("\t%s\tTest %d:\tShould turn the limit of a route off with none.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould turn the limit of a route off with none.", tests.Success, testID)
+		}
+
+		for _, entry := range []string{"/v1/users=5/s", "POST v1/users=5/s", "POST /v1/users", "POST /v1/users=5"} {
+			testID++
+			t.Logf("\tTest %d:\tWhen parsing %q.", testID, entry)
+			{
+				if _, err := ratelimit.ParseRoutes([]string{entry}); err == nil {
+					t.Fatalf("\t%s\tTest %d:\tShould reject the route.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould reject the route.", tests.Success, testID)
+			}
+		}
+	}
+}
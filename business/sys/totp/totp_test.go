@@ -0,0 +1,58 @@
+package totp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/totp"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+// secret is the RFC 6238 SHA1 test key "12345678901234567890" in base32.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	tt := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	t.Log("Given the need to generate codes that match RFC 6238.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen handling time %d.", testID, test.unix)
+			{
+				now := time.Unix(test.unix, 0)
+
+				code, err := totp.Code(secret, now)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to generate a code: %v", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to generate a code.", tests.Success, testID)
+
+				if code != test.code {
+					t.Logf("\t\tTest %d:\texp: %v", testID, test.code)
+					t.Logf("\t\tTest %d:\tgot: %v", testID, code)
+					t.Fatalf("\t%s\tTest %d:\tShould get the expected code.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get the expected code.", tests.Success, testID)
+
+				if _, ok := totp.Validate(secret, test.code, now.Add(totp.Period*time.Second), 1); !ok {
+					t.Fatalf("\t%s\tTest %d:\tShould accept the code one step later.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould accept the code one step later.", tests.Success, testID)
+
+				if _, ok := totp.Validate(secret, test.code, now.Add(2*totp.Period*time.Second), 1); ok {
+					t.Fatalf("\t%s\tTest %d:\tShould reject the code two steps later.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould reject the code two steps later.", tests.Success, testID)
+			}
+		}
+	}
+}
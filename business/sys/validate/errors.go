@@ -16,9 +16,12 @@ var ErrInvalidID = errors.New("ID is not in its proper form")
 //
 // All callers to the web API will get an error string
 // and if there were field model errors, then you get information about the field in error
+//
+// The trace id lets the caller point at the request when reporting it.
 type ErrorResponse struct {
-	Error  string `json:"error"`
-	Fields string `json:"fields,omitempty"`
+	Error   string `json:"error"`
+	Fields  string `json:"fields,omitempty"`
+	TraceID string `json:"trace_id,omitempty"`
 }
 
 // RequestError is used to pass an error during the request through the
@@ -7,12 +7,14 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/jnkroeker/makulu/business/data/audit"
 	"github.com/jnkroeker/makulu/business/sys/auth"
 	webv1 "github.com/jnkroeker/makulu/business/sys/validate"
 	"github.com/jnkroeker/makulu/foundation/web"
 )
 
-// Authenticate validates a JWT from the `Authorization` header.
+// Authenticate validates a JWT from the `Authorization` header. API keys
+// are accepted in the `X-API-Key` header or with the `ApiKey` scheme.
 func Authenticate(a *auth.Auth) web.Middleware {
 
 	// This is the actual middleware function to be executed.
@@ -20,19 +22,41 @@ func Authenticate(a *auth.Auth) web.Middleware {
 
 		// Create the handler that will be attached in the middleware chain.
 		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			traceID := web.GetTraceID(ctx)
+
+			// Scripts and devices can send their key in its own header.
+			if key := r.Header.Get("X-API-Key"); key != "" {
+				claims, err := a.ValidateAPIKey(ctx, traceID, key)
+				if err != nil {
+					return webv1.NewRequestError(err, http.StatusUnauthorized)
+				}
+				return handler(auth.SetClaims(ctx, claims), w, r)
+			}
 
-			// Expecting: bearer <token>
+			// Expecting: bearer <token> or apikey <key>
 			authStr := r.Header.Get("authorization")
 
 			// Parse the authorization header.
 			parts := strings.Split(authStr, " ")
-			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			if len(parts) != 2 {
 				err := errors.New("expected authorization header format: bearer <token>")
 				return webv1.NewRequestError(err, http.StatusUnauthorized)
 			}
 
-			// Validate the token is signed by us.
-			claims, err := a.ValidateToken(parts[1])
+			var claims auth.Claims
+			var err error
+			switch strings.ToLower(parts[0]) {
+			case "bearer":
+
+				// Validate the token is signed by us. The token is kept so it
+				// can be forwarded to the database.
+				claims, err = a.ValidateToken(parts[1])
+				ctx = auth.SetToken(ctx, parts[1])
+			case "apikey":
+				claims, err = a.ValidateAPIKey(ctx, traceID, parts[1])
+			default:
+				err = errors.New("expected authorization header format: bearer <token>")
+			}
 			if err != nil {
 				return webv1.NewRequestError(err, http.StatusUnauthorized)
 			}
@@ -52,7 +76,8 @@ func Authenticate(a *auth.Auth) web.Middleware {
 
 // Authorize validates that an authenticated user has at least one role from a
 // specified list. This method constructs the actual function that is used.
-func Authorize(roles ...string) web.Middleware {
+// Denied requests are recorded by the auditor.
+func Authorize(aud *audit.Auditor, roles ...string) web.Middleware {
 
 	// This is the actual middleware function to be executed.
 	m := func(handler web.Handler) web.Handler {
@@ -70,6 +95,12 @@ func Authorize(roles ...string) web.Middleware {
 			}
 
 			if !claims.Authorized(roles...) {
+				aud.Record(ctx, r, audit.Event{
+					Action:  audit.ActionAuthorize,
+					Target:  r.Method + " " + r.URL.Path,
+					Outcome: audit.OutcomeDenied,
+					Detail:  fmt.Sprintf("roles[%v] required[%v]", claims.Roles, roles),
+				})
 				return webv1.NewRequestError(
 					fmt.Errorf("you are not authorized for that action, claims[%v] roles[%v]", claims.Roles, roles),
 					http.StatusForbidden,
@@ -84,3 +115,130 @@ func Authorize(roles ...string) web.Middleware {
 
 	return m
 }
+
+// RequireLogin refuses callers that authenticated with an API key. Routes
+// that manage credentials use it, so a key can't be used to issue keys or
+// change the second factor of its owner. Denied requests are recorded by
+// the auditor.
+func RequireLogin(aud *audit.Auditor) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+			// If the context is missing this value return failure.
+			claims, err := auth.GetClaims(ctx)
+			if err != nil {
+				return webv1.NewRequestError(
+					fmt.Errorf("you are not authorized for that action, no claims"),
+					http.StatusForbidden,
+				)
+			}
+
+			if claims.HasAMR(auth.AMRAPIKey) {
+				aud.Record(ctx, r, audit.Event{
+					Action:  audit.ActionAuthorize,
+					Target:  r.Method + " " + r.URL.Path,
+					Outcome: audit.OutcomeDenied,
+					Detail:  "api key",
+				})
+				return webv1.NewRequestError(
+					errors.New("you are not authorized for that action with an api key, log in instead"),
+					http.StatusForbidden,
+				)
+			}
+
+			return handler(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// RequireGlobal refuses callers whose token is limited to an organization.
+// Routes that reach beyond a single organization, like the audit trail, use
+// it so an admin of one organization can't see into the others. Denied
+// requests are recorded by the auditor.
+func RequireGlobal(aud *audit.Auditor) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+			// If the context is missing this value return failure.
+			claims, err := auth.GetClaims(ctx)
+			if err != nil {
+				return webv1.NewRequestError(
+					fmt.Errorf("you are not authorized for that action, no claims"),
+					http.StatusForbidden,
+				)
+			}
+
+			if claims.Tenant != "" {
+				aud.Record(ctx, r, audit.Event{
+					Action:  audit.ActionAuthorize,
+					Target:  r.Method + " " + r.URL.Path,
+					Outcome: audit.OutcomeDenied,
+					Detail:  "tenant " + claims.Tenant,
+				})
+				return webv1.NewRequestError(
+					errors.New("you are not authorized for that action with a token limited to an organization"),
+					http.StatusForbidden,
+				)
+			}
+
+			return handler(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// RequireScope validates that an authenticated user holds every one of the
+// specified scopes. Denied requests are recorded by the auditor.
+func RequireScope(aud *audit.Auditor, scopes ...string) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+
+			// If the context is missing this value return failure.
+			claims, err := auth.GetClaims(ctx)
+			if err != nil {
+				return webv1.NewRequestError(
+					fmt.Errorf("you are not authorized for that action, no claims"),
+					http.StatusForbidden,
+				)
+			}
+
+			if !claims.HasScopes(scopes...) {
+				aud.Record(ctx, r, audit.Event{
+					Action:  audit.ActionAuthorize,
+					Target:  r.Method + " " + r.URL.Path,
+					Outcome: audit.OutcomeDenied,
+					Detail:  fmt.Sprintf("scopes[%v] required[%v]", claims.Scopes, scopes),
+				})
+				return webv1.NewRequestError(
+					fmt.Errorf("you are not authorized for that action, claims[%v] scopes[%v]", claims.Scopes, scopes),
+					http.StatusForbidden,
+				)
+			}
+
+			return handler(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return m
+}
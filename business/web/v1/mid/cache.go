@@ -0,0 +1,28 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// CacheControl sets the Cache-Control header of the responses of the route,
+// which tells browsers and proxies whether, and for how long, they can keep
+// them. Middleware closer to the route overrides the policy of its group.
+func CacheControl(policy string) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Cache-Control", policy)
+			return handler(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return m
+}
@@ -0,0 +1,240 @@
+package mid
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+// Compressor compresses response bodies with a content coding, like gzip.
+// Other codings, like brotli, are added by implementing it.
+type Compressor interface {
+
+	// Encoding is the name of the coding in the Accept-Encoding and
+	// Content-Encoding headers.
+	Encoding() string
+
+	// NewWriter returns a writer that compresses into w. Closing it flushes
+	// what's left without closing w.
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+// Gzip returns the gzip Compressor at the compression level, one of the
+// levels of compress/gzip. Invalid levels use the default.
+func Gzip(level int) Compressor {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		level = gzip.DefaultCompression
+	}
+	return gzipCompressor{level: level}
+}
+
+// gzipCompressor compresses with gzip.
+type gzipCompressor struct {
+	level int
+}
+
+// Encoding implements the Compressor interface.
+func (g gzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+// NewWriter implements the Compressor interface.
+func (g gzipCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	zw, _ := gzip.NewWriterLevel(w, g.level)
+	return zw
+}
+
+// CompressConfig represents how responses are compressed.
+type CompressConfig struct {
+
+	// MinSize is the smallest body in bytes that gets compressed, smaller
+	// ones aren't worth it.
+	MinSize int
+
+	// Compressors are the codings offered, the preferred first.
+	Compressors []Compressor
+}
+
+// Compress compresses the body of responses with the coding the client
+// prefers out of the configured ones. Without any compressors responses are
+// sent as they are.
+func Compress(cfg CompressConfig) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+		if len(cfg.Compressors) == 0 {
+			return handler
+		}
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			c := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Compressors)
+			if c == nil {
+				return handler(ctx, w, r)
+			}
+
+			cw := compressWriter{
+				ResponseWriter: w,
+				compressor:     c,
+				minSize:        cfg.MinSize,
+			}
+			err := handler(ctx, &cw, r)
+			if cerr := cw.close(); err == nil {
+				err = cerr
+			}
+
+			return err
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// negotiateEncoding returns the compressor of the coding the client
+// prefers, nil when it accepts none of them.
+func negotiateEncoding(accept string, compressors []Compressor) Compressor {
+	var best Compressor
+	var bestQ float64
+
+	for _, c := range compressors {
+		if q := encodingQ(accept, c.Encoding()); q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+
+	return best
+}
+
+// encodingQ returns how much the Accept-Encoding header wants the coding,
+// from 0 for not at all to 1.
+func encodingQ(accept string, encoding string) float64 {
+	q := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		pq := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					pq = v
+				}
+			}
+		}
+
+		// The coding named outright wins over the wildcard.
+		if name == encoding {
+			return pq
+		}
+		q = pq
+	}
+
+	return q
+}
+
+// compressWriter holds back the status of the response until the first
+// write, when it's known whether the body is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor  Compressor
+	minSize     int
+	status      int
+	wroteHeader bool
+	zw          io.WriteCloser
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+// Write implements the io.Writer interface.
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.start(len(p))
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// start decides whether to compress the body, which starts with size bytes,
+// and writes the header.
+func (cw *compressWriter) start(size int) {
+	cw.wroteHeader = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if size >= cw.minSize && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.compressor.Encoding())
+		h.Del("Content-Length")
+
+		cw.weakenETag()
+		cw.zw = cw.compressor.NewWriter(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// close finishes the compressed body, or writes the header of responses
+// without one.
+func (cw *compressWriter) close() error {
+	if !cw.wroteHeader {
+
+		// The client has the compressed body, which is tagged as such.
+		if cw.status == http.StatusNotModified {
+			cw.weakenETag()
+		}
+		if cw.status != 0 {
+			cw.ResponseWriter.WriteHeader(cw.status)
+		}
+		return nil
+	}
+
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
+
+// weakenETag marks the tag of the response as weak. The compressed body is
+// another representation, so it can't keep a strong tag of the body.
+func (cw *compressWriter) weakenETag() {
+	if etag := cw.Header().Get("ETag"); strings.HasPrefix(etag, `"`) {
+		cw.Header().Set("ETag", "W/"+etag)
+	}
+}
+
+// compressible reports whether bodies of the media type get smaller when
+// compressed. Images and the like already are.
+func compressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "json"):
+		return true
+	case mediaType == "application/msgpack", mediaType == "application/xml":
+		return true
+	}
+	return false
+}
@@ -2,9 +2,13 @@ package mid
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
 	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/trace"
 	"github.com/jnkroeker/makulu/foundation/web"
 	"go.uber.org/zap"
 )
@@ -37,6 +41,45 @@ func Errors(log *zap.SugaredLogger) web.Middleware {
 				// Build out the error response
 				var er validate.ErrorResponse
 				var status int
+
+				// The database is down, the client can try again later.
+				if data.IsUnavailable(err) {
+					err = validate.NewRequestError(data.ErrUnavailable, http.StatusServiceUnavailable)
+				}
+
+				// The client made too many requests, RateLimit told it when to
+				// try again.
+				if errors.Is(err, ratelimit.ErrLimited) {
+					err = validate.NewRequestError(ratelimit.ErrLimited, http.StatusTooManyRequests)
+				}
+
+				// The client only accepts media types the response can't be
+				// sent in.
+				if errors.Is(err, web.ErrNotAcceptable) {
+					err = validate.NewRequestError(web.ErrNotAcceptable, http.StatusNotAcceptable)
+				}
+
+				// Changes must say which version of the entity they change,
+				// and fail when it changed since.
+				if errors.Is(err, web.ErrPreconditionRequired) {
+					err = validate.NewRequestError(web.ErrPreconditionRequired, http.StatusPreconditionRequired)
+				}
+				if errors.Is(err, data.ErrConflict) {
+					err = validate.NewRequestError(data.ErrConflict, http.StatusPreconditionFailed)
+				}
+
+				// The body was larger than the App allows.
+				if errors.Is(err, web.ErrBodyTooLarge) {
+					err = validate.NewRequestError(web.ErrBodyTooLarge, http.StatusRequestEntityTooLarge)
+				}
+
+				// The body couldn't be decoded, tell the client where it went
+				// wrong like any other invalid field.
+				var decodeErr *web.DecodeError
+				if errors.As(err, &decodeErr) {
+					err = validate.FieldErrors{{Field: decodeErr.Field, Error: decodeErr.Message}}
+				}
+
 				switch act := validate.Cause(err).(type) {
 				// always use pointer semantics for the implementation of the Error interface
 				// unless the type of the error we are creating is a slice
@@ -66,6 +109,11 @@ func Errors(log *zap.SugaredLogger) web.Middleware {
 					status = http.StatusInternalServerError
 				}
 
+				// Mark the span of the request as failed and let the client
+				// know which trace to look for.
+				trace.FromContext(ctx).SetError(err)
+				er.TraceID = v.TraceID
+
 				// Respond with the error back to the client
 				if err := web.Respond(ctx, w, er, status); err != nil {
 					return err
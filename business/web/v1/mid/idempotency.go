@@ -0,0 +1,212 @@
+package mid
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"go.uber.org/zap"
+)
+
+// storeTimeout is how long the store gets to release a key or keep a
+// response once the request is done.
+const storeTimeout = 5 * time.Second
+
+// Idempotency keeps the response to a request with an Idempotency-Key header
+// for the window and replays it to retries with the same key, so clients can
+// safely retry requests that create things. Keys are kept per user and
+// route. A retry with another body is rejected with 422, and one made while
+// the first request is still running with 409. Requests that fail aren't
+// kept, so they can be retried. Credentials are removed from the responses
+// that are kept. A nil store lets every request through.
+func Idempotency(log *zap.SugaredLogger, store idempotency.Store, window time.Duration) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+		if store == nil {
+			return handler
+		}
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				return handler(ctx, w, r)
+			}
+			if len(key) > idempotency.MaxKeyLength {
+				return validate.NewRequestError(idempotency.ErrInvalidKey, http.StatusBadRequest)
+			}
+
+			v, err := web.GetValues(ctx)
+			if err != nil {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			// The body is read up front to tell retries from other requests
+			// with the key, and handed to the handler again.
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			rec := idempotency.Record{
+				Key:         idempotency.Key(owner(ctx, r), r.Method, r.URL.Path, key),
+				Fingerprint: idempotency.Fingerprint(body),
+				Expires:     v.Now.Add(window),
+			}
+
+			existing, reserved, err := store.Reserve(ctx, rec, v.Now)
+			if err != nil {
+
+				// A store that can't be reached shouldn't take the api down
+				// with it, so the request is let through.
+				log.Warnw("idempotency", "traceid", v.TraceID, "ERROR", err)
+				return handler(ctx, w, r)
+			}
+
+			if !reserved {
+				switch {
+				case existing.Fingerprint != rec.Fingerprint:
+					return validate.NewRequestError(idempotency.ErrMismatch, http.StatusUnprocessableEntity)
+				case !existing.Done():
+					return validate.NewRequestError(idempotency.ErrInProgress, http.StatusConflict)
+				}
+				return replay(ctx, w, existing)
+			}
+
+			// The key is released unless the response is kept, even when the
+			// handler panics, so retries aren't turned away for the window.
+			// The request can fail because its deadline passed, which mustn't
+			// keep the key from being released or the response from being
+			// kept.
+			kept := false
+			defer func() {
+				if kept {
+					return
+				}
+
+				sctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+				defer cancel()
+
+				if err := store.Release(sctx, rec.Key); err != nil {
+					log.Warnw("idempotency", "traceid", v.TraceID, "ERROR", err)
+				}
+			}()
+
+			rw := newRecorder(w)
+			if err := handler(ctx, rw, r); err != nil {
+				return err
+			}
+
+			// Handlers that write nothing get the status the server sends.
+			if rw.status == 0 {
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			sctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			defer cancel()
+
+			// Credentials in the response aren't kept, and responses that
+			// can't be looked into aren't kept at all.
+			body, ok := idempotency.Redact(rw.body.Bytes(), rw.header.Get("Content-Type"))
+			if !ok {
+				log.Infow("idempotency", "traceid", v.TraceID, "message", "response not kept, its body can't be redacted")
+				return nil
+			}
+
+			// The tag of the response no longer matches what is replayed.
+			if !bytes.Equal(body, rw.body.Bytes()) {
+				rw.header.Del("ETag")
+			}
+
+			rec.Status, rec.Header, rec.Body = rw.status, rw.header, body
+			if err := store.Complete(sctx, rec); err != nil {
+				log.Warnw("idempotency", "traceid", v.TraceID, "ERROR", err)
+				return nil
+			}
+			kept = true
+
+			return nil
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// owner identifies who the keys of a request belong to.
+func owner(ctx context.Context, r *http.Request) string {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return "ip:" + web.ClientIP(r)
+	}
+	return "user:" + claims.Subject
+}
+
+// replay sends the kept response again.
+func replay(ctx context.Context, w http.ResponseWriter, rec idempotency.Record) error {
+	for k, vs := range rec.Header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+
+	web.SetStatusCode(ctx, rec.Status)
+	w.WriteHeader(rec.Status)
+
+	_, err := w.Write(rec.Body)
+	return err
+}
+
+// recorder keeps a copy of the response the handler writes. Only headers
+// the handler set are kept, the ones set before are set again for a replay.
+type recorder struct {
+	http.ResponseWriter
+	before map[string]bool
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// newRecorder constructs a recorder of what is written to w from now on.
+func newRecorder(w http.ResponseWriter) *recorder {
+	before := make(map[string]bool)
+	for k := range w.Header() {
+		before[k] = true
+	}
+
+	return &recorder{
+		ResponseWriter: w,
+		before:         before,
+	}
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (rw *recorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+		rw.header = make(http.Header)
+		for k, vs := range rw.Header() {
+			if !rw.before[k] {
+				rw.header[k] = append([]string(nil), vs...)
+			}
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the io.Writer interface.
+func (rw *recorder) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
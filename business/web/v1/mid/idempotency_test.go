@@ -0,0 +1,173 @@
+package mid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/data/idempotency"
+	"github.com/jnkroeker/makulu/business/web/v1/mid"
+	"github.com/jnkroeker/makulu/foundation/tests"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// idempotent returns an app serving POST /v1/users with the handler behind
+// the middleware, and a function sending a request with the key and body.
+func idempotent(store idempotency.Store, handler web.Handler) func(key string, body string) *httptest.ResponseRecorder {
+	log := zap.NewNop().Sugar()
+	app := web.NewApp(make(chan os.Signal, 1), mid.Errors(log), mid.Panics())
+	app.Handle(http.MethodPost, "v1", "/users", handler, mid.Idempotency(log, store, time.Hour))
+
+	return func(key string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	type user struct {
+		ID           string `json:"id"`
+		PasswordHash string `json:"password_hash"`
+	}
+
+	t.Log("Given the need to let clients retry requests that create things.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a request is retried with its key.", testID)
+		{
+			var calls int
+			send := idempotent(idempotency.NewMemory(), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				calls++
+				return web.Respond(ctx, w, user{ID: "1", PasswordHash: "$2a$10$x"}, http.StatusCreated)
+			})
+
+			first := send("a", `{"name":"Jill"}`)
+			retry := send("a", `{"name":"Jill"}`)
+
+			if calls != 1 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, calls)
+				t.Fatalf("\t%s\tTest %d:\tShould run the request once.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould run the request once.", tests.Success, testID)
+
+			if retry.Code != first.Code || retry.Header().Get("Idempotent-Replayed") != "true" {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, retry.Code)
+				t.Fatalf("\t%s\tTest %d:\tShould replay the response.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould replay the response.", tests.Success, testID)
+
+			if strings.Contains(retry.Body.String(), "password_hash") || !strings.Contains(retry.Body.String(), `"id":"1"`) {
+				t.Logf("\t\tTest %d:\tgot: %s", testID, retry.Body.String())
+				t.Fatalf("\t%s\tTest %d:\tShould not keep the credentials of the response.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not keep the credentials of the response.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the key is used with another body.", testID)
+		{
+			send := idempotent(idempotency.NewMemory(), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return web.Respond(ctx, w, user{ID: "1"}, http.StatusCreated)
+			})
+
+			send("a", `{"name":"Jill"}`)
+			if w := send("a", `{"name":"Jack"}`); w.Code != http.StatusUnprocessableEntity {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, w.Code)
+				t.Fatalf("\t%s\tTest %d:\tShould refuse the request with 422.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse the request with 422.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the key is used while the request is running.", testID)
+		{
+			started, finish := make(chan struct{}), make(chan struct{})
+			send := idempotent(idempotency.NewMemory(), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				close(started)
+				<-finish
+				return web.Respond(ctx, w, user{ID: "1"}, http.StatusCreated)
+			})
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				send("a", `{"name":"Jill"}`)
+			}()
+			<-started
+
+			w := send("a", `{"name":"Jill"}`)
+			close(finish)
+			wg.Wait()
+
+			if w.Code != http.StatusConflict {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, w.Code)
+				t.Fatalf("\t%s\tTest %d:\tShould refuse the request with 409.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse the request with 409.", tests.Success, testID)
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the request fails.", testID)
+		{
+			tt := []struct {
+				name    string
+				handler func() error
+			}{
+				{"panic", func() error { panic("boom") }},
+				{"error", func() error { return errors.New("boom") }},
+			}
+
+			for _, tst := range tt {
+				var calls int
+				send := idempotent(idempotency.NewMemory(), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					calls++
+					if calls == 1 {
+						return tst.handler()
+					}
+					return web.Respond(ctx, w, user{ID: "1"}, http.StatusCreated)
+				})
+
+				send("a", `{"name":"Jill"}`)
+				if w := send("a", `{"name":"Jill"}`); w.Code != http.StatusCreated || calls != 2 {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, w.Code)
+					t.Fatalf("\t%s\tTest %d:\tShould release the key after a %s.", tests.Failed, testID, tst.name)
+				}
+				t.Logf("\t%s\tTest %d:\tShould release the key after a %s.", tests.Success, testID, tst.name)
+			}
+		}
+
+		testID++
+		t.Logf("\tTest %d:\tWhen the response can't be looked into.", testID)
+		{
+			var calls int
+			send := idempotent(idempotency.NewMemory(), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				calls++
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.WriteHeader(http.StatusCreated)
+				_, err := w.Write([]byte("secret"))
+				return err
+			})
+
+			send("a", `{"name":"Jill"}`)
+			send("a", `{"name":"Jill"}`)
+
+			if calls != 2 {
+				t.Logf("\t\tTest %d:\tgot: %v", testID, calls)
+				t.Fatalf("\t%s\tTest %d:\tShould not keep the response.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not keep the response.", tests.Success, testID)
+		}
+	}
+}
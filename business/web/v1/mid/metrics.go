@@ -3,11 +3,14 @@ package mid
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/jnkroeker/makulu/business/sys/metrics"
 	"github.com/jnkroeker/makulu/foundation/web"
 )
 
+// Metrics updates the metrics of the application for every request. It has
+// to run outside of Errors to see the status of the response.
 func Metrics() web.Middleware {
 
 	// This is the actual middleware function to be executed
@@ -16,20 +19,33 @@ func Metrics() web.Middleware {
 		// Create the handler that will be attached in the middleware chain.
 		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 
+			v, err := web.GetValues(ctx)
+			if err != nil {
+				return web.NewShutdownError("web value missing from context")
+			}
+
 			// Add the metrics to the context for metrics gathering
 			ctx = metrics.Set(ctx)
 
 			// Call the next handler
-			err := handler(ctx, w, r)
+			err = handler(ctx, w, r)
 
 			// Handle updating the metrics that can be handled here
 
-			// Increment the request and goroutines counter
+			// Nothing written means the default status of net/http.
+			status := v.StatusCode
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			// Increment the request counter and record the latency by route
 			metrics.AddRequests(ctx)
-			metrics.AddGoroutines(ctx)
+			metrics.ObserveRequest(ctx, v.Route, r.Method, status, time.Since(v.Now))
 
-			// Increment if there is an error flowing through the request
-			if err != nil {
+			// Increment if there is an error flowing through the request.
+			// Errors are turned into responses before they get here, so
+			// these are the responses that report one.
+			if err != nil || status >= http.StatusBadRequest {
 				metrics.AddErrors(ctx)
 			}
 
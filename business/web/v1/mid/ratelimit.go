@@ -0,0 +1,112 @@
+package mid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/auth"
+	"github.com/jnkroeker/makulu/business/sys/metrics"
+	"github.com/jnkroeker/makulu/business/sys/ratelimit"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"go.uber.org/zap"
+)
+
+// RateLimit limits how often a client can call the route. Clients are told
+// about their limit in the RateLimit headers and rejected with 429 once it
+// is used up. The middleware goes after Authenticate so authenticated
+// clients are limited by who they are rather than their address. A nil
+// limiter lets every request through.
+func RateLimit(log *zap.SugaredLogger, l *ratelimit.Limiter) web.Middleware {
+	return rateLimit(log, l, client)
+}
+
+// RateLimitAddress limits how often an address can call the route whoever
+// the caller claims to be. It goes before Authenticate, so requests with bad
+// tokens or unknown API keys are limited before they cost a lookup in the
+// database. A nil limiter lets every request through.
+func RateLimitAddress(log *zap.SugaredLogger, l *ratelimit.Limiter) web.Middleware {
+	address := func(ctx context.Context, r *http.Request) string {
+		return "ip:" + web.ClientIP(r)
+	}
+
+	return rateLimit(log, l, address)
+}
+
+// rateLimit limits the clients the function identifies.
+func rateLimit(log *zap.SugaredLogger, l *ratelimit.Limiter, client func(ctx context.Context, r *http.Request) string) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+		if l == nil {
+			return handler
+		}
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			v, err := web.GetValues(ctx)
+			if err != nil {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			res, err := l.Take(ctx, r.Method, v.Route, client(ctx, r), v.Now)
+			if err != nil {
+
+				// A store that can't be reached shouldn't take the api down
+				// with it, so the request is let through.
+				log.Warnw("ratelimit", "traceid", v.TraceID, "ERROR", err)
+				return handler(ctx, w, r)
+			}
+
+			if res.Limit > 0 {
+				w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+				w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+				w.Header().Set("RateLimit-Reset", ceilSeconds(res.Reset))
+			}
+
+			if !res.Allowed {
+				metrics.AddRateLimited(ctx, v.Route)
+				w.Header().Set("Retry-After", ceilSeconds(res.RetryAfter))
+				return ratelimit.ErrLimited
+			}
+
+			return handler(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// client identifies the caller for rate limiting. Every API key has its own
+// limit, other authenticated callers are limited by user and everyone else
+// by address. Keys are hashed so they are never handed to the store.
+func client(ctx context.Context, r *http.Request) string {
+	claims, err := auth.GetClaims(ctx)
+	if err != nil {
+		return "ip:" + web.ClientIP(r)
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if parts := strings.Fields(r.Header.Get("Authorization")); key == "" && len(parts) == 2 && strings.EqualFold(parts[0], "apikey") {
+		key = parts[1]
+	}
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+
+	return "user:" + claims.Subject
+}
+
+// ceilSeconds formats the duration as whole seconds, rounded up so clients
+// waiting that long find the limit reset.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,118 @@
+package mid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/metrics"
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"go.uber.org/zap"
+)
+
+// ErrTimeout is returned for requests that ran past the deadline of their
+// route.
+var ErrTimeout = errors.New("request took too long")
+
+// TimeoutConfig contains how long requests to the routes may take. Routes
+// are named by method and path, as in "GET /v1/audit", and the ones not
+// named get the default. A route without a duration has no deadline.
+type TimeoutConfig struct {
+	Default time.Duration
+	Routes  map[string]time.Duration
+}
+
+// Timeout gives every request the deadline of its route. The deadline is
+// carried by the context, so the stores pass it on to the database and give
+// up once it passes. A request that failed because it ran out of time is
+// answered with 504. The deadline can't stop a handler that doesn't watch
+// its context.
+func Timeout(log *zap.SugaredLogger, cfg TimeoutConfig) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	m := func(handler web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			v, err := web.GetValues(ctx)
+			if err != nil {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			d, ok := cfg.Routes[r.Method+" "+v.Route]
+			if !ok {
+				d = cfg.Default
+			}
+			if d <= 0 {
+				return handler(ctx, w, r)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			// Errors the handler returned for other reasons, like a bad
+			// request, are passed on even when the deadline passed since.
+			err = handler(ctx, w, r)
+			if err == nil || !timedOut(ctx, err) {
+				return err
+			}
+
+			// The error only says what was cut off, the client is told the
+			// request took too long.
+			metrics.AddTimeouts(ctx, v.Route)
+			log.Infow("timeout", "traceid", v.TraceID, "method", r.Method, "route", v.Route, "timeout", d, "ERROR", err)
+
+			return validate.NewRequestError(ErrTimeout, http.StatusGatewayTimeout)
+		}
+
+		return h
+	}
+
+	return m
+}
+
+// timedOut reports whether the error was caused by the deadline of the
+// context. Either the deadline passed and the error says so, or the error
+// gave up on that deadline early, like the database client does when it
+// can't try again in time.
+func timedOut(ctx context.Context, err error) bool {
+	deadline, ok := deadlineExceeded(err)
+	if !ok {
+		return false
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+
+	own, ok := ctx.Deadline()
+	return ok && !deadline.IsZero() && deadline.Equal(own)
+}
+
+// deadlineExceeded reports whether the error, or any error it wraps, is
+// context.DeadlineExceeded. Errors that gave up before the deadline passed
+// return the deadline they gave up on.
+func deadlineExceeded(err error) (time.Time, bool) {
+	for err != nil {
+		if d, ok := err.(interface{ Deadline() time.Time }); ok {
+			return d.Deadline(), true
+		}
+		if err == context.DeadlineExceeded {
+			return time.Time{}, true
+		}
+
+		// Errors wrapped by github.com/pkg/errors only expose Cause.
+		if next := errors.Unwrap(err); next != nil {
+			err = next
+			continue
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return time.Time{}, false
+		}
+		err = c.Cause()
+	}
+	return time.Time{}, false
+}
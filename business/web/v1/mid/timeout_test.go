@@ -0,0 +1,123 @@
+package mid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/business/sys/validate"
+	"github.com/jnkroeker/makulu/business/web/v1/mid"
+	"github.com/jnkroeker/makulu/foundation/tests"
+	"github.com/jnkroeker/makulu/foundation/web"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// earlyError gives up on a deadline before it passed, like the database
+// client does when it can't try again in time.
+type earlyError struct {
+	deadline time.Time
+}
+
+func (e *earlyError) Error() string       { return "no time left to retry" }
+func (e *earlyError) Unwrap() error       { return context.DeadlineExceeded }
+func (e *earlyError) Deadline() time.Time { return e.deadline }
+
+func TestTimeout(t *testing.T) {
+	wait := func(err error) web.Handler {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			<-ctx.Done()
+			return err
+		}
+	}
+
+	tt := []struct {
+		name    string
+		route   time.Duration
+		handler web.Handler
+		status  int
+	}{
+		{
+			"deadline passed",
+			10 * time.Millisecond,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				<-ctx.Done()
+				return errors.Wrap(ctx.Err(), "querying users")
+			},
+			http.StatusGatewayTimeout,
+		},
+		{
+			"other error after the deadline",
+			10 * time.Millisecond,
+			wait(validate.NewRequestError(errors.New("invalid id"), http.StatusBadRequest)),
+			http.StatusBadRequest,
+		},
+		{
+			"gave up on the deadline early",
+			time.Hour,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				deadline, _ := ctx.Deadline()
+				return errors.Wrap(&earlyError{deadline: deadline}, "querying users")
+			},
+			http.StatusGatewayTimeout,
+		},
+		{
+			"gave up on another deadline early",
+			time.Hour,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return &earlyError{deadline: time.Now().Add(time.Minute)}
+			},
+			http.StatusInternalServerError,
+		},
+		{
+			"no deadline",
+			0,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				if _, ok := ctx.Deadline(); ok {
+					return errors.New("route has a deadline")
+				}
+				return web.Respond(ctx, w, nil, http.StatusNoContent)
+			},
+			http.StatusNoContent,
+		},
+		{
+			"no deadline, deadline error",
+			0,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return context.DeadlineExceeded
+			},
+			http.StatusInternalServerError,
+		},
+	}
+
+	t.Log("Given the need to answer requests that took too long with 504.")
+	{
+		for testID, tst := range tt {
+			t.Logf("\tTest %d:\tWhen the handler returns for %q.", testID, tst.name)
+			{
+				log := zap.NewNop().Sugar()
+				app := web.NewApp(make(chan os.Signal, 1),
+					mid.Errors(log),
+					mid.Timeout(log, mid.TimeoutConfig{
+						Default: time.Hour,
+						Routes:  map[string]time.Duration{"GET /v1/test": tst.route},
+					}),
+				)
+				app.Handle(http.MethodGet, "v1", "/test", tst.handler)
+
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/test", nil))
+
+				if w.Code != tst.status {
+					t.Logf("\t\tTest %d:\tgot: %v", testID, w.Code)
+					t.Logf("\t\tTest %d:\texp: %v", testID, tst.status)
+					t.Fatalf("\t%s\tTest %d:\tShould answer with the expected status.", tests.Failed, testID)
+				}
+				t.Logf("\t%s\tTest %d:\tShould answer with the expected status.", tests.Success, testID)
+			}
+		}
+	}
+}
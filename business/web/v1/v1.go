@@ -1,6 +1,14 @@
 // Package v1 represents types used by the web application for v1.
 package v1
 
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jnkroeker/makulu/business/data"
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
 type RequestError struct {
 	Err    error
 	Status int
@@ -17,3 +25,37 @@ func NewRequestError(err error, status int) error {
 func (err *RequestError) Error() string {
 	return err.Err.Error()
 }
+
+// Token is the response to a successful login.
+type Token struct {
+	Token string `json:"token"`
+}
+
+// Challenge is the response to a login of a user with a second factor. The
+// challenge is exchanged for a token along with a code of the factor.
+type Challenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	Challenge   string `json:"challenge"`
+}
+
+// Version returns the version of the entity the request changes, from its
+// If-Match header. Tags that aren't a version match no entity.
+func Version(r *http.Request) (int, error) {
+	tag, err := web.IfMatch(r)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(tag)
+	if err != nil {
+		return 0, data.ErrConflict
+	}
+
+	return version, nil
+}
+
+// SetVersion tags the response with the version of the entity it holds, so
+// the client can send it back with a change.
+func SetVersion(w http.ResponseWriter, version int) {
+	web.SetETag(w, strconv.Itoa(version))
+}
@@ -0,0 +1,99 @@
+// Package geojson encodes values with a location as GeoJSON features, the
+// format map libraries draw from.
+package geojson
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// MediaType is the media type of GeoJSON bodies.
+const MediaType = "application/geo+json"
+
+// Geometry represents the shape of a feature.
+type Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// Point constructs the geometry of a single location. GeoJSON puts the
+// longitude first.
+func Point(lat float64, lng float64) Geometry {
+	return Geometry{
+		Type:        "Point",
+		Coordinates: []float64{lng, lat},
+	}
+}
+
+// Feature represents a located value.
+type Feature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Geometry   Geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// FeatureCollection represents a list of located values.
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// Featurer is implemented by values with a location.
+type Featurer interface {
+	Feature() Feature
+}
+
+var featurerType = reflect.TypeOf((*Featurer)(nil)).Elem()
+
+// =============================================================================
+
+// Encoder lets web.Respond send GeoJSON to clients that accept it. A single
+// Featurer is encoded as a Feature and a slice of them as a FeatureCollection.
+type Encoder struct{}
+
+// MediaType implements the web.Encoder interface.
+func (Encoder) MediaType() string {
+	return MediaType
+}
+
+// Encodes implements the web.Encoder interface.
+func (Encoder) Encodes(v interface{}) bool {
+	if _, ok := v.(Featurer); ok {
+		return true
+	}
+
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+		return false
+	}
+	return t.Elem().Implements(featurerType)
+}
+
+// Encode implements the web.Encoder interface.
+func (Encoder) Encode(v interface{}) ([]byte, error) {
+	if f, ok := v.(Featurer); ok {
+		return json.Marshal(feature(f))
+	}
+
+	list := reflect.ValueOf(v)
+	fc := FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]Feature, list.Len()),
+	}
+	for i := range fc.Features {
+		fc.Features[i] = feature(list.Index(i).Interface().(Featurer))
+	}
+
+	return json.Marshal(fc)
+}
+
+// feature returns the feature of the value with its type set.
+func feature(f Featurer) Feature {
+	ft := f.Feature()
+	ft.Type = "Feature"
+	if ft.Properties == nil {
+		ft.Properties = make(map[string]interface{})
+	}
+	return ft
+}
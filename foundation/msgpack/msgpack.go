@@ -0,0 +1,202 @@
+// Package msgpack encodes values as MessagePack, a binary form of JSON that
+// is smaller and faster to parse on mobile clients.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MediaType is the media type of MessagePack bodies.
+const MediaType = "application/msgpack"
+
+// Marshal returns the MessagePack encoding of the value. The value is
+// encoded the way encoding/json sees it, so field names, omitempty and
+// MarshalJSON methods apply as they do to JSON responses.
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes a value decoded by encoding/json.
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		return encodeNumber(buf, v)
+	case string:
+		encodeString(buf, v)
+	case []interface{}:
+		writeHeader(buf, len(v), 0x90, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+
+		// Keys are sorted so the same value always has the same encoding.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeHeader(buf, len(v), 0x80, 0xde, 0xdf)
+		for _, k := range keys {
+			encodeString(buf, k)
+			if err := encode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// encodeNumber writes the number as the smallest integer that holds it, or
+// as a float when it isn't an integer.
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		encodeInt(buf, i)
+		return nil
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("msgpack: number %s: %w", n, err)
+	}
+
+	// Integers beyond int64 that still fit a uint64.
+	if f >= 0 && f == math.Trunc(f) && f < math.MaxUint64 {
+		var u uint64
+		if _, err := fmt.Sscan(string(n), &u); err == nil {
+			buf.WriteByte(0xcf)
+			writeUint(buf, u, 8)
+			return nil
+		}
+	}
+
+	buf.WriteByte(0xcb)
+	writeUint(buf, math.Float64bits(f), 8)
+	return nil
+}
+
+// encodeInt writes the integer in the smallest of the integer formats.
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		writeUint(buf, uint64(i), 1)
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		writeUint(buf, uint64(i), 2)
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		writeUint(buf, uint64(i), 4)
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		writeUint(buf, uint64(i), 8)
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		writeUint(buf, uint64(i), 1)
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		writeUint(buf, uint64(i), 2)
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		writeUint(buf, uint64(i), 4)
+	default:
+		buf.WriteByte(0xd3)
+		writeUint(buf, uint64(i), 8)
+	}
+}
+
+// encodeString writes the string in the smallest of the string formats.
+func encodeString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		writeUint(buf, uint64(n), 1)
+	default:
+		writeHeader(buf, n, 0, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+// writeHeader writes the length of an array, map or string in the fix
+// format when it's small enough, otherwise with a 16 or 32 bit length. A
+// fix of zero means the type has no fix format for the length.
+func writeHeader(buf *bytes.Buffer, n int, fix byte, b16 byte, b32 byte) {
+	switch {
+	case fix != 0 && n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		writeUint(buf, uint64(n), 2)
+	default:
+		buf.WriteByte(b32)
+		writeUint(buf, uint64(n), 4)
+	}
+}
+
+// writeUint writes the low size bytes of the value in big endian order.
+func writeUint(buf *bytes.Buffer, v uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[8-size:])
+}
+
+// =============================================================================
+
+// Encoder lets web.Respond send MessagePack to clients that accept it.
+type Encoder struct{}
+
+// MediaType implements the web.Encoder interface.
+func (Encoder) MediaType() string {
+	return MediaType
+}
+
+// Encodes implements the web.Encoder interface.
+func (Encoder) Encodes(v interface{}) bool {
+	return true
+}
+
+// Encode implements the web.Encoder interface.
+func (Encoder) Encode(v interface{}) ([]byte, error) {
+	return Marshal(v)
+}
@@ -0,0 +1,53 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jnkroeker/makulu/foundation/msgpack"
+	"github.com/jnkroeker/makulu/foundation/tests"
+)
+
+func TestMarshal(t *testing.T) {
+	type point struct {
+		Name string  `json:"name"`
+		Lat  float64 `json:"lat"`
+		Org  string  `json:"org,omitempty"`
+	}
+
+	tt := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"true", true, []byte{0xc3}},
+		{"a positive fixint", 7, []byte{0x07}},
+		{"a negative fixint", -3, []byte{0xfd}},
+		{"a uint16", 300, []byte{0xcd, 0x01, 0x2c}},
+		{"an int8", -100, []byte{0xd0, 0x9c}},
+		{"a float", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"a fixstr", "hi", []byte{0xa2, 'h', 'i'}},
+		{"a fixarray", []int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{"a struct", point{Name: "a", Lat: 2}, []byte{0x82, 0xa3, 'l', 'a', 't', 0x02, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'a'}},
+	}
+
+	t.Log("Given the need to send responses as MessagePack.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen encoding %s.", testID, test.name)
+			{
+				got, err := msgpack.Marshal(test.v)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to encode the value: %v.", tests.Failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to encode the value.", tests.Success, testID)
+
+				if !bytes.Equal(got, test.want) {
+					t.Fatalf("\t%s\tTest %d:\tShould get % x, got % x.", tests.Failed, testID, test.want, got)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get the expected bytes.", tests.Success, testID)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// OTLP exports spans to a collector using OTLP over HTTP with JSON bodies.
+type OTLP struct {
+	url    string
+	client *http.Client
+}
+
+// NewOTLP constructs an exporter posting to the traces url of a collector,
+// usually http://host:4318/v1/traces.
+func NewOTLP(url string, client *http.Client) *OTLP {
+	return &OTLP{
+		url:    url,
+		client: client,
+	}
+}
+
+// Export implements the Exporter interface.
+func (o *OTLP) Export(ctx context.Context, service string, spans []SpanData) error {
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		Name              string      `json:"name"`
+		Kind              Kind        `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []attribute `json:"attributes,omitempty"`
+		Status            status      `json:"status"`
+	}
+
+	attributes := func(attrs map[string]string) []attribute {
+		keys := make([]string, 0, len(attrs))
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		list := make([]attribute, len(keys))
+		for i, k := range keys {
+			list[i] = attribute{Key: k, Value: value{StringValue: attrs[k]}}
+		}
+		return list
+	}
+
+	list := make([]span, len(spans))
+	for i, s := range spans {
+		list[i] = span{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+		}
+		if s.ParentID != (SpanID{}) {
+			list[i].ParentSpanID = s.ParentID.String()
+		}
+
+		// Status codes are 1 for ok and 2 for error.
+		list[i].Status.Code = 1
+		if s.Error != "" {
+			list[i].Status = status{Code: 2, Message: s.Error}
+		}
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]string{"service.name": service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/jnkroeker/makulu/foundation/trace"},
+						"spans": list,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("export spans: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// Writer exports spans as lines of JSON, for reading traces locally on
+// stdout or in a file.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter constructs an exporter writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: w,
+	}
+}
+
+// Export implements the Exporter interface.
+func (wr *Writer) Export(ctx context.Context, service string, spans []SpanData) error {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	enc := json.NewEncoder(wr.w)
+	for _, s := range spans {
+		line := struct {
+			Service    string            `json:"service"`
+			Name       string            `json:"name"`
+			TraceID    string            `json:"trace_id"`
+			SpanID     string            `json:"span_id"`
+			ParentID   string            `json:"parent_id,omitempty"`
+			Start      string            `json:"start"`
+			Duration   string            `json:"duration"`
+			Attributes map[string]string `json:"attributes,omitempty"`
+			Error      string            `json:"error,omitempty"`
+		}{
+			Service:    service,
+			Name:       s.Name,
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Start:      s.Start.UTC().Format("2006-01-02T15:04:05.000000Z"),
+			Duration:   s.End.Sub(s.Start).String(),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.ParentID != (SpanID{}) {
+			line.ParentID = s.ParentID.String()
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return fmt.Errorf("write span: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,439 @@
+// Package trace provides support for following a request through the
+// services it touches using W3C trace context.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace across services.
+type TraceID [16]byte
+
+// String returns the id in lowercase hex as used by traceparent.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the id in lowercase hex as used by traceparent.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of a span that is passed between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Valid reports whether the trace and span ids are set.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Kind describes the relationship of a span to the services it spans.
+type Kind int
+
+// Set of kinds of spans, numbered like OTLP numbers them.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// =============================================================================
+
+// header is the name of the header carrying the trace context.
+const header = "traceparent"
+
+// Extract returns the span context of the caller from the traceparent header.
+// The returned span context isn't valid when the header is missing or
+// malformed, in which case a new trace is started.
+func Extract(h http.Header) SpanContext {
+	parts := strings.Split(strings.TrimSpace(h.Get(header)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}
+	}
+
+	// Version 00 has exactly four parts, later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}
+	}
+
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.Valid() {
+		return SpanContext{}
+	}
+
+	return sc
+}
+
+// Inject sets the traceparent header to the span in the context, so the
+// service receiving the request continues the trace.
+func Inject(ctx context.Context, h http.Header) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+
+	flags := "00"
+	if s.sc.Sampled {
+		flags = "01"
+	}
+
+	h.Set(header, fmt.Sprintf("00-%s-%s-%s", s.sc.TraceID, s.sc.SpanID, flags))
+}
+
+// =============================================================================
+
+// ctxKey represents the type of value for the context key.
+type ctxKey int
+
+// key is how the span is stored/retrieved.
+const key ctxKey = 1
+
+// FromContext returns the span in the context, nil when there is none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(key).(*Span)
+	return s
+}
+
+// Start begins a span that is a child of the span in the context. Without a
+// span in the context nothing is traced and a nil span is returned, which is
+// safe to use.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := Span{
+		tracer: parent.tracer,
+		name:   name,
+		kind:   kind,
+		parent: parent.sc.SpanID,
+		start:  time.Now(),
+		sc: SpanContext{
+			TraceID: parent.sc.TraceID,
+			SpanID:  newSpanID(),
+			Sampled: parent.sc.Sampled,
+		},
+	}
+
+	return context.WithValue(ctx, key, &s), &s
+}
+
+// Span represents a unit of work within a trace.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   Kind
+	parent SpanID
+	start  time.Time
+	sc     SpanContext
+
+	mu    sync.Mutex
+	attrs map[string]string
+	err   string
+	ended bool
+}
+
+// Context returns the span context of the span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a detail about the work of the span.
+func (s *Span) SetAttribute(k string, v string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[k] = v
+}
+
+// SetError marks the work of the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// End completes the span and hands it to the exporter of the tracer when
+// the trace is sampled. Spans can only be ended once.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		TraceID:    s.sc.TraceID,
+		SpanID:     s.sc.SpanID,
+		ParentID:   s.parent,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attrs,
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.export(data)
+	}
+}
+
+// SpanData is a completed span as exporters receive it.
+type SpanData struct {
+	Name       string
+	Kind       Kind
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// =============================================================================
+
+// Exporter sends completed spans to where they are looked at.
+type Exporter interface {
+	Export(ctx context.Context, service string, spans []SpanData) error
+}
+
+// Config represents the settings of a tracer.
+type Config struct {
+	Service     string
+	Exporter    Exporter
+	Probability float64
+	BatchSize   int
+	Interval    time.Duration
+	ErrorFunc   func(err error)
+}
+
+// Tracer starts the traces of the requests a service handles and exports
+// their spans in batches. A nil tracer starts traces that are never exported.
+type Tracer struct {
+	cfg   Config
+	spans chan SpanData
+	done  chan struct{}
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// New constructs a tracer exporting its spans through the exporter. Without
+// an exporter spans are only used to correlate logs.
+func New(cfg Config) *Tracer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+
+	t := Tracer{
+		cfg:   cfg,
+		spans: make(chan SpanData, 4*cfg.BatchSize),
+		done:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+
+	if cfg.Exporter == nil {
+		close(t.done)
+		return &t
+	}
+
+	go t.run()
+
+	return &t
+}
+
+// StartRequest begins the span of a request received by the service. The
+// request continues the trace of the caller when it carries one, otherwise
+// a new trace is started and sampled with the probability of the tracer.
+func (t *Tracer) StartRequest(ctx context.Context, name string, r *http.Request) (context.Context, *Span) {
+	remote := Extract(r.Header)
+
+	s := Span{
+		tracer: t,
+		name:   name,
+		kind:   KindServer,
+		start:  time.Now(),
+	}
+
+	if remote.Valid() {
+		s.parent = remote.SpanID
+		s.sc = SpanContext{
+			TraceID: remote.TraceID,
+			SpanID:  newSpanID(),
+			Sampled: remote.Sampled,
+		}
+	} else {
+		s.sc = SpanContext{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Sampled: t.sample(),
+		}
+	}
+
+	return context.WithValue(ctx, key, &s), &s
+}
+
+// Shutdown exports the spans that are still waiting and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.once.Do(func() { close(t.stop) })
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sample decides whether a new trace is exported.
+func (t *Tracer) sample() bool {
+	if t == nil || t.cfg.Exporter == nil || t.cfg.Probability <= 0 {
+		return false
+	}
+	if t.cfg.Probability >= 1 {
+		return true
+	}
+
+	id := newSpanID()
+	var n uint64
+	for _, b := range id {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n) < t.cfg.Probability*math.MaxUint64
+}
+
+// export queues the span. Spans are dropped when the exporter can't keep up
+// rather than slowing down requests.
+func (t *Tracer) export(data SpanData) {
+	if t == nil || t.cfg.Exporter == nil {
+		return
+	}
+
+	select {
+	case <-t.stop:
+	case t.spans <- data:
+	default:
+	}
+}
+
+// run exports the queued spans once a batch is full or the interval passed.
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := t.cfg.Exporter.Export(ctx, t.cfg.Service, batch); err != nil && t.cfg.ErrorFunc != nil {
+			t.cfg.ErrorFunc(err)
+		}
+		batch = make([]SpanData, 0, t.cfg.BatchSize)
+	}
+
+	for {
+		select {
+		case data := <-t.spans:
+			batch = append(batch, data)
+			if len(batch) >= t.cfg.BatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-t.stop:
+			for {
+				select {
+				case data := <-t.spans:
+					batch = append(batch, data)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
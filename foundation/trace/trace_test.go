@@ -0,0 +1,110 @@
+package trace_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jnkroeker/makulu/foundation/tests"
+	"github.com/jnkroeker/makulu/foundation/trace"
+)
+
+func TestExtract(t *testing.T) {
+	tt := []struct {
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	t.Log("Given the need to continue the trace of the caller.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen handling traceparent %q.", testID, test.header)
+			{
+				h := http.Header{}
+				h.Set("traceparent", test.header)
+
+				sc := trace.Extract(h)
+				if sc.Valid() != test.valid {
+					t.Fatalf("\t%s\tTest %d:\tShould get valid %v, got %v.", tests.Failed, testID, test.valid, sc.Valid())
+				}
+				t.Logf("\t%s\tTest %d:\tShould get valid %v.", tests.Success, testID, test.valid)
+
+				if sc.Sampled != test.sampled {
+					t.Fatalf("\t%s\tTest %d:\tShould get sampled %v, got %v.", tests.Failed, testID, test.sampled, sc.Sampled)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get sampled %v.", tests.Success, testID, test.sampled)
+			}
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	t.Log("Given the need to export the spans of a request.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen handling a request continuing a sampled trace.", testID)
+		{
+			var buf bytes.Buffer
+			tracer := trace.New(trace.Config{
+				Service:     "test",
+				Exporter:    trace.NewWriter(&buf),
+				Probability: 0,
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/test", nil)
+			r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+			ctx, span := tracer.StartRequest(context.Background(), "GET /v1/test", r)
+			_, child := trace.Start(ctx, "graphql queryUser", trace.KindClient)
+
+			h := http.Header{}
+			trace.Inject(ctx, h)
+			exp := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.Context().SpanID.String() + "-01"
+			if h.Get("traceparent") != exp {
+				t.Logf("\t\tTest %d:\texp: %v", testID, exp)
+				t.Logf("\t\tTest %d:\tgot: %v", testID, h.Get("traceparent"))
+				t.Fatalf("\t%s\tTest %d:\tShould inject the span of the request.", tests.Failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould inject the span of the request.", tests.Success, testID)
+
+			child.End()
+			span.End()
+			if err := tracer.Shutdown(context.Background()); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to shutdown the tracer: %v", tests.Failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to shutdown the tracer.", tests.Success, testID)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould export both spans, got %d.", tests.Failed, testID, len(lines))
+			}
+			t.Logf("\t%s\tTest %d:\tShould export both spans.", tests.Success, testID)
+
+			var got struct {
+				TraceID  string `json:"trace_id"`
+				ParentID string `json:"parent_id"`
+			}
+			if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to read the span: %v", tests.Failed, testID, err)
+			}
+			if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentID != span.Context().SpanID.String() {
+				t.Fatalf("\t%s\tTest %d:\tShould link the child to the request, got %+v.", tests.Failed, testID, got)
+			}
+			t.Logf("\t%s\tTest %d:\tShould link the child to the request.", tests.Success, testID)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetETag sets the entity tag of the response from the version of the
+// entity it holds. Without one, Respond tags successful responses with a
+// hash of their body.
+func SetETag(w http.ResponseWriter, version string) {
+	w.Header().Set("ETag", `"`+version+`"`)
+}
+
+// ErrPreconditionRequired is returned by IfMatch for requests that don't say
+// which version of the entity they change.
+var ErrPreconditionRequired = errors.New("If-Match header with the ETag of the entity is required")
+
+// IfMatch returns the version of the entity the request changes, from the
+// entity tag in its If-Match header. Tags weakened by compression are taken
+// as the version they hold.
+func IfMatch(r *http.Request) (string, error) {
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" {
+		return "", ErrPreconditionRequired
+	}
+
+	return strings.Trim(strings.TrimPrefix(tag, "W/"), `"`), nil
+}
+
+// SetLastModified sets when the entity the response holds last changed, so
+// clients can ask for it only when it changed since.
+func SetLastModified(w http.ResponseWriter, t time.Time) {
+	w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// bodyETag returns a strong entity tag of the body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether the client already has the response, going by
+// the conditional headers of the request. If-Modified-Since only counts
+// when the request has no If-None-Match.
+func notModified(req http.Header, resp http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := resp.Get("ETag")
+		if etag == "" {
+			return false
+		}
+
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || weakMatch(tag, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(resp.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lm.After(ims)
+}
+
+// weakMatch compares the entity tags ignoring whether they're weak, the
+// comparison If-None-Match calls for.
+func weakMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"errors"
+	"net/http"
 	"time"
 )
 
@@ -17,11 +18,26 @@ const key ctxKey = 1
 
 // Values represent state for each request.
 //
+// TraceID is the W3C trace id of the request, continued from the caller
+// when it sent a traceparent header.
+//
 // We're going to stick this in the context for every request.
+//
+// Route is the pattern the request matched, like /v1/user/:id, so requests
+// can be grouped without the ids in their path.
+//
+// Accept is the Accept header of the request, which Respond picks the media
+// type of the response with.
 type Values struct {
 	TraceID    string
 	Now        time.Time
 	StatusCode int
+	Route      string
+	Accept     string
+
+	encoders []Encoder
+	method   string
+	header   http.Header
 }
 
 // GetValues returns the values from the context.
@@ -39,7 +55,7 @@ func GetValues(ctx context.Context) (*Values, error) {
 func GetTraceID(ctx context.Context) string {
 	v, ok := ctx.Value(key).(*Values)
 	if !ok {
-		return "0000000000-0000-0000-0000-0000000000"
+		return "00000000000000000000000000000000"
 	}
 	return v.TraceID
 }
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig represents which browser origins can call the api and how.
+type CORSConfig struct {
+	// Origins are the origins allowed to make requests, like
+	// https://app.example.com. A single * allows every origin.
+	Origins []string
+
+	// Methods allowed for every route. Without any, the methods the route
+	// was registered with are allowed.
+	Methods []string
+
+	// Headers the browser can send. Without any, the headers asked for in
+	// the preflight request are allowed.
+	Headers []string
+
+	// ExposedHeaders can be read by scripts from the response.
+	ExposedHeaders []string
+
+	// Credentials allows requests with cookies and authorization headers.
+	Credentials bool
+
+	// MaxAge is how long browsers can cache the preflight response.
+	MaxAge time.Duration
+}
+
+// cors applies a CORSConfig to requests.
+type cors struct {
+	cfg     CORSConfig
+	any     bool
+	origins map[string]bool
+}
+
+// newCORS constructs the cors support for the configuration.
+func newCORS(cfg CORSConfig) *cors {
+	c := cors{
+		cfg:     cfg,
+		origins: make(map[string]bool),
+	}
+	for _, origin := range cfg.Origins {
+		if origin == "*" {
+			c.any = true
+			continue
+		}
+		c.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	return &c
+}
+
+// allowed returns the origin of a request from an allowed origin. Requests
+// from other origins, and the ones that aren't cross-origin, get none.
+func (c *cors) allowed(r *http.Request) string {
+	if c == nil {
+		return ""
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !c.any && !c.origins[origin] {
+		return ""
+	}
+	return origin
+}
+
+// setOrigin sets the headers that let the browser hand the response to the
+// script that made the request.
+func (c *cors) setOrigin(h http.Header, origin string) {
+
+	// The origin is echoed rather than * since * can't be used with
+	// credentials, so the response varies by origin.
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.cfg.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply sets the CORS headers of the response to a request.
+func (c *cors) apply(w http.ResponseWriter, r *http.Request) {
+	origin := c.allowed(r)
+	if origin == "" {
+		return
+	}
+
+	c.setOrigin(w.Header(), origin)
+	if len(c.cfg.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.cfg.ExposedHeaders, ", "))
+	}
+}
+
+// preflight answers the request a browser makes before a cross-origin
+// request to find out if it's allowed. Requests that aren't allowed get no
+// CORS headers, which the browser takes as a refusal.
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request, methods []string) {
+	allow := methods
+	if c != nil && len(c.cfg.Methods) > 0 {
+		allow = c.cfg.Methods
+	}
+	w.Header().Set("Allow", strings.Join(append([]string{http.MethodOptions}, methods...), ", "))
+
+	origin := c.allowed(r)
+	method := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" || !contains(allow, method) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h := w.Header()
+	c.setOrigin(h, origin)
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(allow, ", "))
+
+	headers := strings.Join(c.cfg.Headers, ", ")
+	if len(c.cfg.Headers) == 0 {
+		headers = r.Header.Get("Access-Control-Request-Headers")
+	}
+	if headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+
+	if c.cfg.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.cfg.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// contains reports whether the method is in the list.
+func contains(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// =============================================================================
+
+// EnableCORS lets browsers call the api from the configured origins. The
+// App answers the preflight requests of every route registered with Handle.
+func (a *App) EnableCORS(cfg CORSConfig) {
+	a.cors = newCORS(cfg)
+}
+
+// handlePreflight registers the preflight handler for the path the first
+// time a method is registered for it, and keeps track of the methods the
+// path handles.
+func (a *App) handlePreflight(method string, path string) {
+	if a.methods == nil {
+		a.methods = make(map[string][]string)
+	}
+
+	methods, ok := a.methods[path]
+	a.methods[path] = append(methods, method)
+	sort.Strings(a.methods[path])
+	if ok {
+		return
+	}
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		a.cors.preflight(w, r, a.methods[path])
+	}
+	a.ContextMux.Handle(http.MethodOptions, path, h)
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNotAcceptable is returned by Respond when none of the media types the
+// client accepts can hold the response.
+var ErrNotAcceptable = errors.New("none of the accepted media types can be produced")
+
+// Encoder converts the values handlers respond with into a body of one
+// media type.
+type Encoder interface {
+
+	// MediaType is the media type of the bodies, like application/json.
+	MediaType() string
+
+	// Encodes reports whether the value can be converted, some media types
+	// only fit some values.
+	Encodes(v interface{}) bool
+
+	// Encode converts the value into a body.
+	Encode(v interface{}) ([]byte, error)
+}
+
+// JSON encodes every value as JSON. It's the encoder of every App and the one
+// used when the client accepts anything.
+type JSON struct{}
+
+// MediaType implements the Encoder interface.
+func (JSON) MediaType() string {
+	return "application/json"
+}
+
+// Encodes implements the Encoder interface.
+func (JSON) Encodes(v interface{}) bool {
+	return true
+}
+
+// Encode implements the Encoder interface.
+func (JSON) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// AddEncoders lets clients ask for responses in other media types with the
+// Accept header. JSON stays the default.
+func (a *App) AddEncoders(encoders ...Encoder) {
+	a.encoders = append(a.encoders, encoders...)
+}
+
+// =============================================================================
+
+// mediaRange is a media type of the Accept header, like application/*, with
+// its preference.
+type mediaRange struct {
+	typ string
+	q   float64
+}
+
+// matches reports whether the media type is in the range.
+func (m mediaRange) matches(mediaType string) bool {
+	switch {
+	case m.typ == "*/*":
+		return true
+	case strings.HasSuffix(m.typ, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(m.typ, "*"))
+	}
+	return m.typ == mediaType
+}
+
+// parseAccept returns the media ranges of the Accept header the client
+// accepts, the most preferred first. No header means anything goes.
+func parseAccept(accept string) []mediaRange {
+	if strings.TrimSpace(accept) == "" {
+		return []mediaRange{{typ: "*/*", q: 1}}
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		m := mediaRange{
+			typ: strings.ToLower(strings.TrimSpace(params[0])),
+			q:   1,
+		}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					m.q = q
+				}
+			}
+		}
+		if m.typ != "" && m.q > 0 {
+			ranges = append(ranges, m)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	return ranges
+}
+
+// negotiate picks the encoder of the response from the ones the client
+// accepts. Error responses fall back to the first encoder, so the client
+// still learns what went wrong.
+func negotiate(accept string, encoders []Encoder, v interface{}, statusCode int) (Encoder, error) {
+	for _, m := range parseAccept(accept) {
+		for _, enc := range encoders {
+			if m.matches(enc.MediaType()) && enc.Encodes(v) {
+				return enc, nil
+			}
+		}
+	}
+
+	if statusCode >= 400 {
+		return encoders[0], nil
+	}
+	return nil, ErrNotAcceptable
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Group is a set of routes that share a path prefix and middleware. Groups
+// can be nested, each adding to the prefix and middleware of its parent.
+type Group struct {
+	app      *App
+	prefix   string
+	mw       []Middleware
+	security []string
+}
+
+// Group constructs a group of routes under the prefix, like /v1. The
+// middleware runs for every route of the group after the middleware of the
+// App and before the middleware of the route.
+func (a *App) Group(prefix string, mw ...Middleware) *Group {
+	return &Group{
+		app:    a,
+		prefix: prefix,
+		mw:     mw,
+	}
+}
+
+// Group constructs a group nested in this one. Its middleware runs after
+// the middleware of this group.
+func (g *Group) Group(prefix string, mw ...Middleware) *Group {
+	return &Group{
+		app:      g.app,
+		prefix:   g.prefix + prefix,
+		mw:       g.middleware(mw),
+		security: g.security,
+	}
+}
+
+// Secure documents that routes of the group, and of groups nested in it
+// afterwards, are authenticated with any of the security schemes.
+func (g *Group) Secure(schemes ...string) *Group {
+	g.security = schemes
+	return g
+}
+
+// Handle sets a handler function for a given HTTP method and a path relative
+// to the prefix of the group. The route is returned so it can be documented.
+func (g *Group) Handle(method string, path string, handler Handler, mw ...Middleware) *Route {
+	return g.app.handle(method, g.prefix+path, handler, g.middleware(mw), g.security)
+}
+
+// middleware returns the middleware of the group followed by mw. It always
+// copies, so groups and routes never share the backing array.
+func (g *Group) middleware(mw []Middleware) []Middleware {
+	all := make([]Middleware, 0, len(g.mw)+len(mw))
+	all = append(all, g.mw...)
+	return append(all, mw...)
+}
+
+// =============================================================================
+
+// Route describes a route registered with the App.
+type Route struct {
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	Handler  string   `json:"handler"`
+	Security []string `json:"security,omitempty"`
+	Doc      *Doc     `json:"-"`
+}
+
+// Routes returns the routes registered with the App ordered by path.
+func (a *App) Routes() []Route {
+	routes := make([]Route, len(a.routes))
+	for i, r := range a.routes {
+		routes[i] = *r
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	return routes
+}
+
+// handlerName returns the name of the function behind the handler, like
+// usergrp.Handlers.Token.
+func handlerName(handler Handler) string {
+	f := runtime.FuncForPC(reflect.ValueOf(handler).Pointer())
+	if f == nil {
+		return ""
+	}
+
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	// Method values are named after a wrapper the compiler generates.
+	return strings.TrimSuffix(name, "-fm")
+}
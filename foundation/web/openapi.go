@@ -0,0 +1,293 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Doc describes a route for the OpenAPI document of the App.
+type Doc struct {
+	Summary string
+
+	// Request is a value of the type the body of a request is decoded into.
+	// OptionalRequest documents that the body can be left out.
+	Request         interface{}
+	OptionalRequest bool
+
+	// Response is a value of the type the body of a successful response is
+	// encoded from, or a OneOf when it can be one of several.
+	Response interface{}
+
+	// Status is the status of a successful response, 200 by default.
+	Status int
+
+	// Query lists the query parameters the route reads.
+	Query []QueryParam
+
+	// Headers lists the request headers the route reads.
+	Headers []HeaderParam
+
+	// Security names the security schemes the route accepts when they
+	// differ from the ones of its group.
+	Security []string
+}
+
+// QueryParam describes a query parameter.
+type QueryParam struct {
+	Name        string
+	Description string
+}
+
+// HeaderParam describes a request header.
+type HeaderParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// OneOf documents a response that can have any one of the types of the
+// values.
+type OneOf []interface{}
+
+// Describe sets the documentation of the route.
+func (r *Route) Describe(doc Doc) *Route {
+	r.Doc = &doc
+	return r
+}
+
+// =============================================================================
+
+// OpenAPIConfig represents what the OpenAPI document says beyond the routes.
+type OpenAPIConfig struct {
+	Title       string
+	Version     string
+	Description string
+
+	// Error is a value of the type the body of an error response has.
+	Error interface{}
+
+	// SecuritySchemes are the ways routes can be authenticated by name.
+	SecuritySchemes map[string]SecurityScheme
+}
+
+// OpenAPI represents an OpenAPI 3 document.
+type OpenAPI struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// Info represents the metadata of the api.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations of a path by lower case method.
+type PathItem map[string]*Operation
+
+// Operation represents a route.
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter represents a path or query parameter.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody represents the body of a request.
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response represents a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas and security schemes operations refer to.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme represents a way to authenticate.
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// =============================================================================
+
+// OpenAPI generates the OpenAPI document of the routes registered with the
+// App. Routes without documentation are listed with their parameters only.
+func (a *App) OpenAPI(cfg OpenAPIConfig) OpenAPI {
+	doc := OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:       cfg.Title,
+			Version:     cfg.Version,
+			Description: cfg.Description,
+		},
+		Paths: make(map[string]PathItem),
+		Components: Components{
+			SecuritySchemes: cfg.SecuritySchemes,
+		},
+	}
+
+	schemas := newSchemas()
+
+	var errorSchema *Schema
+	if cfg.Error != nil {
+		errorSchema = schemas.of(cfg.Error)
+	}
+
+	ids := make(map[string]int)
+	for _, route := range a.Routes() {
+		path, params := openAPIPath(route.Path)
+
+		op := Operation{
+			OperationID: operationID(ids, route.Handler),
+			Parameters:  params,
+			Responses:   make(map[string]Response),
+		}
+
+		security := route.Security
+		status := http.StatusOK
+		var response interface{}
+		if d := route.Doc; d != nil {
+			op.Summary = d.Summary
+			for _, q := range d.Query {
+				op.Parameters = append(op.Parameters, Parameter{
+					Name:        q.Name,
+					In:          "query",
+					Description: q.Description,
+					Schema:      &Schema{Type: "string"},
+				})
+			}
+			for _, h := range d.Headers {
+				op.Parameters = append(op.Parameters, Parameter{
+					Name:        h.Name,
+					In:          "header",
+					Description: h.Description,
+					Required:    h.Required,
+					Schema:      &Schema{Type: "string"},
+				})
+			}
+			if d.Request != nil {
+				op.RequestBody = &RequestBody{
+					Required: !d.OptionalRequest,
+					Content:  jsonContent(schemas.of(d.Request)),
+				}
+			}
+			if d.Security != nil {
+				security = d.Security
+			}
+			if d.Status != 0 {
+				status = d.Status
+			}
+			response = d.Response
+		}
+
+		resp := Response{Description: http.StatusText(status)}
+		if response != nil {
+			resp.Content = jsonContent(schemas.of(response))
+		}
+		op.Responses[fmt.Sprint(status)] = resp
+
+		if errorSchema != nil {
+			op.Responses["default"] = Response{
+				Description: "Error",
+				Content:     jsonContent(errorSchema),
+			}
+		}
+
+		for _, name := range security {
+			op.Security = append(op.Security, map[string][]string{name: {}})
+		}
+
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = make(PathItem)
+			doc.Paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = &op
+	}
+
+	doc.Components.Schemas = schemas.named
+	return doc
+}
+
+// openAPIPath converts a route path like /user/:id to the OpenAPI form
+// /user/{id} and returns the parameters in it.
+func openAPIPath(path string) (string, []Parameter) {
+	var params []Parameter
+
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if seg == "" || seg[0] != ':' && seg[0] != '*' {
+			continue
+		}
+
+		name := seg[1:]
+		segments[i] = "{" + name + "}"
+		params = append(params, Parameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &Schema{Type: "string"},
+		})
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// operationID derives the id of an operation from the name of its handler,
+// like usergrp.Token. Handlers bound to several routes get a number.
+func operationID(ids map[string]int, handler string) string {
+	id := strings.Replace(handler, ".Handlers.", ".", 1)
+	id = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+
+	ids[id]++
+	if n := ids[id]; n > 1 {
+		id = fmt.Sprintf("%s_%d", id, n)
+	}
+	return id
+}
+
+// jsonContent returns the content of a JSON body with the schema.
+func jsonContent(s *Schema) map[string]MediaType {
+	return map[string]MediaType{
+		"application/json": {Schema: s},
+	}
+}
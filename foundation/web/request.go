@@ -2,7 +2,13 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"reflect"
+	"strings"
 
 	"github.com/dimfeld/httptreemux/v5"
 )
@@ -13,15 +19,140 @@ func Param(r *http.Request, key string) string {
 	return m[key]
 }
 
+// ErrBodyTooLarge is returned when the body of a request is larger than the
+// App allows.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// DecodeError is returned when the body of a request isn't a JSON document
+// that fits the value it is decoded into. Field is the path to the value in
+// error, like address.city, when the error is about one.
+type DecodeError struct {
+	Field   string
+	Message string
+}
+
+// Error implements the error interface.
+func (e *DecodeError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
 // Decode reads the body of an HTTP request looking for a JSON document.
 // The body is decoded into the provided value.
 //
-// If the provided value is a struct then it is checked for validation tags.
+// The body must hold exactly one document and every field in it must exist
+// in the value. Bodies that don't are reported with a DecodeError and bodies
+// over the limit of the App with ErrBodyTooLarge.
 func Decode(r *http.Request, val interface{}) error {
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(val); err != nil {
-		return err
+		return decodeError(err)
+	}
+
+	// Anything after the document is a mistake of the client.
+	if _, err := decoder.Token(); err != io.EOF {
+		if errors.Is(err, ErrBodyTooLarge) {
+			return ErrBodyTooLarge
+		}
+		return &DecodeError{Message: "body must only contain a single JSON document"}
 	}
+
 	return nil
 }
+
+// decodeError turns the errors of the JSON decoder about the body into
+// DecodeErrors the client can act on.
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		return ErrBodyTooLarge
+	case errors.Is(err, io.EOF):
+		return &DecodeError{Message: "body must not be empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &DecodeError{Message: "body contains malformed JSON"}
+	case errors.As(err, &syntaxErr):
+		return &DecodeError{Message: fmt.Sprintf("body contains malformed JSON at offset %d", syntaxErr.Offset)}
+	case errors.As(err, &typeErr):
+		return &DecodeError{Field: typeErr.Field, Message: fmt.Sprintf("must be %s, not %s", jsonType(typeErr.Type), typeErr.Value)}
+	}
+
+	// The decoder has no error type for unknown fields.
+	if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+		return &DecodeError{Field: strings.Trim(name, `"`), Message: "unknown field"}
+	}
+
+	return err
+}
+
+// jsonType returns the JSON type values of the Go type are decoded from.
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+// =============================================================================
+
+// SetMaxBodySize sets the largest body in bytes a request can have. Reading
+// more of a body fails with ErrBodyTooLarge. Zero means no limit.
+func (a *App) SetMaxBodySize(n int64) {
+	a.maxBody = n
+}
+
+// limitedBody fails reads beyond the limit of the App.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read implements the io.Reader interface.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	// Read one byte more than allowed to find out if the body is larger.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// ClientIP returns the address of the client that made the request without
+// the port. Forwarding headers are ignored since any client can set them.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -2,11 +2,12 @@ package web
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
 )
 
-// Respond converts a Go value to JSON and sends it to the client.
+// Respond converts a Go value to the media type the client accepts, JSON by
+// default, and sends it to the client. It returns ErrNotAcceptable when the
+// App can't produce any of the media types the client accepts.
 //
 // Isn't this a business concern, thus live in the business layer?
 // If we decide the web package is setting a policy for how we communicate, it creates more consistency to put in here.
@@ -22,22 +23,61 @@ func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statu
 		return nil
 	}
 
-	// Convert the response value to JSON.
-	jsonData, err := json.Marshal(data)
+	// Responses written outside of an App have no values.
+	v, _ := GetValues(ctx)
+
+	// Pick the media type the client prefers out of the ones the App can
+	// produce, JSON unless it was asked for another one.
+	var enc Encoder = JSON{}
+	if v != nil && len(v.encoders) > 1 {
+		w.Header().Add("Vary", "Accept")
+		var err error
+		if enc, err = negotiate(v.Accept, v.encoders, data, statusCode); err != nil {
+			return err
+		}
+	}
+
+	// Convert the response value to the media type.
+	body, err := enc.Encode(data)
 	if err != nil {
 		return err
 	}
 
+	// Successful reads are tagged, so clients can ask for them again only
+	// when they changed. The handler may have tagged it with the version of
+	// the entity already.
+	if v != nil && statusCode == http.StatusOK && (v.method == http.MethodGet || v.method == http.MethodHead) {
+		if w.Header().Get("ETag") == "" {
+			w.Header().Set("ETag", bodyETag(body))
+		}
+		if notModified(v.header, w.Header()) {
+			SetStatusCode(ctx, http.StatusNotModified)
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
 	// Set the content type and headers once we know marshaling has succeeded.
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", enc.MediaType())
 
 	// Write the status code to the response.
 	w.WriteHeader(statusCode)
 
 	// Send the result back to the client.
-	if _, err := w.Write(jsonData); err != nil {
+	if _, err := w.Write(body); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Redirect sends the client to the specified url. The status code must be
+// one of the 3xx redirect codes.
+func Redirect(ctx context.Context, w http.ResponseWriter, r *http.Request, url string, statusCode int) error {
+
+	// Set the status code for the request logger middleware
+	SetStatusCode(ctx, statusCode)
+
+	http.Redirect(w, r, url, statusCode)
+	return nil
+}
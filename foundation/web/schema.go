@@ -0,0 +1,299 @@
+package web
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema represents the JSON schema of a value in an OpenAPI document.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// schemas derives schemas from Go types. Named struct types become named
+// schemas that are referred to, so each is only described once.
+type schemas struct {
+	named map[string]*Schema
+}
+
+// newSchemas constructs an empty set of named schemas.
+func newSchemas() *schemas {
+	return &schemas{
+		named: make(map[string]*Schema),
+	}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// of returns the schema of the value, which can also be a OneOf.
+func (s *schemas) of(v interface{}) *Schema {
+	if one, ok := v.(OneOf); ok {
+		var sch Schema
+		for _, v := range one {
+			sch.OneOf = append(sch.OneOf, s.of(v))
+		}
+		return &sch
+	}
+
+	return s.schema(reflect.TypeOf(v))
+}
+
+// schema returns the schema of the type as encoding/json encodes it.
+func (s *schemas) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawJSONType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: s.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.schema(t.Elem())}
+	case reflect.Struct:
+		return s.structSchema(t)
+	}
+
+	// Interfaces can hold anything.
+	return &Schema{}
+}
+
+// structSchema returns a reference to the named schema of a named struct
+// type and the schema itself for anonymous ones.
+func (s *schemas) structSchema(t reflect.Type) *Schema {
+	if t.Name() == "" {
+		return s.object(t)
+	}
+
+	name := path.Base(t.PkgPath()) + "." + t.Name()
+	ref := &Schema{Ref: "#/components/schemas/" + name}
+	if _, ok := s.named[name]; ok {
+		return ref
+	}
+
+	// Claim the name before describing the fields, so types that refer to
+	// themselves end up with a reference.
+	s.named[name] = &Schema{}
+	*s.named[name] = *s.object(t)
+
+	return ref
+}
+
+// object describes the fields of the struct as properties.
+func (s *schemas) object(t reflect.Type) *Schema {
+	sch := Schema{
+		Type:       "object",
+		Properties: make(map[string]*Schema),
+	}
+	s.fields(&sch, t)
+	return &sch
+}
+
+// fields adds the fields of the struct to the schema. The fields of
+// embedded structs are added as if they were declared in the struct.
+func (s *schemas) fields(sch *Schema, t reflect.Type) {
+
+	// Rules comparing fields name them as declared in Go.
+	names := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, ok := jsonName(t.Field(i)); ok {
+			names[t.Field(i).Name] = name
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, omitempty, ok := jsonName(f)
+		if !ok {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			s.fields(sch, ft)
+			continue
+		}
+
+		prop := s.schema(f.Type)
+		required := applyRules(prop, f.Tag.Get("validate"), names)
+		if required && !omitempty {
+			sch.Required = append(sch.Required, name)
+		}
+		sch.Properties[name] = prop
+	}
+}
+
+// jsonName returns the name encoding/json gives the field and whether it
+// is left out when empty. Fields encoding/json ignores aren't ok.
+func jsonName(f reflect.StructField) (string, bool, bool) {
+	if f.PkgPath != "" && !f.Anonymous {
+		return "", false, false
+	}
+
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = f.Name
+	}
+
+	var omitempty bool
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+
+	return name, omitempty, true
+}
+
+// applyRules adds what the rules of a validate struct tag say about the
+// value to its schema and reports whether the value is required. Rules
+// after dive apply to the items of a slice or map. Fields other rules refer
+// to are looked up in names.
+func applyRules(sch *Schema, tag string, names map[string]string) bool {
+	if tag == "" {
+		return false
+	}
+
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		if rule == "dive" {
+			target := sch.Items
+			if target == nil {
+				target = sch.AdditionalProperties
+			}
+			if target != nil {
+				applyRules(target, strings.Join(rules[i+1:], ","), names)
+			}
+			rules = rules[:i]
+			break
+		}
+	}
+
+	var required bool
+	for _, rule := range rules {
+		name, param := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, param = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			required = true
+		case "oneof":
+			sch.Enum = strings.Fields(param)
+		case "email":
+			sch.Format = "email"
+		case "url", "uri":
+			sch.Format = "uri"
+		case "uuid", "uuid4":
+			sch.Format = "uuid"
+		case "latitude":
+			sch.Minimum, sch.Maximum = float(-90), float(90)
+		case "longitude":
+			sch.Minimum, sch.Maximum = float(-180), float(180)
+		case "min", "gte":
+			bound(sch, param, true)
+		case "max", "lte":
+			bound(sch, param, false)
+		case "len":
+			bound(sch, param, true)
+			bound(sch, param, false)
+		case "eqfield":
+			if n, ok := names[param]; ok {
+				param = n
+			}
+			sch.Description = "Must be equal to " + param + "."
+		}
+	}
+
+	return required
+}
+
+// bound sets the lower or upper bound of the value, which is the length of
+// strings, the number of items of arrays and the value of numbers.
+func bound(sch *Schema, param string, lower bool) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+
+	switch sch.Type {
+	case "string":
+		if lower {
+			sch.MinLength = integer(n)
+		} else {
+			sch.MaxLength = integer(n)
+		}
+	case "array":
+		if lower {
+			sch.MinItems = integer(n)
+		} else {
+			sch.MaxItems = integer(n)
+		}
+	case "integer", "number":
+		if lower {
+			sch.Minimum = float(n)
+		} else {
+			sch.Maximum = float(n)
+		}
+	}
+}
+
+func float(n float64) *float64 {
+	return &n
+}
+
+func integer(n float64) *int {
+	i := int(n)
+	return &i
+}
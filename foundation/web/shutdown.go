@@ -4,6 +4,7 @@ package web
 
 import (
 	"errors"
+	"fmt"
 )
 
 // shutdownError is a type used to help with the graceful termination of the service.
@@ -39,3 +40,48 @@ func IsShutdown(err error) bool {
 	var se *shutdownError
 	return errors.As(err, &se)
 }
+
+// =============================================================================
+
+// ShutdownPolicy decides which errors returned by a handler chain shut the
+// service down.
+type ShutdownPolicy int
+
+// Set of policies for shutting the service down.
+const (
+	// ShutdownOnIntegrity shuts down on errors created by NewShutdownError
+	// only. Every other error failed just the one request.
+	ShutdownOnIntegrity ShutdownPolicy = iota
+
+	// ShutdownOnAnyError shuts down on every error that reaches the App.
+	ShutdownOnAnyError
+
+	// ShutdownNever keeps the service running whatever the error.
+	ShutdownNever
+)
+
+// ParseShutdownPolicy parses a policy from configuration: integrity, any
+// or never.
+func ParseShutdownPolicy(s string) (ShutdownPolicy, error) {
+	switch s {
+	case "integrity":
+		return ShutdownOnIntegrity, nil
+	case "any":
+		return ShutdownOnAnyError, nil
+	case "never":
+		return ShutdownNever, nil
+	}
+	return 0, fmt.Errorf("unknown shutdown policy %q, use integrity, any or never", s)
+}
+
+// shutdownFor reports whether the policy shuts the service down on the error.
+func (p ShutdownPolicy) shutdownFor(err error) bool {
+	switch p {
+	case ShutdownOnAnyError:
+		return true
+	case ShutdownNever:
+		return false
+	default:
+		return IsShutdown(err)
+	}
+}
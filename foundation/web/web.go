@@ -5,11 +5,12 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/dimfeld/httptreemux/v5"
-	"github.com/google/uuid"
+	"github.com/jnkroeker/makulu/foundation/trace"
 )
 
 // KeyValues is how request values are stored/retrieved.
@@ -24,8 +25,21 @@ type App struct {
 	*httptreemux.ContextMux
 	shutdown chan os.Signal
 	mw       []Middleware
+	tracer   *trace.Tracer
+	policy   ShutdownPolicy
+	onError  ErrorHook
+	cors     *cors
+	methods  map[string][]string
+	routes   []*Route
+	maxBody  int64
+	encoders []Encoder
 }
 
+// ErrorHook is called with the errors that failed a request without
+// shutting the service down, like a client that went away while the error
+// response was written.
+type ErrorHook func(ctx context.Context, r *http.Request, err error)
+
 // NewApp creates an App value that handles a set of routes for the application.
 // The `mw` parameter allows passing ZERO to many middleware functions.
 // We dont want to the slice; in that case we must pass nil in cases we dont need middleware
@@ -35,12 +49,36 @@ func NewApp(shutdown chan os.Signal, mw ...Middleware) *App {
 		ContextMux: httptreemux.NewContextMux(),
 		shutdown:   shutdown,
 		mw:         mw,
+		encoders:   []Encoder{JSON{}},
 	}
 }
 
+// SetTracer sets the tracer that starts a span for every request. Without
+// one requests still get a trace id but no spans are exported.
+func (a *App) SetTracer(tracer *trace.Tracer) {
+	a.tracer = tracer
+}
+
+// SetShutdownPolicy sets which errors reaching the App shut the service
+// down. By default only errors created by NewShutdownError do.
+func (a *App) SetShutdownPolicy(policy ShutdownPolicy) {
+	a.policy = policy
+}
+
+// SetErrorHook sets the function errors that don't shut the service down
+// are reported to. Without one they are dropped.
+func (a *App) SetErrorHook(hook ErrorHook) {
+	a.onError = hook
+}
+
 // SignalShutdown is use to gracefully shutdown the app when an integrity issue is identified
+// A shutdown already signaled isn't signaled again, so failing requests
+// don't block waiting for it.
 func (a *App) SignalShutdown() {
-	a.shutdown <- syscall.SIGTERM
+	select {
+	case a.shutdown <- syscall.SIGTERM:
+	default:
+	}
 }
 
 // A Handler is a type that handles an http request within our mini framework
@@ -51,7 +89,25 @@ type Handler func(ctx context.Context, w http.ResponseWriter, r *http.Request) e
 // This is overriding the ContextMux Handle method with our own implementation
 //
 // There are middlewares that need to be applied at a handler level; like authentication
-func (a *App) Handle(method string, group string, path string, handler Handler, mw ...Middleware) {
+func (a *App) Handle(method string, group string, path string, handler Handler, mw ...Middleware) *Route {
+	finalPath := path
+	if group != "" {
+		finalPath = "/" + group + path
+	}
+
+	return a.handle(method, finalPath, handler, mw, nil)
+}
+
+// handle binds the handler to the full path of the route and returns the
+// route so it can be documented.
+func (a *App) handle(method string, finalPath string, handler Handler, mw []Middleware, security []string) *Route {
+	route := Route{
+		Method:   method,
+		Path:     finalPath,
+		Handler:  handlerName(handler),
+		Security: security,
+	}
+	a.routes = append(a.routes, &route)
 
 	// First wrap middleware specific to the passed in handler function.
 	handler = wrapMiddleware(mw, handler)
@@ -73,8 +129,22 @@ func (a *App) Handle(method string, group string, path string, handler Handler,
 		// Visually you can think of each layer of middleware being called before calling the next middleware
 		// and wrapping the next handler as this comment does
 
-		// Pull the context from the request
-		ctx := r.Context()
+		// Bodies larger than the App allows are cut off, so a client can't
+		// make a handler read an unbounded amount of data.
+		if a.maxBody > 0 && r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: a.maxBody}
+		}
+
+		// Responses to browsers calling from another origin need to say
+		// they can be read, whatever the handler chain ends up writing.
+		a.cors.apply(w, r)
+
+		// Pull the context from the request and continue the trace of
+		// the caller, if any, with a span for this request.
+		ctx, span := a.tracer.StartRequest(r.Context(), r.Method+" "+finalPath, r)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", finalPath)
+		defer span.End()
 
 		// Set the context with the required values
 		// process the request
@@ -83,17 +153,35 @@ func (a *App) Handle(method string, group string, path string, handler Handler,
 		//
 		// could, later, associate a userid with a traceid to help with debugging ;)
 		v := Values{
-			TraceID: uuid.New().String(),
+			TraceID: span.Context().TraceID.String(),
 			Now:     time.Now(),
+			Route:   finalPath,
+			Accept:  r.Header.Get("Accept"),
+
+			encoders: a.encoders,
+			method:   r.Method,
+			header:   r.Header,
 		}
 
 		ctx = context.WithValue(ctx, key, &v)
 
 		// handler is now one function, wrapped with middleware, that will call all the middleware functions
-		if err := handler(ctx, w, r); err != nil {
+		err := handler(ctx, w, r)
+		span.SetAttribute("http.status_code", strconv.Itoa(v.StatusCode))
+		if err != nil {
 			// Logging error - handle it
 			// We need a way to inject code from the business layer here (aka middleware)
-			a.SignalShutdown()
+			span.SetError(err)
+
+			// Only integrity issues take the service down, unless the
+			// policy says otherwise. Anything else failed this request.
+			if a.policy.shutdownFor(err) {
+				a.SignalShutdown()
+				return
+			}
+			if a.onError != nil {
+				a.onError(ctx, r, err)
+			}
 			return
 		}
 
@@ -105,12 +193,13 @@ func (a *App) Handle(method string, group string, path string, handler Handler,
 		// and wrapping the next handler as this comment does
 	}
 
-	finalPath := path
-	if group != "" {
-		finalPath = "/" + group + path
-	}
-
 	// the only thing we can ever actually bind to the mux is using the Handle method from the mux
 	// this is the true implementation of the mux; now living inside our App wrapper
 	a.ContextMux.Handle(method, finalPath, h)
+
+	// OPTIONS requests for the path are answered by the App, which is how
+	// browsers ask whether they can call it from another origin.
+	a.handlePreflight(method, finalPath)
+
+	return &route
 }
@@ -0,0 +1,372 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnkroeker/makulu/foundation/tests"
+	"github.com/jnkroeker/makulu/foundation/web"
+)
+
+func TestShutdownPolicy(t *testing.T) {
+	tt := []struct {
+		name     string
+		policy   web.ShutdownPolicy
+		err      error
+		shutdown bool
+		reported bool
+	}{
+		{"integrity, request error", web.ShutdownOnIntegrity, errors.New("write: broken pipe"), false, true},
+		{"integrity, shutdown error", web.ShutdownOnIntegrity, web.NewShutdownError("web value missing from context"), true, false},
+		{"integrity, no error", web.ShutdownOnIntegrity, nil, false, false},
+		{"any, request error", web.ShutdownOnAnyError, errors.New("write: broken pipe"), true, false},
+		{"never, shutdown error", web.ShutdownNever, web.NewShutdownError("web value missing from context"), false, true},
+	}
+
+	t.Log("Given the need to only shut down the service on integrity issues.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen a handler returns with policy %s.", testID, test.name)
+			{
+				shutdown := make(chan os.Signal, 1)
+				app := web.NewApp(shutdown)
+				app.SetShutdownPolicy(test.policy)
+
+				var reported error
+				app.SetErrorHook(func(ctx context.Context, r *http.Request, err error) {
+					reported = err
+				})
+
+				app.Handle(http.MethodGet, "v1", "/test", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return test.err
+				})
+
+				app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/test", nil))
+
+				signaled := len(shutdown) == 1
+				if signaled != test.shutdown {
+					t.Fatalf("\t%s\tTest %d:\tShould signal shutdown %v, got %v.", tests.Failed, testID, test.shutdown, signaled)
+				}
+				t.Logf("\t%s\tTest %d:\tShould signal shutdown %v.", tests.Success, testID, test.shutdown)
+
+				if (reported != nil) != test.reported {
+					t.Fatalf("\t%s\tTest %d:\tShould report the error %v, got %v.", tests.Failed, testID, test.reported, reported)
+				}
+				if test.reported && reported != test.err {
+					t.Fatalf("\t%s\tTest %d:\tShould report the error of the handler, got %v.", tests.Failed, testID, reported)
+				}
+				t.Logf("\t%s\tTest %d:\tShould report the error %v.", tests.Success, testID, test.reported)
+			}
+		}
+	}
+}
+
+func TestSignalShutdown(t *testing.T) {
+	t.Log("Given the need to not block requests once shutdown was signaled.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen several requests fail with an integrity issue.", testID)
+		{
+			shutdown := make(chan os.Signal, 1)
+			app := web.NewApp(shutdown)
+			app.Handle(http.MethodGet, "v1", "/test", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return web.NewShutdownError("integrity issue")
+			})
+
+			for i := 0; i < 3; i++ {
+				app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/test", nil))
+			}
+
+			if len(shutdown) != 1 {
+				t.Fatalf("\t%s\tTest %d:\tShould have a single shutdown signal pending, got %d.", tests.Failed, testID, len(shutdown))
+			}
+			t.Logf("\t%s\tTest %d:\tShould have a single shutdown signal pending.", tests.Success, testID)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tt := []struct {
+		name   string
+		method string
+		origin string
+		allow  string
+	}{
+		{"preflight from an allowed origin", http.MethodOptions, "https://app.example.com", "https://app.example.com"},
+		{"preflight from another origin", http.MethodOptions, "https://evil.example.com", ""},
+		{"request from an allowed origin", http.MethodGet, "https://app.example.com", "https://app.example.com"},
+		{"request from another origin", http.MethodGet, "https://evil.example.com", ""},
+	}
+
+	t.Log("Given the need to let the browser frontend call the api from another origin.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen handling a %s.", testID, test.name)
+			{
+				app := web.NewApp(make(chan os.Signal, 1))
+				app.EnableCORS(web.CORSConfig{
+					Origins: []string{"https://app.example.com"},
+					Headers: []string{"Authorization"},
+				})
+				h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return web.Respond(ctx, w, nil, http.StatusNoContent)
+				}
+				app.Handle(http.MethodGet, "v1", "/action/:id", h)
+				app.Handle(http.MethodDelete, "v1", "/action/:id", h)
+
+				r := httptest.NewRequest(test.method, "/v1/action/1", nil)
+				r.Header.Set("Origin", test.origin)
+				r.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+
+				if w.Code != http.StatusNoContent {
+					t.Fatalf("\t%s\tTest %d:\tShould receive a status code of %d, got %d.", tests.Failed, testID, http.StatusNoContent, w.Code)
+				}
+				t.Logf("\t%s\tTest %d:\tShould receive a status code of %d.", tests.Success, testID, http.StatusNoContent)
+
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+					t.Fatalf("\t%s\tTest %d:\tShould allow origin %q, got %q.", tests.Failed, testID, test.allow, got)
+				}
+				t.Logf("\t%s\tTest %d:\tShould allow origin %q.", tests.Success, testID, test.allow)
+
+				if test.method == http.MethodOptions && test.allow != "" {
+					if got := w.Header().Get("Access-Control-Allow-Methods"); got != "DELETE, GET" {
+						t.Fatalf("\t%s\tTest %d:\tShould allow the methods of the route, got %q.", tests.Failed, testID, got)
+					}
+					t.Logf("\t%s\tTest %d:\tShould allow the methods of the route.", tests.Success, testID)
+				}
+			}
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	t.Log("Given the need to share a prefix and middleware between routes.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen handling a request to a route of a nested group.", testID)
+		{
+			var order []string
+			mark := func(name string) web.Middleware {
+				return func(handler web.Handler) web.Handler {
+					return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+						order = append(order, name)
+						return handler(ctx, w, r)
+					}
+				}
+			}
+
+			app := web.NewApp(make(chan os.Signal, 1), mark("app"))
+			v1 := app.Group("/v1", mark("v1"))
+			admin := v1.Group("/admin", mark("admin"))
+			admin.Handle(http.MethodGet, "/users", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return web.Respond(ctx, w, nil, http.StatusNoContent)
+			}, mark("route"))
+
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/admin/users", nil))
+
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("\t%s\tTest %d:\tShould receive a status code of %d, got %d.", tests.Failed, testID, http.StatusNoContent, w.Code)
+			}
+			t.Logf("\t%s\tTest %d:\tShould receive a status code of %d.", tests.Success, testID, http.StatusNoContent)
+
+			if got := strings.Join(order, " "); got != "app v1 admin route" {
+				t.Fatalf("\t%s\tTest %d:\tShould run the middleware from the outside in, got %q.", tests.Failed, testID, got)
+			}
+			t.Logf("\t%s\tTest %d:\tShould run the middleware from the outside in.", tests.Success, testID)
+
+			routes := app.Routes()
+			if len(routes) != 1 || routes[0].Path != "/v1/admin/users" || routes[0].Method != http.MethodGet {
+				t.Fatalf("\t%s\tTest %d:\tShould list the route, got %v.", tests.Failed, testID, routes)
+			}
+			t.Logf("\t%s\tTest %d:\tShould list the route.", tests.Success, testID)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type user struct {
+		Name    string  `json:"name"`
+		Address address `json:"address"`
+	}
+
+	tt := []struct {
+		name  string
+		body  string
+		field string
+		large bool
+	}{
+		{"a valid document", `{"name":"bill","address":{"city":"miami"}}`, "", false},
+		{"an empty body", ``, "", false},
+		{"malformed JSON", `{"name":`, "", false},
+		{"a value of the wrong type", `{"address":{"city":5}}`, "address.city", false},
+		{"an unknown field", `{"nickname":"bill"}`, "nickname", false},
+		{"trailing data", `{"name":"bill"}{}`, "", false},
+		{"a body over the limit", `{"name":"` + strings.Repeat("x", 64) + `"}`, "", true},
+	}
+
+	t.Log("Given the need to only accept well formed request bodies.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen decoding %s.", testID, test.name)
+			{
+				var err error
+				app := web.NewApp(make(chan os.Signal, 1))
+				app.SetMaxBodySize(64)
+				app.Handle(http.MethodPost, "v1", "/users", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					var u user
+					err = web.Decode(r, &u)
+					return web.Respond(ctx, w, nil, http.StatusNoContent)
+				})
+
+				app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(test.body)))
+
+				var decodeErr *web.DecodeError
+				switch {
+				case test.large:
+					if !errors.Is(err, web.ErrBodyTooLarge) {
+						t.Fatalf("\t%s\tTest %d:\tShould fail with ErrBodyTooLarge, got %v.", tests.Failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould fail with ErrBodyTooLarge.", tests.Success, testID)
+				case testID == 0:
+					if err != nil {
+						t.Fatalf("\t%s\tTest %d:\tShould decode the body, got %v.", tests.Failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould decode the body.", tests.Success, testID)
+				default:
+					if !errors.As(err, &decodeErr) {
+						t.Fatalf("\t%s\tTest %d:\tShould fail with a DecodeError, got %v.", tests.Failed, testID, err)
+					}
+					if decodeErr.Field != test.field {
+						t.Fatalf("\t%s\tTest %d:\tShould point at field %q, got %q.", tests.Failed, testID, test.field, decodeErr.Field)
+					}
+					t.Logf("\t%s\tTest %d:\tShould fail with a DecodeError for field %q.", tests.Success, testID, test.field)
+				}
+			}
+		}
+	}
+}
+
+// text encodes strings as plain text.
+type text struct{}
+
+func (text) MediaType() string { return "text/plain" }
+
+func (text) Encodes(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func (text) Encode(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+
+func TestRespond(t *testing.T) {
+	tt := []struct {
+		name        string
+		accept      string
+		v           interface{}
+		status      int
+		contentType string
+		err         error
+	}{
+		{"no Accept header", "", "hi", http.StatusOK, "application/json", nil},
+		{"the preferred media type", "application/json;q=0.5, text/plain", "hi", http.StatusOK, "text/plain", nil},
+		{"a media range", "text/*", "hi", http.StatusOK, "text/plain", nil},
+		{"a media type that can't hold the value", "text/plain, application/json;q=0.1", 5, http.StatusOK, "application/json", nil},
+		{"only unknown media types", "image/png", "hi", http.StatusOK, "", web.ErrNotAcceptable},
+		{"an error for unknown media types", "image/png", "hi", http.StatusBadRequest, "application/json", nil},
+	}
+
+	t.Log("Given the need to respond in the media type the client accepts.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen responding to a request with %s.", testID, test.name)
+			{
+				var err error
+				app := web.NewApp(make(chan os.Signal, 1))
+				app.AddEncoders(text{})
+				app.Handle(http.MethodGet, "v1", "/test", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					err = web.Respond(ctx, w, test.v, test.status)
+					return nil
+				})
+
+				r := httptest.NewRequest(http.MethodGet, "/v1/test", nil)
+				r.Header.Set("Accept", test.accept)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+
+				if err != test.err {
+					t.Fatalf("\t%s\tTest %d:\tShould get error %v, got %v.", tests.Failed, testID, test.err, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get error %v.", tests.Success, testID, test.err)
+
+				if got := w.Header().Get("Content-Type"); got != test.contentType {
+					t.Fatalf("\t%s\tTest %d:\tShould respond with %q, got %q.", tests.Failed, testID, test.contentType, got)
+				}
+				t.Logf("\t%s\tTest %d:\tShould respond with %q.", tests.Success, testID, test.contentType)
+			}
+		}
+	}
+}
+
+func TestConditional(t *testing.T) {
+	modified := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"no conditions", "", "", http.StatusOK},
+		{"a matching If-None-Match", "If-None-Match", `"v1"`, http.StatusNotModified},
+		{"a weak matching If-None-Match", "If-None-Match", `"v0", W/"v1"`, http.StatusNotModified},
+		{"another If-None-Match", "If-None-Match", `"v0"`, http.StatusOK},
+		{"an If-Modified-Since after the change", "If-Modified-Since", modified.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified},
+		{"an If-Modified-Since before the change", "If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	}
+
+	t.Log("Given the need to only send responses the client doesn't have.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen a request has %s.", testID, test.name)
+			{
+				app := web.NewApp(make(chan os.Signal, 1))
+				app.Handle(http.MethodGet, "v1", "/test", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					web.SetETag(w, "v1")
+					web.SetLastModified(w, modified)
+					return web.Respond(ctx, w, "hi", http.StatusOK)
+				})
+
+				r := httptest.NewRequest(http.MethodGet, "/v1/test", nil)
+				if test.header != "" {
+					r.Header.Set(test.header, test.value)
+				}
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+
+				if w.Code != test.status {
+					t.Fatalf("\t%s\tTest %d:\tShould receive a status code of %d, got %d.", tests.Failed, testID, test.status, w.Code)
+				}
+				t.Logf("\t%s\tTest %d:\tShould receive a status code of %d.", tests.Success, testID, test.status)
+
+				if got := w.Header().Get("ETag"); got != `"v1"` {
+					t.Fatalf("\t%s\tTest %d:\tShould tag the response with the version, got %q.", tests.Failed, testID, got)
+				}
+				t.Logf("\t%s\tTest %d:\tShould tag the response with the version.", tests.Success, testID)
+			}
+		}
+	}
+}